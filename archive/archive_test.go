@@ -0,0 +1,236 @@
+package archive_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/archive"
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+var day = time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+
+// record archives a realtime update for each of the given frame numbers, the
+// frame number of seconds after noon on day.
+func record(t *testing.T, recorder *archive.Recorder, monitorID int, frames ...int) {
+	t.Helper()
+	for _, frame := range frames {
+		at := day.Add(time.Duration(frame) * time.Second)
+		if err := recorder.Record(&archive.Frame{
+			Time:      at,
+			MonitorID: monitorID,
+			Message:   string(message(t, sensetest.RealtimeUpdate(at, frame))),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func message(t *testing.T, update *sense.RealtimeUpdate) []byte {
+	t.Helper()
+	data, err := json.Marshal(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// replayed returns the frame numbers of the realtime updates in directory.
+func replayed(t *testing.T, directory string, options archive.ReplayOptions) []int {
+	t.Helper()
+	var frames []int
+	err := archive.ReplayUpdates(context.Background(), directory, options, func(monitorID int, update *sense.RealtimeUpdate) error {
+		frames = append(frames, update.Payload.FrameNumber)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+func checkFrames(t *testing.T, got []int, want ...int) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got frames %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got frames %v, want %v", got, want)
+		}
+	}
+}
+
+func TestReplayAfterCrash(t *testing.T) {
+	directory := t.TempDir()
+
+	// The first run dies without closing its file, leaving it without a
+	// gzip trailer.
+	crashed, err := archive.NewRecorder(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, crashed, 1, 1, 2, 3)
+
+	// The next run starts a new file rather than append to the broken one.
+	recorder, err := archive.NewRecorder(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, recorder, 1, 4, 5)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// That one was closed cleanly, so the run after appends to it.
+	recorder, err = archive.NewRecorder(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, recorder, 1, 6)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(directory, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"frames-2024-03-01.1.jsonl.gz", "frames-2024-03-01.jsonl.gz"}
+	if len(names) != len(want) || filepath.Base(names[0]) != want[0] || filepath.Base(names[1]) != want[1] {
+		t.Errorf("got files %v, want %v", names, want)
+	}
+	checkFrames(t, replayed(t, directory, archive.ReplayOptions{}), 1, 2, 3, 4, 5, 6)
+}
+
+func TestReplaySkipsUnreadableData(t *testing.T) {
+	directory := t.TempDir()
+	crashed, err := archive.NewRecorder(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, crashed, 1, 1, 2)
+
+	// Appending a gzip member after one without a trailer makes the rest of
+	// the file unreadable, but the frames before it still replay, as do
+	// later files.
+	path := filepath.Join(directory, "frames-2024-03-01.jsonl.gz")
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xffnot deflate"))
+	file.Close()
+	next := day.AddDate(0, 0, 1)
+	recorder, err := archive.NewRecorder(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Record(&archive.Frame{
+		Time:      next,
+		MonitorID: 1,
+		Message:   string(message(t, sensetest.RealtimeUpdate(next, 3))),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+
+	checkFrames(t, replayed(t, directory, archive.ReplayOptions{}), 1, 2, 3)
+}
+
+func TestReplayRange(t *testing.T) {
+	directory := t.TempDir()
+	recorder, err := archive.NewRecorder(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, recorder, 1, 1, 2, 3, 4, 5)
+	record(t, recorder, 2, 6)
+	if err := recorder.Record(&archive.Frame{Time: day.Add(7 * time.Second), MonitorID: 3, Message: "not json"}); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+
+	checkFrames(t, replayed(t, directory, archive.ReplayOptions{
+		From: day.Add(2 * time.Second),
+		To:   day.Add(4 * time.Second),
+	}), 2, 3, 4)
+
+	monitors, err := archive.Monitors(context.Background(), directory, archive.ReplayOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(monitors) != 3 || monitors[0] != 1 || monitors[1] != 2 || monitors[2] != 3 {
+		t.Errorf("got monitors %v, want [1 2 3]", monitors)
+	}
+	monitors, err = archive.Monitors(context.Background(), directory, archive.ReplayOptions{To: day.Add(5 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(monitors) != 1 || monitors[0] != 1 {
+		t.Errorf("got monitors %v up to frame 5, want [1]", monitors)
+	}
+}
+
+func TestRecordFrameFlushesPeriodically(t *testing.T) {
+	directory := t.TempDir()
+	recorder, err := archive.NewRecorder(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+	recorder.RecordFrame(1, day, message(t, sensetest.RealtimeUpdate(day, 1)))
+
+	// Without Close, the frame is in the file once the writer has flushed
+	// it, as it would be if the process died.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		frames := replayed(t, directory, archive.ReplayOptions{})
+		if len(frames) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got frames %v without closing, want frame 1 flushed", frames)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestReplayDevices(t *testing.T) {
+	directory := t.TempDir()
+	recorder, err := archive.NewRecorder(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, recorder, 1, 1)
+	if err := recorder.RecordDevices(1, day.Add(2*time.Second), sensetest.DefaultDevices().Devices); err != nil {
+		t.Fatal(err)
+	}
+	record(t, recorder, 1, 3)
+	recorder.Close()
+
+	// The device list comes between the updates it was recorded between.
+	var got []string
+	err = archive.ReplayUpdates(context.Background(), directory, archive.ReplayOptions{
+		OnDevices: func(monitorID int, devices []sense.Device) error {
+			got = append(got, fmt.Sprintf("%d devices", len(devices)))
+			return nil
+		},
+	}, func(monitorID int, update *sense.RealtimeUpdate) error {
+		got = append(got, fmt.Sprintf("frame %d", update.Payload.FrameNumber))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[frame 1 4 devices frame 3]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Without OnDevices, device lists are skipped.
+	checkFrames(t, replayed(t, directory, archive.ReplayOptions{}), 1, 3)
+}
@@ -0,0 +1,272 @@
+// Package archive records the raw messages from the Sense realtime feed to
+// compressed, daily-rotated JSONL files, and replays them.
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+const (
+	filePrefix = "frames-"
+	fileSuffix = ".jsonl.gz"
+	dayLayout  = "2006-01-02"
+
+	// queueSize is how many frames RecordFrame holds for the writer before
+	// it drops them.
+	queueSize = 1024
+	// flushInterval is how often frames queued by RecordFrame are flushed
+	// to the file, and so how much is lost if the process dies.
+	flushInterval = time.Second
+)
+
+// Frame is a single line of an archive file.
+type Frame struct {
+	Time      time.Time `json:"t"`
+	MonitorID int       `json:"monitor"`
+	// Message is kept as a string rather than raw JSON so that malformed
+	// messages can be archived too.
+	Message string `json:"message"`
+	// Devices, in a frame without a Message, is the monitor's device list
+	// as loaded from the Sense API, so that a replay can name the devices
+	// as the live run did.
+	Devices []sense.Device `json:"devices,omitempty"`
+}
+
+// Recorder writes every frame it is given to a file per day (in local time)
+// named frames-YYYY-MM-DD.jsonl.gz. If a run dies without closing that file,
+// the next run carries on in frames-YYYY-MM-DD.1.jsonl.gz, and so on. It
+// implements sense.FrameRecorder.
+type Recorder struct {
+	directory string
+	queue     chan *Frame
+	stop      chan struct{}
+	done      chan struct{}
+	closing   sync.Once
+	dropped   atomic.Uint64
+
+	mu      sync.Mutex
+	day     string
+	file    *os.File
+	gz      *gzip.Writer
+	encoder *json.Encoder
+	dirty   bool // frames have been written since the last flush
+}
+
+// NewRecorder returns a Recorder writing to directory, which is created if it
+// does not already exist.
+func NewRecorder(directory string) (*Recorder, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory %v: %w", directory, err)
+	}
+	r := &Recorder{
+		directory: directory,
+		queue:     make(chan *Frame, queueSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// RecordFrame queues a message to be archived, without waiting for it to be
+// written. If the queue is full, because the disk can't keep up, the message
+// is dropped and counted. Errors are logged, since the realtime feed has no
+// way to report them.
+func (r *Recorder) RecordFrame(monitorID int, received time.Time, message []byte) {
+	frame := &Frame{Time: received, MonitorID: monitorID, Message: string(message)}
+	select {
+	case <-r.stop:
+		return
+	default:
+	}
+	select {
+	case r.queue <- frame:
+	default:
+		if n := r.dropped.Add(1); n == 1 || n%1000 == 0 {
+			log.Printf("Archive queue full; %d frames dropped\n", n)
+		}
+	}
+}
+
+// RecordDevices archives a monitor's device list, waiting for it to be
+// written. Device lists are loaded off the realtime feed's goroutine, and
+// rarely, so unlike frames they are never dropped.
+func (r *Recorder) RecordDevices(monitorID int, loaded time.Time, devices []sense.Device) error {
+	return r.Record(&Frame{Time: loaded, MonitorID: monitorID, Devices: devices})
+}
+
+// Dropped returns how many frames RecordFrame has dropped because its queue
+// was full.
+func (r *Recorder) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
+// run writes the frames RecordFrame queues, flushing them every
+// flushInterval, until Close.
+func (r *Recorder) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case frame := <-r.queue:
+			if err := r.write(frame); err != nil {
+				log.Printf("Failed to archive frame: %v\n", err)
+			}
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				log.Printf("Failed to archive frame: %v\n", err)
+			}
+		case <-r.stop:
+			for {
+				select {
+				case frame := <-r.queue:
+					if err := r.write(frame); err != nil {
+						log.Printf("Failed to archive frame: %v\n", err)
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Record archives a frame and flushes it to the file before returning,
+// rotating to a new file if the day has changed.
+func (r *Recorder) Record(frame *Frame) error {
+	if err := r.write(frame); err != nil {
+		return err
+	}
+	return r.flush()
+}
+
+// write archives a frame, rotating to a new file if the day has changed,
+// but leaves it buffered until the next flush.
+func (r *Recorder) write(frame *Frame) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	day := frame.Time.Local().Format(dayLayout)
+	if day != r.day {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+		if err := r.openFile(day); err != nil {
+			return err
+		}
+	}
+	if err := r.encoder.Encode(frame); err != nil {
+		return fmt.Errorf("error writing archive file %v: %w", r.file.Name(), err)
+	}
+	r.dirty = true
+	return nil
+}
+
+// flush writes out the frames written since the last flush, so that little
+// is lost if the process dies; readers stop cleanly at the end of a
+// truncated file.
+func (r *Recorder) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.dirty {
+		return nil
+	}
+	r.dirty = false
+	if err := r.gz.Flush(); err != nil {
+		return fmt.Errorf("error writing archive file %v: %w", r.file.Name(), err)
+	}
+	return nil
+}
+
+// Close writes the frames still queued, then flushes and closes the current
+// archive file. Frames recorded after Close are dropped.
+func (r *Recorder) Close() error {
+	r.closing.Do(func() { close(r.stop) })
+	<-r.done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closeFile()
+}
+
+// openFile must be called with r.mu held. The latest existing file for the
+// same day (from an earlier run) is appended to as a new gzip member if it was
+// closed cleanly. If it wasn't, it ends in a gzip member without a trailer,
+// and anything appended would be unreadable, so the next file is started
+// instead.
+func (r *Recorder) openFile(day string) error {
+	path := ""
+	for n := 0; ; n++ {
+		next := filepath.Join(r.directory, fileName(day, n))
+		if _, err := os.Stat(next); errors.Is(err, os.ErrNotExist) {
+			if path == "" || !complete(path) {
+				path = next
+			}
+			break
+		}
+		path = next
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening archive file %v: %w", path, err)
+	}
+	r.day = day
+	r.file = file
+	r.gz = gzip.NewWriter(file)
+	r.encoder = json.NewEncoder(r.gz)
+	return nil
+}
+
+// fileName returns the name of the nth archive file for day.
+func fileName(day string, n int) string {
+	if n == 0 {
+		return filePrefix + day + fileSuffix
+	}
+	return filePrefix + day + "." + strconv.Itoa(n) + fileSuffix
+}
+
+// complete reports whether the archive file at path reads cleanly to the end.
+func complete(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		// An empty file has nothing to lose.
+		return errors.Is(err, io.EOF)
+	}
+	_, err = io.Copy(io.Discard, gz)
+	return err == nil
+}
+
+// closeFile must be called with r.mu held.
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.gz.Close()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.day = ""
+	r.file = nil
+	r.gz = nil
+	r.encoder = nil
+	r.dirty = false
+	return err
+}
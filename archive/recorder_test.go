@@ -0,0 +1,56 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+func TestRecordFrameDropsWhenFull(t *testing.T) {
+	directory := t.TempDir()
+	recorder, err := NewRecorder(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+
+	// While the file is busy, frames queue up and then are dropped, rather
+	// than holding up the caller.
+	recorder.mu.Lock()
+	const sent = queueSize + 10
+	for frame := 1; frame <= sent; frame++ {
+		at := day.Add(time.Duration(frame) * time.Second)
+		message, err := json.Marshal(sensetest.RealtimeUpdate(at, frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder.RecordFrame(1, at, message)
+	}
+	recorder.mu.Unlock()
+	dropped := recorder.Dropped()
+	if dropped < 9 {
+		t.Errorf("got %d frames dropped, want at least 9", dropped)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close writes everything that was queued.
+	var frames int
+	err = ReplayUpdates(context.Background(), directory, ReplayOptions{}, func(int, *sense.RealtimeUpdate) error {
+		frames++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames != sent-int(dropped) {
+		t.Errorf("got %d frames archived, want the %d not dropped", frames, sent-int(dropped))
+	}
+	// Frames after Close are dropped without blocking.
+	recorder.RecordFrame(1, day, []byte("{}"))
+}
@@ -0,0 +1,199 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+type ReplayOptions struct {
+	// Speed is how many times faster than real time frames are replayed: 1
+	// reproduces the original timing, 10 is ten times faster, and 0 replays
+	// as fast as possible.
+	Speed float64
+	// From and To, if set, restrict the replay to frames received in that
+	// range.
+	From time.Time
+	To   time.Time
+	// OnDevices, if set, is called by ReplayUpdates with each device list
+	// recorded in the archive, in order with the updates.
+	OnDevices func(monitorID int, devices []sense.Device) error
+}
+
+// Replay reads the archive files in directory in order and calls handle with
+// each frame, pacing them according to options. It stops at the first error
+// from handle.
+func Replay(ctx context.Context, directory string, options ReplayOptions, handle func(*Frame) error) error {
+	files, err := archiveFiles(directory)
+	if err != nil {
+		return err
+	}
+
+	var first time.Time
+	start := time.Now()
+	for _, file := range files {
+		if !options.From.IsZero() && file.day.AddDate(0, 0, 1).Before(options.From) {
+			continue
+		}
+		if !options.To.IsZero() && file.day.After(options.To) {
+			break
+		}
+		err = readFile(file.path, func(frame *Frame) error {
+			if !options.From.IsZero() && frame.Time.Before(options.From) {
+				return nil
+			}
+			if !options.To.IsZero() && frame.Time.After(options.To) {
+				return nil
+			}
+			if first.IsZero() {
+				first = frame.Time
+			}
+			if options.Speed > 0 {
+				due := start.Add(time.Duration(float64(frame.Time.Sub(first)) / options.Speed))
+				timer := time.NewTimer(time.Until(due))
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return handle(frame)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplayUpdates is like Replay, but decodes the realtime updates from the
+// archive and calls handle with them, skipping every other message type.
+// Frames that fail to decode are skipped, as they are on the live feed.
+// Device lists go to options.OnDevices.
+func ReplayUpdates(ctx context.Context, directory string, options ReplayOptions, handle func(monitorID int, update *sense.RealtimeUpdate) error) error {
+	return Replay(ctx, directory, options, func(frame *Frame) error {
+		if frame.Devices != nil {
+			if options.OnDevices == nil {
+				return nil
+			}
+			return options.OnDevices(frame.MonitorID, frame.Devices)
+		}
+		msg := &sense.Message{}
+		if err := json.Unmarshal([]byte(frame.Message), msg); err != nil {
+			return nil
+		}
+		if msg.Type != sense.MessageRealtimeUpdate {
+			return nil
+		}
+		update, err := msg.RealtimeUpdate()
+		if err != nil {
+			return nil
+		}
+		return handle(frame.MonitorID, update)
+	})
+}
+
+// Monitors returns the IDs, in ascending order, of the monitors with frames in
+// the archive in directory within the range given by options.
+func Monitors(ctx context.Context, directory string, options ReplayOptions) ([]int, error) {
+	options.Speed = 0
+	var monitors []int
+	err := Replay(ctx, directory, options, func(frame *Frame) error {
+		if !slices.Contains(monitors, frame.MonitorID) {
+			monitors = append(monitors, frame.MonitorID)
+		}
+		return nil
+	})
+	slices.Sort(monitors)
+	return monitors, err
+}
+
+type archiveFile struct {
+	path string
+	day  time.Time
+	n    int
+}
+
+// archiveFiles returns the archive files in directory in the order they were
+// written: by day, and then by the number a run that found an unfinished
+// file gave its own.
+func archiveFiles(directory string) ([]archiveFile, error) {
+	paths, err := filepath.Glob(filepath.Join(directory, filePrefix+"*"+fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var files []archiveFile
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), filePrefix), fileSuffix)
+		day, number, _ := strings.Cut(name, ".")
+		file := archiveFile{path: path}
+		if file.day, err = time.ParseInLocation(dayLayout, day, time.Local); err != nil {
+			continue
+		}
+		if number != "" {
+			if file.n, err = strconv.Atoi(number); err != nil {
+				continue
+			}
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].day.Equal(files[j].day) {
+			return files[i].day.Before(files[j].day)
+		}
+		return files[i].n < files[j].n
+	})
+	return files, nil
+}
+
+func readFile(path string, handle func(*Frame) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening archive file %v: %w", path, err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("error reading archive file %v: %w", path, err)
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		frame := &Frame{}
+		if err := json.Unmarshal(scanner.Bytes(), frame); err != nil {
+			// Most likely the partial last line of a file that was being
+			// written when the process died.
+			continue
+		}
+		if err := handle(frame); err != nil {
+			return err
+		}
+	}
+	// A file that was still being written (or whose writer died) ends
+	// without a gzip trailer, and anything appended to it after that can't
+	// be decompressed. What comes before is still good, so skip the rest
+	// rather than abandon the replay.
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Printf("Skipping the rest of archive file %v: %v\n", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Command fakesense serves a sensetest.Server on a fixed address and streams
+// synthetic realtime updates, so the logger can be run end to end offline:
+//
+//	SENSE_API_URL=http://127.0.0.1:8080 SENSE_WEBSOCKET_URL=ws://127.0.0.1:8080 \
+//	SENSE_USER=user@example.com SENSE_PASS=password ./logger
+package main
+
+import (
+	"flag"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "address to listen on")
+	interval := flag.Duration("interval", 500*time.Millisecond, "interval between realtime updates")
+	flag.Parse()
+
+	server := sensetest.New()
+	go func() {
+		devices := sensetest.DefaultDevices().Devices
+		for frame := 0; ; frame++ {
+			time.Sleep(*interval)
+			var active []sense.Device
+			for _, device := range devices {
+				if rand.IntN(2) == 0 {
+					active = append(active, sense.Device{ID: device.ID})
+				}
+			}
+			if err := server.Send(sensetest.RealtimeUpdate(time.Now(), frame, active...)); err != nil {
+				log.Printf("Failed to send realtime update: %v\n", err)
+			}
+		}
+	}()
+
+	log.Printf("Serving fake Sense API on http://%s\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adamroach/sense-logger/demand"
+	"github.com/adamroach/sense-logger/energy"
+	"github.com/adamroach/sense-logger/gaps"
+	"github.com/adamroach/sense-logger/rrd"
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/tariff"
+	"github.com/adamroach/sense-logger/timeline"
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []*command{
+	{"run", "", "log the realtime feed to the configured sinks (the default)", runCommand},
+	{"devices", "", "list the devices Sense has found", devicesCommand},
+	{"device", "<id>", "show a device's details and usage", deviceCommand},
+	{"labs", "", "show the Sense Labs power quality report, or dump its raw data", labsCommand},
+	{"export", "", "export recorded readings from the RRD files as CSV or JSON", exportCommand},
+	{"graph", "", "graph recorded power from the RRD files", graphCommand},
+	{"gaps", "", "list the times readings are missing", gapsCommand},
+	{"runs", "", "list the times devices were on, from the run history", runsCommand},
+	{"energy", "", "show the energy used, by hour, day or month", energyCommand},
+	{"cost", "", "price the energy used, by day, month or billing cycle", costCommand},
+	{"peaks", "", "list each month's peak demand and the devices on at the time", peaksCommand},
+}
+
+// usageError is returned for mistakes in how the logger was invoked, which
+// exit with status 2. Its err is nil when the flag package has already
+// reported the mistake.
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string {
+	if e.err == nil {
+		return "usage error"
+	}
+	return e.err.Error()
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: logger [command] [flags] [args]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun \"logger <command> -h\" for the flags each command takes.\n")
+}
+
+// monitorClient logs in and returns a Client for the first configured
+// monitor, or the account's first monitor if none is configured.
+func monitorClient(config *Config) (*sense.Client, error) {
+	client, _, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Monitors) > 0 {
+		if err := client.SelectMonitor(config.Monitors[0]); err != nil {
+			return nil, fmt.Errorf("monitor %s: %w", config.Monitors[0], err)
+		}
+	}
+	return client, nil
+}
+
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func devicesCommand(args []string) error {
+	flags := newConfigFlags("devices", needLogin)
+	asJSON := flags.set.Bool("json", false, "print the devices as JSON")
+	config, err := flags.load(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(config)
+	client, err := monitorClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	devices, err := client.GetDevices()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(devices.Devices)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tTYPE\tLOCATION\tMAKE\tMODEL")
+	for _, device := range devices.Devices {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", device.ID, device.Name,
+			value(device.Tags.UserDeviceType), value(device.Location), value(device.Make), value(device.Model))
+	}
+	return tw.Flush()
+}
+
+func deviceCommand(args []string) error {
+	flags := newConfigFlags("device", needLogin)
+	asJSON := flags.set.Bool("json", false, "print the details as JSON")
+	config, err := flags.load(args)
+	if err != nil {
+		return err
+	}
+	if flags.set.NArg() != 1 {
+		return usageError{fmt.Errorf("usage: logger device [flags] <id>")}
+	}
+	setupLogging(config)
+	client, err := monitorClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	details, err := client.GetDeviceDetails(flags.set.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(details)
+	}
+
+	device := &details.Device
+	usage := &details.Usage
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s\n", device.Name)
+	fmt.Fprintf(tw, "ID:\t%s\n", device.ID)
+	fmt.Fprintf(tw, "Type:\t%s\n", value(device.Tags.UserDeviceType))
+	fmt.Fprintf(tw, "Location:\t%s\n", value(device.Location))
+	fmt.Fprintf(tw, "Make:\t%s\n", value(device.Make))
+	fmt.Fprintf(tw, "Model:\t%s\n", value(device.Model))
+	fmt.Fprintf(tw, "Last state:\t%s\n", value(device.LastState))
+	if device.LastStateTime != nil {
+		fmt.Fprintf(tw, "Last state time:\t%v\n", device.LastStateTime.Local())
+	}
+	if details.Info != "" {
+		fmt.Fprintf(tw, "Info:\t%s\n", details.Info)
+	}
+	fmt.Fprintf(tw, "\nAverage power:\t%.0f W\n", usage.AvgWatts)
+	fmt.Fprintf(tw, "Average run:\t%v\n", time.Duration(usage.AvgDuration*float64(time.Second)).Round(time.Second))
+	fmt.Fprintf(tw, "This month:\t%.1f kWh, %d runs\n", usage.CurrentMonthKWH, usage.CurrentMonthRuns)
+	fmt.Fprintf(tw, "Monthly average:\t%.1f kWh, %d runs, %.1f%% of total\n", usage.AvgMonthlyKWH, usage.AvgMonthlyRuns, usage.AvgMonthlyPct)
+	fmt.Fprintf(tw, "Yearly:\t%.0f kWh\n", usage.YearlyKWH)
+	if usage.YearlyText != "" {
+		fmt.Fprintf(tw, "\t%s\n", usage.YearlyText)
+	}
+	return tw.Flush()
+}
+
+// labsRaw are the raw dumps the labs command can print.
+var labsRaw = map[string]func(*sense.LabsReport) string{
+	"power-quality-csv":      func(r *sense.LabsReport) string { return r.PowerQualityRawCSV },
+	"motor-stall-csv":        func(r *sense.LabsReport) string { return r.MotorStallRawCSV },
+	"motor-stall-daily-svg":  func(r *sense.LabsReport) string { return r.MotorStallDailyCountsSVG },
+	"motor-stall-sample-svg": func(r *sense.LabsReport) string { return r.MotorStallPowermeterSampleSVG },
+}
+
+func labsCommand(args []string) error {
+	flags := newConfigFlags("labs", needLogin)
+	asJSON := flags.set.Bool("json", false, "print the whole report as JSON")
+	var names []string
+	for name := range labsRaw {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	raw := flags.set.String("raw", "", "print one of the raw dumps: "+strings.Join(names, ", "))
+	config, err := flags.load(args)
+	if err != nil {
+		return err
+	}
+	dump, ok := labsRaw[*raw]
+	if *raw != "" && !ok {
+		return usageError{fmt.Errorf("-raw must be one of %s", strings.Join(names, ", "))}
+	}
+	setupLogging(config)
+	client, err := monitorClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	report, err := client.GetLabsReport()
+	if err != nil {
+		return err
+	}
+	switch {
+	case *asJSON:
+		return printJSON(report)
+	case dump != nil:
+		_, err := io.WriteString(os.Stdout, dump(report))
+		return err
+	}
+	fmt.Print(report.Summary())
+	return nil
+}
+
+// recordFlags are the flags shared by the commands that read the RRD files.
+type recordFlags struct {
+	device *string
+	start  *string
+	end    *string
+}
+
+// addRecordFlags adds the flags for a time range, and a -device flag with
+// the given usage unless it is empty.
+func addRecordFlags(flags *configFlags, device string) *recordFlags {
+	r := &recordFlags{
+		start: flags.set.String("start", "-24h", "start `time`: now, a duration before now, a date or an RFC 3339 time"),
+		end:   flags.set.String("end", "now", "end `time`: now, a duration before now, a date or an RFC 3339 time"),
+	}
+	if device != "" {
+		r.device = flags.set.String("device", "", device)
+	}
+	return r
+}
+
+func (r *recordFlags) times() (start, end time.Time, err error) {
+	now := time.Now()
+	if start, err = parseTime(*r.start, now); err != nil {
+		return start, end, usageError{fmt.Errorf("-start: %w", err)}
+	}
+	if end, err = parseTime(*r.end, now); err != nil {
+		return start, end, usageError{fmt.Errorf("-end: %w", err)}
+	}
+	if !start.Before(end) {
+		return start, end, usageError{fmt.Errorf("-start must be before -end")}
+	}
+	return start, end, nil
+}
+
+// parseTime parses "now", a duration before now (with or without a leading
+// minus sign, and in days as well as the units time.ParseDuration takes), a
+// local date, or an RFC 3339 time.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	ago := strings.TrimPrefix(s, "-")
+	if days, ok := strings.CutSuffix(ago, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(ago); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("can't parse time %q", s)
+}
+
+// recordDirectory returns the directory holding the RRD files for the
+// configured monitor: its own subdirectory of the output directory, if there
+// is one, and otherwise the output directory itself.
+func recordDirectory(config *Config) string {
+	if len(config.Monitors) > 0 {
+		dir := filepath.Join(config.OutputDir, config.Monitors[0])
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return config.OutputDir
+}
+
+func exportCommand(args []string) error {
+	flags := newConfigFlags("export", 0)
+	record := addRecordFlags(flags, "export the device with this `id` instead of the mains readings")
+	step := flags.set.Duration("step", time.Minute, "interval between exported readings")
+	format := flags.set.String("format", "csv", "csv or json")
+	output := flags.set.String("o", "", "write to `file` instead of standard output")
+	config, err := flags.load(args)
+	if err != nil {
+		return err
+	}
+	start, end, err := record.times()
+	if err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "json" {
+		return usageError{fmt.Errorf("-format must be csv or json")}
+	}
+	setupLogging(config)
+
+	directory := recordDirectory(config)
+	series, err := rrd.Fetch(directory, *record.device, start, end, *step)
+	if err != nil {
+		return err
+	}
+	missing, err := missingSeconds(directory, series)
+	if err != nil {
+		return err
+	}
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	if *format == "json" {
+		return writeSeriesJSON(w, series, missing)
+	}
+	return writeSeriesCSV(w, series, missing)
+}
+
+// missingSeconds returns, for each row of series, how many seconds of the
+// step it averages over the gap log in directory says have no readings. Row
+// i averages the readings after Start + i*Step, up to the step after.
+func missingSeconds(directory string, series *rrd.Series) ([]float64, error) {
+	missing := make([]float64, len(series.Rows))
+	if len(series.Rows) == 0 {
+		return missing, nil
+	}
+	rowStart := func(i int) time.Time {
+		return series.Start.Add(time.Duration(i) * series.Step)
+	}
+	gapList, err := gaps.Read(directory, rowStart(0), rowStart(len(series.Rows)))
+	if err != nil {
+		return nil, err
+	}
+	for i := range series.Rows {
+		missing[i] = gaps.Missing(gapList, rowStart(i), rowStart(i+1)).Seconds()
+	}
+	return missing, nil
+}
+
+func writeSeriesCSV(w io.Writer, series *rrd.Series, missing []float64) error {
+	cw := csv.NewWriter(w)
+	cw.Write(append(append([]string{"time"}, series.Names...), "missing_seconds"))
+	record := make([]string, len(series.Names)+2)
+	for i, row := range series.Rows {
+		record[0] = series.Time(i).Format(time.RFC3339)
+		for j, v := range row {
+			record[j+1] = ""
+			if !math.IsNaN(v) {
+				record[j+1] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		}
+		record[len(record)-1] = strconv.FormatFloat(missing[i], 'f', -1, 64)
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeSeriesJSON(w io.Writer, series *rrd.Series, missing []float64) error {
+	type row struct {
+		Time           time.Time           `json:"time"`
+		Values         map[string]*float64 `json:"values"`
+		MissingSeconds float64             `json:"missing_seconds"`
+	}
+	rows := make([]row, len(series.Rows))
+	for i, values := range series.Rows {
+		rows[i] = row{Time: series.Time(i), Values: map[string]*float64{}, MissingSeconds: missing[i]}
+		for j, v := range values {
+			if !math.IsNaN(v) {
+				rows[i].Values[series.Names[j]] = &values[j]
+			} else {
+				rows[i].Values[series.Names[j]] = nil
+			}
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(rows)
+}
+
+func graphCommand(args []string) error {
+	flags := newConfigFlags("graph", 0)
+	record := addRecordFlags(flags, "comma-separated `ids` of devices to graph instead of the total and grid power")
+	output := flags.set.String("o", "power.png", "write the graph to `file`; a .svg name draws an SVG")
+	width := flags.set.Uint("width", 800, "width of the graph area in pixels")
+	height := flags.set.Uint("height", 300, "height of the graph area in pixels")
+	title := flags.set.String("title", "", "title of the graph")
+	config, err := flags.load(args)
+	if err != nil {
+		return err
+	}
+	start, end, err := record.times()
+	if err != nil {
+		return err
+	}
+	setupLogging(config)
+
+	directory := recordDirectory(config)
+	options := rrd.GraphOptions{
+		Devices: splitList(*record.device),
+		Start:   start,
+		End:     end,
+		Title:   *title,
+		Width:   *width,
+		Height:  *height,
+		Format:  "PNG",
+	}
+	if strings.EqualFold(filepath.Ext(*output), ".svg") {
+		options.Format = "SVG"
+	}
+	if len(options.Devices) > 0 {
+		// Names are only for the legend, so a missing device.json doesn't
+		// matter.
+		options.Names, _ = rrd.DeviceNames(directory)
+	}
+	image, err := rrd.Graph(directory, options)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*output, image, 0644)
+}
+
+func gapsCommand(args []string) error {
+	flags := newConfigFlags("gaps", 0)
+	record := addRecordFlags(flags, "")
+	asJSON := flags.set.Bool("json", false, "print the gaps as JSON")
+	config, err := flags.load(args)
+	if err != nil {
+		return err
+	}
+	start, end, err := record.times()
+	if err != nil {
+		return err
+	}
+	setupLogging(config)
+
+	gapList, err := gaps.Read(recordDirectory(config), start, end)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if gapList == nil {
+			gapList = []gaps.Gap{}
+		}
+		return printJSON(gapList)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tEND\tDURATION\tCAUSE\tFRAMES")
+	for _, gap := range gapList {
+		frames := ""
+		if gap.Frames > 0 {
+			frames = strconv.Itoa(gap.Frames)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%s\n", gap.Start.Local().Format(time.DateTime), gap.End.Local().Format(time.DateTime),
+			gap.Duration(), gap.Cause, frames)
+	}
+	tw.Flush()
+	missing := gaps.Missing(gapList, start, end)
+	fmt.Printf("\n%d gaps; readings missing for %v of %v (%.2f%%)\n", len(gapList), missing.Round(time.Second),
+		end.Sub(start).Round(time.Second), 100*missing.Seconds()/end.Sub(start).Seconds())
+	return nil
+}
+
+func runsCommand(args []string) error {
+	flags := newConfigFlags("runs", 0)
+	record := addRecordFlags(flags, "list only the runs of the device with this `id`")
+	asJSON := flags.set.Bool("json", false, "print the runs as JSON")
+	config, err := flags.load(args)
+	if err != nil {
+		return err
+	}
+	start, end, err := record.times()
+	if err != nil {
+		return err
+	}
+	setupLogging(config)
+
+	directory := recordDirectory(config)
+	if _, err := os.Stat(filepath.Join(directory, timeline.File)); err != nil {
+		return fmt.Errorf("no run history in %v: %w", directory, err)
+	}
+	store, err := timeline.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	runs, err := store.Runs(*record.device, start, end)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if runs == nil {
+			runs = []timeline.Run{}
+		}
+		return printJSON(runs)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tNAME\tSTART\tEND\tDURATION\tENERGY (WH)\tPEAK (W)\t")
+	var energy float64
+	for _, run := range runs {
+		note := ""
+		if run.Interrupted {
+			note = "interrupted"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\t%.1f\t%.0f\t%s\n", run.DeviceID, run.DeviceName,
+			run.Start.Local().Format(time.DateTime), run.End.Local().Format(time.DateTime),
+			run.Duration(), run.EnergyWh, run.PeakWatts, note)
+		energy += run.EnergyWh
+	}
+	tw.Flush()
+	fmt.Printf("\n%d runs using %.1f Wh\n", len(runs), energy)
+	return nil
+}
+
+// periodFormats are the layouts energy periods are shown in.
+var periodFormats = map[energy.Period]string{
+	energy.Hourly:  "2006-01-02 15:04",
+	energy.Daily:   time.DateOnly,
+	energy.Monthly: "2006-01",
+}
+
+func energyCommand(args []string) error {
+	flags := newConfigFlags("energy", 0)
+	record := addRecordFlags(flags, "show the energy used by the device with this `id` instead of the mains")
+	by := flags.set.String("by", "day", "add up the energy by hour, day or month")
+	asJSON := flags.set.Bool("json", false, "print the energy as JSON")
+	config, err := flags.load(args)
+	if err != nil {
+		return err
+	}
+	start, end, err := record.times()
+	if err != nil {
+		return err
+	}
+	period := energy.Period(*by)
+	format, ok := periodFormats[period]
+	if !ok {
+		return usageError{fmt.Errorf("-by must be hour, day or month")}
+	}
+	setupLogging(config)
+
+	directory := recordDirectory(config)
+	if _, err := os.Stat(filepath.Join(directory, energy.File)); err != nil {
+		return fmt.Errorf("no energy totals in %v: %w", directory, err)
+	}
+	store, err := energy.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	hours, err := store.Hours(energy.Hour(start, time.Local), end)
+	if err != nil {
+		return err
+	}
+	buckets := energy.Rollup(hours, period, time.Local)
+	if *asJSON {
+		if buckets == nil {
+			buckets = []energy.Bucket{}
+		}
+		return printJSON(buckets)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	if *record.device != "" {
+		meter := energy.DeviceMeter(*record.device)
+		fmt.Fprintln(tw, "PERIOD\tKWH\t")
+		for _, bucket := range buckets {
+			fmt.Fprintf(tw, "%s\t%.3f\t\n", bucket.Start.Format(format), bucket.Energy[meter])
+		}
+		fmt.Fprintf(tw, "total\t%.3f\t\n", energy.Sum(buckets)[meter])
+		return tw.Flush()
+	}
+	meters := []energy.Meter{energy.Total, energy.Leg1, energy.Leg2, energy.GridImport, energy.GridExport}
+	fmt.Fprintln(tw, "PERIOD\tTOTAL\tLEG 1\tLEG 2\tIMPORT\tEXPORT\t")
+	row := func(label string, kWh map[energy.Meter]float64) {
+		fmt.Fprint(tw, label)
+		for _, meter := range meters {
+			fmt.Fprintf(tw, "\t%.3f", kWh[meter])
+		}
+		fmt.Fprintln(tw, "\t")
+	}
+	for _, bucket := range buckets {
+		row(bucket.Start.Format(format), bucket.Energy)
+	}
+	sum := energy.Sum(buckets)
+	row("total", sum)
+	tw.Flush()
+
+	// The devices, biggest first.
+	names, _ := rrd.DeviceNames(directory)
+	var devices []energy.Meter
+	for meter := range sum {
+		if _, ok := meter.Device(); ok {
+			devices = append(devices, meter)
+		}
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+	slices.SortFunc(devices, func(a, b energy.Meter) int {
+		return cmp.Compare(sum[b], sum[a])
+	})
+	fmt.Println()
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tNAME\tKWH")
+	for _, meter := range devices {
+		id, _ := meter.Device()
+		fmt.Fprintf(tw, "%s\t%s\t%.3f\n", id, names[id], sum[meter])
+	}
+	return tw.Flush()
+}
+
+func costCommand(args []string) error {
+	flags := newConfigFlags("cost", needLogin|needTariff)
+	record := addRecordFlags(flags, "")
+	by := flags.set.String("by", "cycle", "price the energy by day, month, cycle (billing cycle) or range (all at once)")
+	asJSON := flags.set.Bool("json", false, "print the bills as JSON")
+	config, err := flags.load(args)
+	if err != nil {
+		return err
+	}
+	start, end, err := record.times()
+	if err != nil {
+		return err
+	}
+	grouping := tariff.Grouping(*by)
+	switch grouping {
+	case tariff.ByDay, tariff.ByMonth, tariff.ByCycle, tariff.ByRange:
+	default:
+		return usageError{fmt.Errorf("-by must be day, month, cycle or range")}
+	}
+	setupLogging(config)
+
+	directory := recordDirectory(config)
+	if _, err := os.Stat(filepath.Join(directory, energy.File)); err != nil {
+		return fmt.Errorf("no energy totals in %v: %w", directory, err)
+	}
+	t, err := loadTariff(config)
+	if err != nil {
+		return err
+	}
+	store, err := energy.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	// Energy is recorded by the hour.
+	start = energy.Hour(start, time.Local)
+	hours, err := store.Hours(t.CycleStart(start, time.Local), end)
+	if err != nil {
+		return err
+	}
+	bills, err := t.Bills(hours, start, end, grouping, time.Local)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if bills == nil {
+			bills = []tariff.Bill{}
+		}
+		return printJSON(bills)
+	}
+
+	money := func(amount float64) string {
+		sign := ""
+		if math.Round(amount*100) < 0 {
+			sign = "-"
+		}
+		return fmt.Sprintf("%s%s%.2f", sign, t.Currency, math.Abs(amount))
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "START\tEND\tIMPORT KWH\tEXPORT KWH\tIMPORT\tEXPORT\tCHARGES\tTOTAL\t")
+	var total float64
+	deviceKWh, deviceCost := map[string]float64{}, map[string]float64{}
+	for _, bill := range bills {
+		fmt.Fprintf(tw, "%s\t%s\t%.3f\t%.3f\t%s\t%s\t%s\t%s\t\n",
+			bill.Start.Format("2006-01-02 15:04"), bill.End.Format("2006-01-02 15:04"), bill.ImportKWh, bill.ExportKWh,
+			money(bill.ImportCost), money(-bill.ExportCredit), money(bill.DailyCharges), money(bill.Total))
+		total += bill.Total
+		for id, kWh := range bill.DeviceKWh {
+			deviceKWh[id] += kWh
+			deviceCost[id] += bill.DeviceCost[id]
+		}
+	}
+	tw.Flush()
+	fmt.Printf("\n%d bills totalling %s\n", len(bills), money(total))
+	if len(deviceCost) == 0 {
+		return nil
+	}
+
+	// The devices, most expensive first.
+	names, _ := rrd.DeviceNames(directory)
+	ids := slices.Collect(maps.Keys(deviceCost))
+	slices.SortFunc(ids, func(a, b string) int {
+		return cmp.Compare(deviceCost[b], deviceCost[a])
+	})
+	fmt.Println()
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tNAME\tKWH\tCOST")
+	for _, id := range ids {
+		fmt.Fprintf(tw, "%s\t%s\t%.3f\t%s\n", id, names[id], deviceKWh[id], money(deviceCost[id]))
+	}
+	return tw.Flush()
+}
+
+func peaksCommand(args []string) error {
+	flags := newConfigFlags("peaks", 0)
+	asJSON := flags.set.Bool("json", false, "print the peaks as JSON")
+	config, err := flags.load(args)
+	if err != nil {
+		return err
+	}
+	setupLogging(config)
+
+	peaks, err := demand.ReadPeaks(recordDirectory(config))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(peaks)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MONTH\tTIME\tKW\tWINDOW\tSOURCE\tDEVICES")
+	for _, peak := range peaks {
+		var devices []string
+		for _, device := range peak.Devices {
+			devices = append(devices, fmt.Sprintf("%s %.0fW", device.Name, device.Watts))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.2f\t%v\t%s\t%s\n", peak.Month, peak.Time.Local().Format(time.DateTime),
+			peak.Watts/1000, peak.Window, peak.Source, strings.Join(devices, ", "))
+	}
+	return tw.Flush()
+}
+
+// loadTariff returns the configured tariff, or the flat rate set in Sense for
+// the configured monitor.
+func loadTariff(config *Config) (*tariff.Tariff, error) {
+	if config.Tariff != nil {
+		return config.Tariff, nil
+	}
+	client, err := monitorClient(config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	monitor, err := client.Monitor()
+	if err != nil {
+		return nil, err
+	}
+	attributes := monitor.Attributes
+	// Without a cost of its own, the monitor uses the default in its
+	// realtime updates.
+	defaultCost := 0
+	if attributes.Cost == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		update, err := client.GetRealtimeUpdateContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error getting the default cost: %w", err)
+		}
+		defaultCost = update.Payload.DefaultCost
+	}
+	if attributes.TOUEnabled {
+		slog.Warn("Sense doesn't share its time-of-use rates; using the flat rate. Configure a tariff to use time-of-use rates.")
+	}
+	t := tariff.FromMonitor(attributes, defaultCost)
+	slog.Debug("Using the tariff set in Sense", "rate", t.Rate, "export_rate", t.ExportRate, "cycle_start", t.CycleDay)
+	return t, nil
+}
+
+// value returns *s, or "" if s is nil.
+func value(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
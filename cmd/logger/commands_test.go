@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/gaps"
+	"github.com/adamroach/sense-logger/rrd"
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 30, 0, 0, time.Local)
+	for _, test := range []struct {
+		s    string
+		want time.Time
+	}{
+		{"now", now},
+		{"-24h", now.Add(-24 * time.Hour)},
+		{"90m", now.Add(-90 * time.Minute)},
+		{"-7d", time.Date(2024, 3, 3, 12, 30, 0, 0, time.Local)},
+		// Days are calendar days, so they keep the time of day across a
+		// daylight saving change.
+		{"30d", time.Date(2024, 2, 9, 12, 30, 0, 0, time.Local)},
+		{"2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-03-01T08:00:00Z", time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)},
+	} {
+		got, err := parseTime(test.s, now)
+		if err != nil {
+			t.Errorf("parseTime(%q) failed: %v", test.s, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("parseTime(%q) = %v, want %v", test.s, got, test.want)
+		}
+	}
+	for _, s := range []string{"", "yesterday", "-xd", "2024-13-01", "2024-03-01 08:00"} {
+		if _, err := parseTime(s, now); err == nil {
+			t.Errorf("parseTime(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+// capture returns what run writes to standard output.
+func capture(t *testing.T, run func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	err = run()
+	w.Close()
+	return <-output, err
+}
+
+func TestCommandUsageErrors(t *testing.T) {
+	isolate(t)
+	directory := t.TempDir()
+	for _, test := range []struct {
+		run  func([]string) error
+		args []string
+	}{
+		{gapsCommand, []string{"-out", directory, "-start", "yesterday"}},
+		{gapsCommand, []string{"-out", directory, "-start", "now", "-end", "-1h"}},
+		{exportCommand, []string{"-out", directory, "-format", "xml"}},
+		{deviceCommand, []string{"-user", "a@example.com"}},
+		{labsCommand, []string{"-user", "a@example.com", "-raw", "everything"}},
+	} {
+		err := test.run(test.args)
+		var usageErr usageError
+		if !errors.As(err, &usageErr) || usageErr.err == nil {
+			t.Errorf("got error %v for %q, want a usage error", err, test.args)
+		}
+	}
+}
+
+func TestGapsCommand(t *testing.T) {
+	isolate(t)
+	output, err := capture(t, func() error {
+		return gapsCommand([]string{"-out", t.TempDir(), "-start", "-1h", "-json"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(output) != "[]" {
+		t.Errorf("got %q with no gap log, want an empty list", output)
+	}
+}
+
+func TestMissingSeconds(t *testing.T) {
+	directory := t.TempDir()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	// 10 minutes missing from the row covering 01:00 to 02:00, and 30s either
+	// side of 02:00.
+	var log []byte
+	for _, gap := range []gaps.Gap{
+		{Start: start.Add(70 * time.Minute), End: start.Add(80 * time.Minute), Cause: gaps.Disconnected},
+		{Start: start.Add(2*time.Hour - 30*time.Second), End: start.Add(2*time.Hour + 30*time.Second), Cause: gaps.Disconnected},
+	} {
+		line, err := json.Marshal(gap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log = append(append(log, line...), '\n')
+	}
+	if err := os.WriteFile(filepath.Join(directory, gaps.LogFile), log, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	series := &rrd.Series{Start: start, Step: time.Hour, Rows: make([][]float64, 3)}
+	missing, err := missingSeconds(directory, series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 3 || missing[0] != 0 || missing[1] != 630 || missing[2] != 30 {
+		t.Errorf("got %v seconds missing, want [0 630 30]", missing)
+	}
+}
+
+func TestDevicesCommand(t *testing.T) {
+	isolate(t)
+	server := sensetest.NewServer()
+	defer server.Close()
+	t.Setenv("SENSE_API_URL", server.URL())
+	t.Setenv("SENSE_TOKEN_FILE", "")
+	args := []string{"-user", sensetest.DefaultEmail}
+	t.Setenv("SENSE_PASS", sensetest.DefaultPassword)
+
+	output, err := capture(t, func() error { return devicesCommand(args) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != len(sensetest.DefaultDevices().Devices)+1 || !strings.HasPrefix(lines[0], "ID ") {
+		t.Fatalf("got %q, want a header and a line per device", output)
+	}
+	if !strings.Contains(output, "d1a2b3c4") || !strings.Contains(output, "Fridge") {
+		t.Errorf("got %q, want the fridge listed", output)
+	}
+
+	output, err = capture(t, func() error { return devicesCommand(append(args, "-json")) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devices []sense.Device
+	if err := json.Unmarshal([]byte(output), &devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != len(sensetest.DefaultDevices().Devices) {
+		t.Errorf("got %d devices, want %d", len(devices), len(sensetest.DefaultDevices().Devices))
+	}
+
+	// An unknown monitor is an error rather than a silent fallback.
+	if _, err := capture(t, func() error { return devicesCommand(append(args, "-monitors", "99")) }); err == nil {
+		t.Error("got no error for an unknown monitor")
+	}
+}
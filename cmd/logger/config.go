@@ -0,0 +1,561 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/adamroach/sense-logger/demand"
+	"github.com/adamroach/sense-logger/rrd"
+	"github.com/adamroach/sense-logger/tariff"
+)
+
+// Display modes.
+const (
+	displayScreen = "screen" // redraw the terminal with every update
+	displayLog    = "log"    // log a line per update
+	displayNone   = "none"
+)
+
+// Config is everything the logger can be configured with. It is read from a
+// YAML or TOML file, then overridden by SENSE_* environment variables, then by
+// command line flags.
+type Config struct {
+	Username     string   `yaml:"username" toml:"username"`
+	Password     string   `yaml:"password" toml:"password"`
+	PasswordFile string   `yaml:"password_file" toml:"password_file"`
+	TOTPSecret   string   `yaml:"totp_secret" toml:"totp_secret"`
+	TokenFile    string   `yaml:"token_file" toml:"token_file"`
+	ApiURL       string   `yaml:"api_url" toml:"api_url"`
+	WebsocketURL string   `yaml:"websocket_url" toml:"websocket_url"`
+	Monitors     []string `yaml:"monitors" toml:"monitors"`
+
+	OutputDir  string        `yaml:"output_dir" toml:"output_dir"`
+	SampleRate time.Duration `yaml:"sample_rate" toml:"sample_rate"`
+	LogLevel   string        `yaml:"log_level" toml:"log_level"`
+	Display    string        `yaml:"display" toml:"display"`
+	// Daemon runs without a terminal: the screen display becomes the log
+	// display.
+	Daemon bool `yaml:"daemon" toml:"daemon"`
+	// StatusAddress, if set, is where the status and liveness endpoints are
+	// served. The liveness check fails once a monitor has sent nothing for
+	// StaleAfter.
+	StatusAddress string        `yaml:"status_address" toml:"status_address"`
+	StaleAfter    time.Duration `yaml:"stale_after" toml:"stale_after"`
+	// DemandWindow is how long demand is averaged over, and DemandSource
+	// whether it is measured on the power drawn from the grid or on the
+	// house's total.
+	DemandWindow time.Duration `yaml:"demand_window" toml:"demand_window"`
+	DemandSource string        `yaml:"demand_source" toml:"demand_source"`
+
+	ArchiveDir  string  `yaml:"archive_dir" toml:"archive_dir"`
+	Replay      string  `yaml:"replay" toml:"replay"`
+	ReplaySpeed float64 `yaml:"replay_speed" toml:"replay_speed"`
+
+	Sinks SinksConfig `yaml:"sinks" toml:"sinks"`
+
+	// Tariff prices the energy recorded. Without it, the cost command uses
+	// the flat rate set in Sense.
+	Tariff *tariff.Tariff `yaml:"tariff" toml:"tariff"`
+}
+
+type SinksConfig struct {
+	RRD struct {
+		Enabled bool `yaml:"enabled" toml:"enabled"`
+	} `yaml:"rrd" toml:"rrd"`
+	Prometheus struct {
+		Enabled bool   `yaml:"enabled" toml:"enabled"`
+		Address string `yaml:"address" toml:"address"`
+	} `yaml:"prometheus" toml:"prometheus"`
+	InfluxDB struct {
+		Enabled  bool   `yaml:"enabled" toml:"enabled"`
+		URL      string `yaml:"url" toml:"url"`
+		Org      string `yaml:"org" toml:"org"`
+		Bucket   string `yaml:"bucket" toml:"bucket"`
+		Token    string `yaml:"token" toml:"token"`
+		Database string `yaml:"database" toml:"database"`
+		Username string `yaml:"username" toml:"username"`
+		Password string `yaml:"password" toml:"password"`
+		Spool    string `yaml:"spool" toml:"spool"`
+	} `yaml:"influxdb" toml:"influxdb"`
+	MQTT struct {
+		Enabled         bool   `yaml:"enabled" toml:"enabled"`
+		Broker          string `yaml:"broker" toml:"broker"`
+		Username        string `yaml:"username" toml:"username"`
+		Password        string `yaml:"password" toml:"password"`
+		TopicPrefix     string `yaml:"topic_prefix" toml:"topic_prefix"`
+		DiscoveryPrefix string `yaml:"discovery_prefix" toml:"discovery_prefix"`
+		NoDiscovery     bool   `yaml:"no_discovery" toml:"no_discovery"`
+	} `yaml:"mqtt" toml:"mqtt"`
+	SQLite struct {
+		Enabled bool   `yaml:"enabled" toml:"enabled"`
+		Path    string `yaml:"path" toml:"path"`
+	} `yaml:"sqlite" toml:"sqlite"`
+	// Timeline keeps the history of devices turning on and off beside the
+	// RRD files.
+	Timeline struct {
+		Enabled bool `yaml:"enabled" toml:"enabled"`
+	} `yaml:"timeline" toml:"timeline"`
+}
+
+// sinkNames lists the sinks in the order they are added.
+var sinkNames = []string{"rrd", "prometheus", "influxdb", "mqtt", "sqlite", "timeline"}
+
+func defaultConfig() *Config {
+	config := &Config{
+		OutputDir:    "out",
+		SampleRate:   time.Second,
+		LogLevel:     "info",
+		Display:      displayScreen,
+		ReplaySpeed:  1,
+		StaleAfter:   5 * time.Minute,
+		DemandWindow: 15 * time.Minute,
+		DemandSource: string(demand.Grid),
+	}
+	config.Sinks.RRD.Enabled = true
+	config.Sinks.Timeline.Enabled = true
+	config.Sinks.Prometheus.Address = ":9100"
+	if dir, err := os.UserConfigDir(); err == nil {
+		config.TokenFile = filepath.Join(dir, "sense-logger", "token.json")
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		config.Sinks.InfluxDB.Spool = filepath.Join(dir, "sense-logger", "influx-spool")
+	}
+	return config
+}
+
+// defaultConfigFile is read if it exists and no other file is named. It is
+// config.yaml, or config.toml if only that exists.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(dir, "sense-logger", "config.yaml")
+	if other := filepath.Join(dir, "sense-logger", "config.toml"); !fileExists(path) && fileExists(other) {
+		return other
+	}
+	return path
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// What a command needs from the configuration, which decides what is
+// validated.
+const (
+	needLogin  = 1 << iota // Sense credentials
+	needSinks              // everything the run command uses
+	needTariff             // a tariff, or Sense credentials to look one up
+)
+
+// configFlags are the flags that override the configuration. Commands add
+// their own flags to set before calling load.
+type configFlags struct {
+	set   *flag.FlagSet
+	needs int
+
+	configFile   *string
+	username     *string
+	passwordFile *string
+	monitors     *string
+	outputDir    *string
+	logLevel     *string
+	sinks        *string
+	sampleRate   *time.Duration
+	display      *string
+	daemon       *bool
+	statusAddr   *string
+	staleAfter   *time.Duration
+	replay       *string
+}
+
+func newConfigFlags(command string, needs int) *configFlags {
+	set := flag.NewFlagSet(command, flag.ContinueOnError)
+	f := &configFlags{
+		set:        set,
+		needs:      needs,
+		configFile: set.String("config", "", "YAML or TOML config `file` (default "+defaultConfigFile()+", if it exists)"),
+		monitors:   set.String("monitors", "", "comma-separated monitor IDs or serial numbers (default all)"),
+		outputDir:  set.String("out", "", "`directory` for RRD files"),
+		logLevel:   set.String("log-level", "", "debug, info, warn or error"),
+	}
+	if needs&needLogin != 0 {
+		f.username = set.String("user", "", "Sense account email address")
+		f.passwordFile = set.String("password-file", "", "read the Sense password from `file`")
+	}
+	if needs&needSinks != 0 {
+		f.sinks = set.String("sinks", "", "comma-separated sinks to enable: "+strings.Join(sinkNames, ", "))
+		f.sampleRate = set.Duration("sample-rate", 0, "minimum interval between samples written to the sinks")
+		f.display = set.String("display", "", "screen, log or none")
+		f.daemon = set.Bool("daemon", false, "run without a terminal, logging updates instead of redrawing the screen")
+		f.statusAddr = set.String("status-addr", "", "serve /status and /healthz on `address`")
+		f.staleAfter = set.Duration("stale-after", 0, "how long without updates before /healthz fails")
+		f.replay = set.String("replay", "", "replay the archive in `directory` instead of connecting to Sense")
+	}
+	return f
+}
+
+// load parses args and builds the configuration from the defaults, the
+// config file, the environment and the flags, in increasing order of
+// precedence, and validates it.
+func (f *configFlags) load(args []string) (*Config, error) {
+	if err := f.set.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		// The flag package has already reported the mistake.
+		return nil, usageError{}
+	}
+	config, err := f.build()
+	if err != nil {
+		return nil, usageError{err}
+	}
+	return config, nil
+}
+
+func (f *configFlags) build() (*Config, error) {
+	config := defaultConfig()
+
+	path := *f.configFile
+	if path == "" {
+		path = os.Getenv("SENSE_CONFIG")
+	}
+	if path == "" {
+		if fileExists(defaultConfigFile()) {
+			path = defaultConfigFile()
+		}
+	}
+	if path != "" {
+		if err := config.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.readEnv(); err != nil {
+		return nil, err
+	}
+
+	f.set.Visit(func(flag *flag.Flag) {
+		switch flag.Name {
+		case "user":
+			config.Username = *f.username
+		case "password-file":
+			config.PasswordFile = *f.passwordFile
+			config.Password = ""
+		case "monitors":
+			config.Monitors = splitList(*f.monitors)
+		case "out":
+			config.OutputDir = *f.outputDir
+		case "sample-rate":
+			config.SampleRate = *f.sampleRate
+		case "log-level":
+			config.LogLevel = *f.logLevel
+		case "display":
+			config.Display = *f.display
+		case "daemon":
+			config.Daemon = *f.daemon
+		case "status-addr":
+			config.StatusAddress = *f.statusAddr
+		case "stale-after":
+			config.StaleAfter = *f.staleAfter
+		case "replay":
+			config.Replay = *f.replay
+		}
+	})
+	if f.sinks != nil && *f.sinks != "" {
+		if err := config.enableSinks(splitList(*f.sinks)); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Daemon && config.Display == displayScreen {
+		config.Display = displayLog
+	}
+
+	if f.needs&needLogin != 0 && config.PasswordFile != "" && config.Password == "" {
+		password, err := os.ReadFile(config.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("password_file: %w", err)
+		}
+		config.Password = strings.TrimRight(string(password), "\r\n")
+	}
+	if err := config.validate(f.needs); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readFile reads a config file, which is TOML if its name ends in .toml and
+// YAML otherwise. Unknown keys are errors in both.
+func (c *Config) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	defer file.Close()
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		metadata, err := toml.NewDecoder(file).Decode(c)
+		if err != nil {
+			return fmt.Errorf("error reading config file %v: %w", path, err)
+		}
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("error reading config file %v: unknown keys %s", path, strings.Join(keys, ", "))
+		}
+		return nil
+	}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("error reading config file %v: %w", path, err)
+	}
+	return nil
+}
+
+// readEnv applies the SENSE_* environment variables. Setting the variable
+// that points a sink somewhere also enables it.
+func (c *Config) readEnv() error {
+	str := func(name string, value *string) {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+	str("SENSE_USER", &c.Username)
+	str("SENSE_PASS", &c.Password)
+	if v := os.Getenv("SENSE_PASS_FILE"); v != "" {
+		c.PasswordFile = v
+		c.Password = ""
+	}
+	str("SENSE_TOTP_SECRET", &c.TOTPSecret)
+	str("SENSE_TOKEN_FILE", &c.TokenFile)
+	str("SENSE_API_URL", &c.ApiURL)
+	str("SENSE_WEBSOCKET_URL", &c.WebsocketURL)
+	if v := os.Getenv("SENSE_MONITORS"); v != "" {
+		c.Monitors = splitList(v)
+	}
+	str("SENSE_OUT", &c.OutputDir)
+	str("SENSE_LOG_LEVEL", &c.LogLevel)
+	str("SENSE_DISPLAY", &c.Display)
+	str("SENSE_ARCHIVE_DIR", &c.ArchiveDir)
+	str("SENSE_REPLAY", &c.Replay)
+	str("SENSE_STATUS_ADDR", &c.StatusAddress)
+	if v := os.Getenv("SENSE_SAMPLE_RATE"); v != "" {
+		rate, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("SENSE_SAMPLE_RATE: %w", err)
+		}
+		c.SampleRate = rate
+	}
+	if v := os.Getenv("SENSE_STALE_AFTER"); v != "" {
+		staleAfter, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("SENSE_STALE_AFTER: %w", err)
+		}
+		c.StaleAfter = staleAfter
+	}
+	if v := os.Getenv("SENSE_DEMAND_WINDOW"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("SENSE_DEMAND_WINDOW: %w", err)
+		}
+		c.DemandWindow = window
+	}
+	str("SENSE_DEMAND_SOURCE", &c.DemandSource)
+	if v := os.Getenv("SENSE_DAEMON"); v != "" {
+		daemon, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("SENSE_DAEMON: %w", err)
+		}
+		c.Daemon = daemon
+	}
+	if v := os.Getenv("SENSE_REPLAY_SPEED"); v != "" {
+		speed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("SENSE_REPLAY_SPEED: %w", err)
+		}
+		c.ReplaySpeed = speed
+	}
+
+	sinks := &c.Sinks
+	if v := os.Getenv("SENSE_METRICS_ADDR"); v != "" {
+		sinks.Prometheus.Enabled = true
+		sinks.Prometheus.Address = v
+	}
+	if v := os.Getenv("SENSE_INFLUX_URL"); v != "" {
+		sinks.InfluxDB.Enabled = true
+		sinks.InfluxDB.URL = v
+	}
+	str("SENSE_INFLUX_ORG", &sinks.InfluxDB.Org)
+	str("SENSE_INFLUX_BUCKET", &sinks.InfluxDB.Bucket)
+	str("SENSE_INFLUX_TOKEN", &sinks.InfluxDB.Token)
+	str("SENSE_INFLUX_DATABASE", &sinks.InfluxDB.Database)
+	str("SENSE_INFLUX_SPOOL", &sinks.InfluxDB.Spool)
+	if v := os.Getenv("SENSE_MQTT_BROKER"); v != "" {
+		sinks.MQTT.Enabled = true
+		sinks.MQTT.Broker = v
+	}
+	str("SENSE_MQTT_USER", &sinks.MQTT.Username)
+	str("SENSE_MQTT_PASS", &sinks.MQTT.Password)
+	str("SENSE_MQTT_PREFIX", &sinks.MQTT.TopicPrefix)
+	if v := os.Getenv("SENSE_SQLITE"); v != "" {
+		sinks.SQLite.Enabled = true
+		sinks.SQLite.Path = v
+	}
+	if v := os.Getenv("SENSE_SINKS"); v != "" {
+		return c.enableSinks(splitList(v))
+	}
+	return nil
+}
+
+// enableSinks enables exactly the named sinks.
+func (c *Config) enableSinks(names []string) error {
+	enabled := map[string]*bool{
+		"rrd":        &c.Sinks.RRD.Enabled,
+		"prometheus": &c.Sinks.Prometheus.Enabled,
+		"influxdb":   &c.Sinks.InfluxDB.Enabled,
+		"mqtt":       &c.Sinks.MQTT.Enabled,
+		"sqlite":     &c.Sinks.SQLite.Enabled,
+		"timeline":   &c.Sinks.Timeline.Enabled,
+	}
+	for _, e := range enabled {
+		*e = false
+	}
+	for _, name := range names {
+		e, ok := enabled[name]
+		if !ok {
+			return fmt.Errorf("unknown sink %q; the sinks are %s", name, strings.Join(sinkNames, ", "))
+		}
+		*e = true
+	}
+	return nil
+}
+
+// validate checks that the parts of the configuration a command needs make
+// sense, returning every problem found at once.
+func (c *Config) validate(needs int) error {
+	var errs []error
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Tariff != nil {
+		if err := c.Tariff.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("tariff: %w", err))
+		}
+	}
+	// A configured tariff doesn't need looking up in Sense.
+	if needs&needLogin != 0 && c.Replay == "" && (needs&needTariff == 0 || c.Tariff == nil) {
+		if c.Username == "" {
+			errs = append(errs, fmt.Errorf("username is required (set it in the config file, SENSE_USER or -user)"))
+		}
+		if c.Password == "" && c.TokenFile == "" {
+			errs = append(errs, fmt.Errorf("password is required when there is no token_file (set password, password_file, SENSE_PASS or -password-file)"))
+		}
+	}
+	if needs&needSinks != 0 {
+		errs = append(errs, c.validateRun()...)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %w", joinErrors(errs))
+	}
+	return nil
+}
+
+func (c *Config) validateRun() []error {
+	var errs []error
+	if c.Replay != "" && c.ReplaySpeed < 0 {
+		errs = append(errs, fmt.Errorf("replay_speed must not be negative"))
+	}
+	if c.StaleAfter <= 0 {
+		errs = append(errs, fmt.Errorf("stale_after must be positive, not %v", c.StaleAfter))
+	}
+	if c.DemandWindow < time.Minute {
+		errs = append(errs, fmt.Errorf("demand_window must be at least 1m, not %v", c.DemandWindow))
+	}
+	switch demand.Source(c.DemandSource) {
+	case demand.Grid, demand.Total:
+	default:
+		errs = append(errs, fmt.Errorf("demand_source must be %s or %s, not %q", demand.Grid, demand.Total, c.DemandSource))
+	}
+	if c.SampleRate < time.Second {
+		errs = append(errs, fmt.Errorf("sample_rate must be at least 1s, not %v", c.SampleRate))
+	}
+	if c.Sinks.RRD.Enabled && c.SampleRate > rrd.Heartbeat*time.Second {
+		errs = append(errs, fmt.Errorf("sample_rate must be at most %ds when the rrd sink is enabled, not %v", rrd.Heartbeat, c.SampleRate))
+	}
+	switch c.Display {
+	case displayScreen, displayLog, displayNone:
+	default:
+		errs = append(errs, fmt.Errorf("display must be %s, %s or %s, not %q", displayScreen, displayLog, displayNone, c.Display))
+	}
+	if c.OutputDir == "" && c.Sinks.RRD.Enabled {
+		errs = append(errs, fmt.Errorf("output_dir is required when the rrd sink is enabled"))
+	}
+	if c.OutputDir == "" && c.Sinks.Timeline.Enabled {
+		errs = append(errs, fmt.Errorf("output_dir is required when the timeline sink is enabled"))
+	}
+
+	sinks := &c.Sinks
+	if !sinks.RRD.Enabled && !sinks.Prometheus.Enabled && !sinks.InfluxDB.Enabled && !sinks.MQTT.Enabled && !sinks.SQLite.Enabled && !sinks.Timeline.Enabled {
+		errs = append(errs, fmt.Errorf("no sinks are enabled"))
+	}
+	if sinks.Prometheus.Enabled && sinks.Prometheus.Address == "" {
+		errs = append(errs, fmt.Errorf("sinks.prometheus.address is required"))
+	}
+	if sinks.InfluxDB.Enabled {
+		if sinks.InfluxDB.URL == "" {
+			errs = append(errs, fmt.Errorf("sinks.influxdb.url is required"))
+		}
+		if sinks.InfluxDB.Database == "" && (sinks.InfluxDB.Org == "" || sinks.InfluxDB.Bucket == "") {
+			errs = append(errs, fmt.Errorf("sinks.influxdb needs either org and bucket (InfluxDB 2.x) or database (1.x)"))
+		}
+	}
+	if sinks.MQTT.Enabled && sinks.MQTT.Broker == "" {
+		errs = append(errs, fmt.Errorf("sinks.mqtt.broker is required"))
+	}
+	if sinks.SQLite.Enabled && sinks.SQLite.Path == "" {
+		errs = append(errs, fmt.Errorf("sinks.sqlite.path is required"))
+	}
+	return errs
+}
+
+// joinErrors joins errs one per line, indented to follow "invalid
+// configuration".
+func joinErrors(errs []error) error {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return errors.New(strings.Join(messages, "\n  "))
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("log_level must be debug, info, warn or error, not %q", level)
+	}
+	return l, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
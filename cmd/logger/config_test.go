@@ -0,0 +1,266 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildConfig builds the run command's configuration from args.
+func buildConfig(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	f := newConfigFlags("run", needLogin|needSinks)
+	if err := f.set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f.build()
+}
+
+// isolate clears the SENSE_* environment and points the user configuration
+// directory somewhere empty.
+func isolate(t *testing.T) {
+	t.Helper()
+	for _, v := range os.Environ() {
+		if name, _, _ := strings.Cut(v, "="); strings.HasPrefix(name, "SENSE_") {
+			t.Setenv(name, "")
+		}
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+}
+
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	isolate(t)
+	path := writeFile(t, "config.yaml", `
+username: file@example.com
+password: file
+output_dir: file-out
+log_level: debug
+stale_after: 2m
+sample_rate: 5s
+`)
+
+	// The file overrides the defaults.
+	config, err := buildConfig(t, "-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "file@example.com" || config.OutputDir != "file-out" || config.StaleAfter != 2*time.Minute {
+		t.Errorf("got %q, %q and %v, want the file's settings", config.Username, config.OutputDir, config.StaleAfter)
+	}
+	if config.DemandWindow != 15*time.Minute || config.Display != displayScreen {
+		t.Errorf("got %v and %q, want the defaults for what the file doesn't set", config.DemandWindow, config.Display)
+	}
+
+	// The environment overrides the file, and the flags override both.
+	t.Setenv("SENSE_USER", "env@example.com")
+	t.Setenv("SENSE_OUT", "env-out")
+	t.Setenv("SENSE_LOG_LEVEL", "warn")
+	t.Setenv("SENSE_STALE_AFTER", "3m")
+	config, err = buildConfig(t, "-config", path, "-out", "flag-out", "-stale-after", "4m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range []struct {
+		name      string
+		got, want any
+	}{
+		{"username", config.Username, "env@example.com"},
+		{"log_level", config.LogLevel, "warn"},
+		{"output_dir", config.OutputDir, "flag-out"},
+		{"stale_after", config.StaleAfter, 4 * time.Minute},
+		{"sample_rate", config.SampleRate, 5 * time.Second},
+	} {
+		if check.got != check.want {
+			t.Errorf("got %s %v, want %v", check.name, check.got, check.want)
+		}
+	}
+
+	// SENSE_CONFIG names the file when -config doesn't.
+	t.Setenv("SENSE_CONFIG", path)
+	config, err = buildConfig(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Password != "file" {
+		t.Errorf("got password %q, want the one from SENSE_CONFIG's file", config.Password)
+	}
+}
+
+func TestConfigTOML(t *testing.T) {
+	isolate(t)
+	path := writeFile(t, "config.toml", `
+username = "toml@example.com"
+password = "secret"
+monitors = ["N000000001", "2"]
+stale_after = "90s"
+
+[sinks.prometheus]
+enabled = true
+address = ":9200"
+
+[tariff]
+rate = 0.14
+tiers = [{up_to = 500.0, rate = 0.12}, {rate = 0.16}]
+`)
+	config, err := buildConfig(t, "-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "toml@example.com" || len(config.Monitors) != 2 || config.StaleAfter != 90*time.Second {
+		t.Errorf("got %q, %v and %v, want the TOML file's settings", config.Username, config.Monitors, config.StaleAfter)
+	}
+	if !config.Sinks.Prometheus.Enabled || config.Sinks.Prometheus.Address != ":9200" {
+		t.Errorf("got prometheus sink %+v, want it enabled on :9200", config.Sinks.Prometheus)
+	}
+	if config.Tariff == nil || len(config.Tariff.Tiers) != 2 || config.Tariff.Tiers[0].UpTo != 500 {
+		t.Errorf("got tariff %+v, want two tiers", config.Tariff)
+	}
+
+	// Misspelt keys are errors, as they are in YAML.
+	path = writeFile(t, "config.toml", "username = \"a\"\n[sinks.prometheus]\nadress = \":9200\"\n")
+	if _, err := buildConfig(t, "-config", path); err == nil || !strings.Contains(err.Error(), "sinks.prometheus.adress") {
+		t.Errorf("got error %v, want the unknown key reported", err)
+	}
+	path = writeFile(t, "config.yaml", "usernme: a\n")
+	if _, err := buildConfig(t, "-config", path); err == nil || !strings.Contains(err.Error(), "usernme") {
+		t.Errorf("got error %v, want the unknown key reported", err)
+	}
+}
+
+func TestDefaultConfigFile(t *testing.T) {
+	isolate(t)
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	dir = filepath.Join(dir, "sense-logger")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := defaultConfigFile(), filepath.Join(dir, "config.yaml"); got != want {
+		t.Errorf("got %s with no config file, want %s", got, want)
+	}
+	toml := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(toml, []byte("username = \"toml@example.com\"\npassword = \"secret\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := defaultConfigFile(); got != toml {
+		t.Errorf("got %s, want %s when only it exists", got, toml)
+	}
+	config, err := buildConfig(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "toml@example.com" {
+		t.Errorf("got username %q, want the default config file's", config.Username)
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	isolate(t)
+	passwordFile := writeFile(t, "password", "from-file\r\n")
+	path := writeFile(t, "config.yaml", "username: a@example.com\npassword: from-config\n")
+
+	// A password file given in the environment or on the command line
+	// replaces the password in the config file, and loses its line ending.
+	t.Setenv("SENSE_PASS_FILE", passwordFile)
+	config, err := buildConfig(t, "-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Password != "from-file" {
+		t.Errorf("got password %q, want %q", config.Password, "from-file")
+	}
+	t.Setenv("SENSE_PASS_FILE", "")
+	config, err = buildConfig(t, "-config", path, "-password-file", passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Password != "from-file" {
+		t.Errorf("got password %q with -password-file, want %q", config.Password, "from-file")
+	}
+
+	// A password in the environment wins over a password file in the
+	// config file.
+	path = writeFile(t, "config.yaml", "username: a@example.com\npassword_file: "+passwordFile+"\n")
+	t.Setenv("SENSE_PASS", "from-env")
+	config, err = buildConfig(t, "-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Password != "from-env" {
+		t.Errorf("got password %q, want %q", config.Password, "from-env")
+	}
+
+	t.Setenv("SENSE_PASS", "")
+	_, err = buildConfig(t, "-config", path, "-password-file", filepath.Join(t.TempDir(), "missing"))
+	if err == nil || !strings.Contains(err.Error(), "password_file") {
+		t.Errorf("got error %v, want a password_file error", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	isolate(t)
+	path := writeFile(t, "config.yaml", `
+sample_rate: 500ms
+stale_after: 0s
+demand_window: 30s
+demand_source: solar
+display: fancy
+log_level: loud
+output_dir: ""
+token_file: ""
+sinks:
+  influxdb:
+    enabled: true
+  mqtt:
+    enabled: true
+`)
+	_, err := buildConfig(t, "-config", path)
+	if err == nil {
+		t.Fatal("got no error for an invalid configuration")
+	}
+	// Every problem is reported at once.
+	for _, want := range []string{
+		"username is required",
+		"password is required",
+		"log_level must be",
+		"sample_rate must be at least 1s",
+		"stale_after must be positive",
+		"demand_window must be at least 1m",
+		"demand_source must be",
+		"display must be",
+		"output_dir is required when the rrd sink is enabled",
+		"sinks.influxdb.url is required",
+		"sinks.mqtt.broker is required",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %q, want it to include %q", err, want)
+		}
+	}
+
+	if _, err := buildConfig(t, "-config", path, "-sinks", "rrd,bogus"); err == nil || !strings.Contains(err.Error(), `unknown sink "bogus"`) {
+		t.Errorf("got error %v, want the unknown sink reported", err)
+	}
+
+	// The rrd sink can't take samples further apart than its heartbeat.
+	path = writeFile(t, "config.yaml", "username: a@example.com\npassword: p\nsample_rate: 1m\n")
+	if _, err := buildConfig(t, "-config", path); err == nil || !strings.Contains(err.Error(), "sample_rate must be at most") {
+		t.Errorf("got error %v, want the sample rate rejected", err)
+	}
+	if _, err := buildConfig(t, "-config", path, "-sinks", "prometheus"); err != nil {
+		t.Errorf("got error %v, want a 1m sample rate allowed without the rrd sink", err)
+	}
+}
@@ -1,63 +1,688 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/adamroach/sense-logger/archive"
+	"github.com/adamroach/sense-logger/demand"
+	"github.com/adamroach/sense-logger/energy"
+	"github.com/adamroach/sense-logger/gaps"
+	"github.com/adamroach/sense-logger/influx"
+	"github.com/adamroach/sense-logger/metrics"
+	"github.com/adamroach/sense-logger/mqtt"
 	"github.com/adamroach/sense-logger/rrd"
+	"github.com/adamroach/sense-logger/sdnotify"
 	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sink"
+	"github.com/adamroach/sense-logger/sqlite"
+	"github.com/adamroach/sense-logger/timeline"
 )
 
+// logger holds what every monitor being logged shares.
+type logger struct {
+	config   *Config
+	exporter *metrics.Exporter // set when the prometheus sink is enabled
+	recorder *archive.Recorder // set when the feed is archived
+	display  *display
+	status   *status
+}
+
 func main() {
-	client := sense.NewClient()
-	// TODO -- add configuration for username and password
-	err := client.Login(os.Getenv("SENSE_USER"), os.Getenv("SENSE_PASS"))
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage(os.Stdout)
+		return
+	}
+	i := slices.IndexFunc(commands, func(c *command) bool { return c.name == name })
+	if i < 0 {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	err := commands[i].run(args)
+	var usageErr usageError
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+	case errors.As(err, &usageErr):
+		if usageErr.err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// setupLogging sends log output through slog at the configured level.
+func setupLogging(config *Config) {
+	level, _ := parseLogLevel(config.LogLevel)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	// The library packages log with the log package; those messages are
+	// warnings.
+	slog.SetLogLoggerLevel(slog.LevelWarn)
+}
+
+// newClient returns a Client logged in with the configured credentials, along
+// with a function that logs it in again.
+func newClient(config *Config, opts ...sense.Option) (*sense.Client, func(ctx context.Context) error, error) {
+	if config.ApiURL != "" {
+		opts = append(opts, sense.WithApiURL(config.ApiURL))
+	}
+	if config.WebsocketURL != "" {
+		opts = append(opts, sense.WithWebsocketURL(config.WebsocketURL))
+	}
+	if config.TOTPSecret != "" {
+		opts = append(opts, sense.WithTOTPSecret(config.TOTPSecret))
+	}
+	if config.TokenFile != "" {
+		opts = append(opts, sense.WithTokenStore(sense.NewFileTokenStore(config.TokenFile)))
+	}
+	client := sense.NewClient(opts...)
+	login := func(ctx context.Context) error {
+		return client.LoginContext(ctx, config.Username, config.Password)
+	}
+	if err := login(context.Background()); err != nil {
+		return nil, nil, err
+	}
+	return client, login, nil
+}
+
+// runCommand logs every configured monitor, or replays an archive, until it
+// is interrupted or terminated. It then stops taking updates, lets every
+// sink write out what it has queued, and closes them.
+func runCommand(args []string) error {
+	config, err := newConfigFlags("run", needLogin|needSinks).load(args)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	// TODO -- add configuration for the output directory
-	rrdWriter, err := rrd.NewWriter("out")
+	setupLogging(config)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopShutdown := context.AfterFunc(ctx, func() {
+		// With the signals no longer caught, a second one kills the
+		// process.
+		stop()
+		slog.Info("Shutting down; interrupt again to exit immediately")
+		sdnotify.Stopping()
+	})
+	defer stopShutdown()
+
+	l := &logger{
+		config:  config,
+		display: &display{mode: config.Display, updates: map[int]*sense.RealtimeUpdate{}},
+		status:  newStatus(config.StaleAfter),
+	}
+	// The metrics and status endpoints share a server if they are given the
+	// same address.
+	muxes := map[string]*http.ServeMux{}
+	mux := func(address string) *http.ServeMux {
+		if muxes[address] == nil {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+	if config.Sinks.Prometheus.Enabled {
+		l.exporter = metrics.NewExporter()
+		mux(config.Sinks.Prometheus.Address).Handle("/metrics", l.exporter.Handler())
+	}
+	if config.StatusAddress != "" {
+		mux(config.StatusAddress).HandleFunc("/status", l.status.handleStatus)
+		mux(config.StatusAddress).HandleFunc("/healthz", l.status.handleHealth)
+	}
+	for address, mux := range muxes {
+		shutdown, err := serveHTTP(address, mux)
+		if err != nil {
+			return err
+		}
+		defer shutdown()
+	}
+
+	if config.Replay != "" {
+		err = l.replay(ctx)
+	} else {
+		err = l.run(ctx)
+	}
+	if err == nil {
+		slog.Info("Stopped")
+	}
+	return err
+}
+
+// serveHTTP serves handler on address until the returned function is
+// called. Unlike http.ListenAndServe, it reports a bad or busy address
+// straight away.
+func serveHTTP(address string, handler http.Handler) (func(), error) {
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", "address", address, "err", err)
+		}
+	}()
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+// run logs in and logs every configured monitor until ctx is done or a
+// monitor's feed fails for good.
+func (l *logger) run(ctx context.Context) error {
+	config := l.config
+	var opts []sense.Option
+	// Every raw realtime feed message can be archived for later replay.
+	if config.ArchiveDir != "" {
+		recorder, err := archive.NewRecorder(config.ArchiveDir)
+		if err != nil {
+			return err
+		}
+		defer recorder.Close()
+		l.recorder = recorder
+		opts = append(opts, sense.WithFrameRecorder(recorder))
 	}
-	devices, err := client.GetDevices()
+	client, login, err := newClient(config, opts...)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = rrdWriter.UpdateDeviceNames(devices.Devices)
+
+	// By default, every monitor on the account is logged.
+	monitors := config.Monitors
+	if len(monitors) == 0 {
+		infos, err := client.Monitors()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			monitors = append(monitors, strconv.Itoa(info.ID))
+		}
+	}
+	if len(monitors) == 0 {
+		return sense.ErrNoMonitors
+	}
+
+	// A monitor whose feed fails for good stops the others, so that the
+	// process exits and its supervisor can restart it.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var wg sync.WaitGroup
+	for _, monitor := range monitors {
+		m, err := l.startMonitor(client, monitor, len(monitors) == 1)
+		if err != nil {
+			cancel(err)
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.logMonitor(ctx, m, login); err != nil {
+				cancel(fmt.Errorf("monitor %s: %w", monitor, err))
+			}
+		}()
+	}
+	if ctx.Err() == nil {
+		sdnotify.Ready(fmt.Sprintf("Logging %d monitor(s)", len(monitors)))
+		go l.watchdog(ctx)
+	}
+	wg.Wait()
+	client.Close()
+	if err := context.Cause(ctx); !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// startMonitor sets up a Client and the sinks for monitor, with the sinks
+// given the monitor's devices, and starts tracking its status.
+func (l *logger) startMonitor(client *sense.Client, monitor string, single bool) (*monitorStatus, error) {
+	monitorClient, err := client.ForMonitor(monitor)
+	if err != nil {
+		return nil, fmt.Errorf("monitor %s: %w", monitor, err)
+	}
+	info, err := monitorClient.Monitor()
+	if err != nil {
+		return nil, err
+	}
+	devices, err := monitorClient.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+	sinks, err := l.newSinks(*info, single, false)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	m, err := l.track(info.ID, monitorClient, sinks, single)
+	if err != nil {
+		return nil, err
+	}
+	sinks.UpdateDevices(devices.Devices)
+	l.recordDevices(info.ID, devices.Devices)
+	// The client reloads the device list when Sense says it has changed.
+	monitorClient.SetDeviceEventHandler(func(events []sense.DeviceEvent, devices *sense.Devices) {
+		for _, event := range events {
+			slog.Info("Device "+string(event.Type), "monitor", info.ID, "device", event.Device.ID,
+				"name", event.Device.Name, "old_name", event.OldName)
+		}
+		sinks.UpdateDevices(devices.Devices)
+		l.recordDevices(info.ID, devices.Devices)
+	})
+	slog.Info("Logging monitor", "monitor", info.ID, "serial", info.SerialNumber, "devices", len(devices.Devices))
+	return m, nil
+}
+
+// recordDevices archives a monitor's device list, if the feed is archived,
+// so that a replay can name the devices.
+func (l *logger) recordDevices(monitorID int, devices []sense.Device) {
+	if l.recorder == nil {
+		return
+	}
+	if err := l.recorder.RecordDevices(monitorID, time.Now(), devices); err != nil {
+		slog.Error("Failed to archive devices", "monitor", monitorID, "error", err)
+	}
+}
+
+// track starts tracking the status of a monitor logged to sinks. If there
+// is an output directory, the monitor's gap log, energy totals and peak
+// demand are kept there, beside its RRD files. If tracking can't start, the
+// sinks are closed.
+func (l *logger) track(monitorID int, client *sense.Client, sinks *sink.Fanout, single bool) (*monitorStatus, error) {
+	m := &monitorStatus{id: monitorID, client: client, sinks: sinks}
+	if l.config.OutputDir != "" {
+		directory := l.monitorDirectory(monitorID, single)
+		var err error
+		m.detector, err = gaps.NewDetector(directory, gaps.Options{
+			OnGap: func(gap gaps.Gap) {
+				slog.Warn("Gap in readings", "monitor", monitorID, "cause", gap.Cause,
+					"start", gap.Start, "duration", gap.Duration(), "frames", gap.Frames)
+			},
+		})
+		if err == nil {
+			m.integrator, err = energy.NewIntegrator(directory, energy.Options{})
+		}
+		if err == nil {
+			m.demand, err = demand.NewTracker(directory, demand.Options{
+				Window: l.config.DemandWindow,
+				Source: demand.Source(l.config.DemandSource),
+				OnPeak: func(peak demand.Peak) {
+					slog.Info("New monthly peak demand", "monitor", monitorID, "month", peak.Month,
+						"watts", math.Round(peak.Watts), "time", peak.Time)
+				},
+				OnAlert: func(alert demand.Alert) {
+					slog.Warn("Demand is on course to set a new monthly peak", "monitor", monitorID,
+						"watts", math.Round(alert.Watts), "projected", math.Round(alert.Projected),
+						"peak", math.Round(alert.Peak.Watts))
+				},
+			})
+		}
+		if err != nil {
+			closeMonitor(m)
+			return nil, err
+		}
+	}
+	l.status.add(m)
+	return m, nil
+}
+
+// closeMonitor closes m's sinks, then whichever of its gap detector, energy
+// integrator and demand tracker it has.
+func closeMonitor(m *monitorStatus) {
+	if err := m.sinks.Close(); err != nil {
+		slog.Error("Closing sinks failed", "monitor", m.id, "err", err)
+	}
+	if m.detector != nil {
+		if err := m.detector.Close(); err != nil {
+			slog.Error("Closing gap detector failed", "monitor", m.id, "err", err)
+		}
+	}
+	if m.integrator != nil {
+		if err := m.integrator.Close(); err != nil {
+			slog.Error("Closing energy integrator failed", "monitor", m.id, "err", err)
+		}
+	}
+	if m.demand != nil {
+		if err := m.demand.Close(); err != nil {
+			slog.Error("Closing demand tracker failed", "monitor", m.id, "err", err)
+		}
+	}
+}
+
+// monitorDirectory returns the directory for a monitor's files: the output
+// directory itself if there is a single monitor, and otherwise its own
+// subdirectory.
+func (l *logger) monitorDirectory(monitorID int, single bool) string {
+	if single {
+		return l.config.OutputDir
 	}
+	return filepath.Join(l.config.OutputDir, strconv.Itoa(monitorID))
+}
+
+// watchdog pings the systemd watchdog, if it is enabled, for as long as the
+// liveness check passes.
+func (l *logger) watchdog(ctx context.Context) {
+	interval := sdnotify.WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
 	for {
-		if time.Until(client.TokenExpiry()) < time.Minute*5 {
-			_, err := client.Refresh()
-			if err != nil {
-				panic(err)
-			}
-			// Close the websocket -- we'll open a new one with the new token
-			client.Close()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if problems := l.status.problems(); len(problems) > 0 {
+			slog.Warn("Unhealthy; not pinging the watchdog", "problems", strings.Join(problems, "; "))
+			continue
+		}
+		sdnotify.Watchdog()
+	}
+}
+
+// newSinks returns the enabled sinks for monitor. A single monitor's RRD
+// files go straight into the output directory, as they always have; several
+// monitors each get a subdirectory. When replaying, writes wait for the sinks
+// rather than dropping updates.
+func (l *logger) newSinks(monitor sense.MonitorInfo, single, replaying bool) (*sink.Fanout, error) {
+	sinks := sink.NewFanout(sink.FanoutOptions{
+		Block: replaying,
+		OnError: func(name string, err error) {
+			slog.Error("Sink write failed", "monitor", monitor.ID, "sink", name, "err", err)
+		},
+	})
+	if err := l.addSinks(sinks, monitor, single); err != nil {
+		// Close the sinks already added, and their workers.
+		sinks.Close()
+		return nil, err
+	}
+	return sinks, nil
+}
+
+// addSinks adds the enabled sinks for monitor to sinks.
+func (l *logger) addSinks(sinks *sink.Fanout, monitor sense.MonitorInfo, single bool) error {
+	config := &l.config.Sinks
+	if config.RRD.Enabled {
+		if err := os.MkdirAll(l.config.OutputDir, 0755); err != nil {
+			return fmt.Errorf("error creating directory %v: %w", l.config.OutputDir, err)
+		}
+		var rrdWriter *rrd.Writer
+		var err error
+		if single {
+			rrdWriter, err = rrd.NewWriter(l.config.OutputDir)
+		} else {
+			rrdWriter, err = rrd.NewMonitorWriter(l.config.OutputDir, monitor)
 		}
-		realtimeUpdate, err := client.GetRealtimeUpdate()
 		if err != nil {
-			// Sometimes the websocket disconects -- we'll try refreshing the token
-			_, err := client.Refresh()
-			if err != nil {
-				panic(err)
+			return err
+		}
+		sinks.Add("rrd", rrdWriter)
+	}
+	if config.Prometheus.Enabled {
+		sinks.Add("prometheus", l.exporter.ForMonitor(monitor))
+	}
+	if config.InfluxDB.Enabled {
+		influxWriter, err := influx.New(influx.Config{
+			URL:            config.InfluxDB.URL,
+			Org:            config.InfluxDB.Org,
+			Bucket:         config.InfluxDB.Bucket,
+			Token:          config.InfluxDB.Token,
+			Database:       config.InfluxDB.Database,
+			Username:       config.InfluxDB.Username,
+			Password:       config.InfluxDB.Password,
+			SpoolDirectory: config.InfluxDB.Spool,
+		}, monitor)
+		if err != nil {
+			return err
+		}
+		sinks.Add("influxdb", influxWriter)
+	}
+	if config.MQTT.Enabled {
+		publisher, err := mqtt.New(mqtt.Config{
+			Broker:          config.MQTT.Broker,
+			Username:        config.MQTT.Username,
+			Password:        config.MQTT.Password,
+			TopicPrefix:     config.MQTT.TopicPrefix,
+			DiscoveryPrefix: config.MQTT.DiscoveryPrefix,
+			NoDiscovery:     config.MQTT.NoDiscovery,
+		}, monitor)
+		if err != nil {
+			return err
+		}
+		sinks.Add("mqtt", publisher)
+	}
+	if config.SQLite.Enabled {
+		sqliteWriter, err := sqlite.New(config.SQLite.Path, monitor)
+		if err != nil {
+			return err
+		}
+		sinks.Add("sqlite", sqliteWriter)
+	}
+	if config.Timeline.Enabled {
+		timelineWriter, err := timeline.NewWriter(l.monitorDirectory(monitor.ID, single), func(event timeline.Event) {
+			run := event.Run
+			if event.Type == timeline.On {
+				slog.Debug("Device turned on", "monitor", monitor.ID, "device", run.DeviceID, "name", run.DeviceName)
+				return
 			}
-			continue
+			slog.Debug("Device turned off", "monitor", monitor.ID, "device", run.DeviceID, "name", run.DeviceName,
+				"duration", run.Duration(), "energy_wh", run.EnergyWh, "interrupted", run.Interrupted)
+		})
+		if err != nil {
+			return err
 		}
+		sinks.Add("timeline", timelineWriter)
+	}
+	return nil
+}
+
+// logMonitor streams m's monitor to its sinks until ctx is done or the
+// stream fails for good, then closes the sinks once they have written out
+// everything queued. Closing the stream closes the client's websocket.
+func (l *logger) logMonitor(ctx context.Context, m *monitorStatus, login func(ctx context.Context) error) error {
+	client, sinks, monitorID := m.client, m.sinks, m.id
+	stream := client.NewStream(sense.StreamConfig{
+		Login: login,
+		OnStateChange: func(state sense.StreamState, err error) {
+			if state != sense.StreamConnected && m.detector != nil {
+				m.detector.Disconnect()
+			}
+			if err != nil {
+				slog.Warn("Realtime feed state changed", "monitor", monitorID, "state", state, "err", err)
+			} else {
+				slog.Debug("Realtime feed state changed", "monitor", monitorID, "state", state)
+			}
+		},
+	})
+	m.setStream(stream)
+	subscription := stream.Subscribe(sense.SubscribeOptions{Overflow: sense.Block})
+	done := make(chan error, 1)
+	go func() {
+		done <- stream.Run(ctx)
+	}()
+	sampler := sampler{rate: l.config.SampleRate}
+	// The subscription ends when Run returns.
+	for realtimeUpdate := range subscription.All() {
+		m.receive(realtimeUpdate)
 		deviceCount := len(realtimeUpdate.Payload.Devices)
-		if deviceCount == 0 {
+		if deviceCount == 0 || !sampler.take(realtimeUpdate) {
 			continue
 		}
-		fmt.Print("\033[H\033[2J")
-		fmt.Printf("%v - token expires in %v\n\n", time.Now(), time.Until(client.TokenExpiry()))
-		fmt.Println(realtimeUpdate)
-		err = rrdWriter.Write(realtimeUpdate)
+		header := fmt.Sprintf("%v - token expires in %v", time.Now(), time.Until(client.TokenExpiry()))
+		l.display.show(header, monitorID, realtimeUpdate)
+		// An update some sink had no room for isn't counted as written.
+		if sinks.Write(realtimeUpdate) == nil {
+			m.write()
+		}
+	}
+	err := <-done
+
+	slog.Debug("Closing sinks", "monitor", monitorID)
+	closeMonitor(m)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// replay feeds the frames in the configured archive through the display and
+// sinks, as though they were arriving live, until the archive ends or ctx is
+// done. The configured monitors, which must be given by ID, restrict it to
+// some monitors.
+func (l *logger) replay(ctx context.Context) error {
+	config := l.config
+	options := archive.ReplayOptions{Speed: config.ReplaySpeed}
+	var monitors []int
+	for _, monitor := range config.Monitors {
+		id, err := strconv.Atoi(monitor)
+		if err != nil {
+			return usageError{fmt.Errorf("replay needs monitor IDs, not %q", monitor)}
+		}
+		monitors = append(monitors, id)
+	}
+	// As with a live run, a single monitor writes straight into the output
+	// directory; that depends on what is in the archive, not on how many
+	// monitors are listed.
+	archived, err := archive.Monitors(ctx, config.Replay, options)
+	if err != nil {
+		return err
+	}
+	if len(monitors) > 0 {
+		archived = slices.DeleteFunc(archived, func(id int) bool { return !slices.Contains(monitors, id) })
+	}
+	single := len(archived) == 1
+
+	sdnotify.Ready("Replaying " + config.Replay)
+	statuses := map[int]*monitorStatus{}
+	samplers := map[int]*sampler{}
+	// start sets up a monitor's sinks when its first frame is replayed.
+	start := func(monitorID int) (*monitorStatus, error) {
+		if m, ok := statuses[monitorID]; ok {
+			return m, nil
+		}
+		sinks, err := l.newSinks(sense.MonitorInfo{ID: monitorID}, single, true)
+		if err != nil {
+			return nil, err
+		}
+		m, err := l.track(monitorID, nil, sinks, single)
+		if err != nil {
+			return nil, err
+		}
+		statuses[monitorID] = m
+		samplers[monitorID] = &sampler{rate: config.SampleRate}
+		return m, nil
+	}
+	// The device lists the live run loaded are in the archive with the
+	// updates, and name the devices as they did then.
+	options.OnDevices = func(monitorID int, devices []sense.Device) error {
+		if len(monitors) > 0 && !slices.Contains(monitors, monitorID) {
+			return nil
+		}
+		m, err := start(monitorID)
+		if err != nil {
+			return err
+		}
+		m.sinks.UpdateDevices(devices)
+		return nil
+	}
+	err = archive.ReplayUpdates(ctx, config.Replay, options, func(monitorID int, update *sense.RealtimeUpdate) error {
+		if len(monitors) > 0 && !slices.Contains(monitors, monitorID) {
+			return nil
+		}
+		m, err := start(monitorID)
 		if err != nil {
-			fmt.Printf("Error writing to RRD: %v\n", err)
+			return err
 		}
+		m.receive(update)
+		if len(update.Payload.Devices) == 0 || !samplers[monitorID].take(update) {
+			return nil
+		}
+		reportTime := time.Unix(update.Payload.EpochTimestamp, 0)
+		l.display.show(fmt.Sprintf("%v - replaying %s", reportTime, config.Replay), monitorID, update)
+		if m.sinks.Write(update) == nil {
+			m.write()
+		}
+		return nil
+	})
+	for _, m := range statuses {
+		closeMonitor(m)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
 
+// sampler passes at most one update per sample period.
+type sampler struct {
+	rate time.Duration
+	last time.Time
+}
+
+func (s *sampler) take(update *sense.RealtimeUpdate) bool {
+	t := time.Unix(update.Payload.EpochTimestamp, 0)
+	if !s.last.IsZero() && t.Sub(s.last) < s.rate {
+		return false
+	}
+	s.last = t
+	return true
+}
+
+// display shows the latest update from every monitor: by redrawing the
+// terminal, by logging a line per update, or not at all.
+type display struct {
+	mode    string
+	mu      sync.Mutex
+	updates map[int]*sense.RealtimeUpdate
+}
+
+func (d *display) show(header string, monitorID int, update *sense.RealtimeUpdate) {
+	switch d.mode {
+	case displayNone:
+		return
+	case displayLog:
+		slog.Info("Update", "monitor", monitorID, "time", time.Unix(update.Payload.EpochTimestamp, 0),
+			"watts", update.Payload.TotalWatts, "devices", len(update.Payload.Devices))
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.updates[monitorID] = update
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("%s\n\n", header)
+	ids := make([]int, 0, len(d.updates))
+	for id := range d.updates {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if len(ids) > 1 {
+			fmt.Printf("Monitor %d\n\n", id)
+		}
+		fmt.Println(d.updates[id])
 	}
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/energy"
+	"github.com/adamroach/sense-logger/gaps"
+	"github.com/adamroach/sense-logger/rrd"
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+	"github.com/adamroach/sense-logger/timeline"
+)
+
+const testTimeout = 5 * time.Second
+
+// testLogger returns a logger for server that writes to a new output
+// directory with the rrd, timeline and sqlite sinks.
+func testLogger(t *testing.T, server *sensetest.Server) *logger {
+	t.Helper()
+	config := defaultConfig()
+	config.Username = sensetest.DefaultEmail
+	config.Password = sensetest.DefaultPassword
+	config.ApiURL = server.URL()
+	config.WebsocketURL = server.WebsocketURL()
+	config.TokenFile = ""
+	config.OutputDir = t.TempDir()
+	config.Display = displayNone
+	config.ReplaySpeed = 0
+	config.Sinks.Timeline.Enabled = true
+	config.Sinks.SQLite.Enabled = true
+	config.Sinks.SQLite.Path = filepath.Join(config.OutputDir, "sense.db")
+	return &logger{
+		config:  config,
+		display: &display{mode: config.Display, updates: map[int]*sense.RealtimeUpdate{}},
+		status:  newStatus(config.StaleAfter),
+	}
+}
+
+// start runs l until the test ends or the returned function is called,
+// which waits for it to finish.
+func start(t *testing.T, l *logger, run func(*logger, context.Context) error) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(l, ctx) }()
+	stopped := false
+	stop := func() {
+		t.Helper()
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("logger returned %v", err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for the logger to stop")
+		}
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// waitFor polls the status report of l's only monitor until ok accepts it.
+func waitFor(t *testing.T, l *logger, what string, ok func(monitorReport) bool) monitorReport {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		if report := l.status.report(); len(report.Monitors) == 1 && ok(report.Monitors[0]) {
+			return report.Monitors[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sendFrames sends a second's worth of readings per frame, with the fridge
+// drawing 100 W, followed by one frame without any devices. As in the real
+// feed, the devices in the frames carry their names.
+func sendFrames(t *testing.T, server *sensetest.Server, frames int) {
+	t.Helper()
+	first := time.Now().Add(-time.Duration(frames) * time.Second)
+	for i := range frames {
+		watts := 100.0
+		fridge := sense.Device{ID: "d1a2b3c4", Name: "Fridge", Watts: &watts}
+		if err := server.Send(sensetest.RealtimeUpdate(first.Add(time.Duration(i)*time.Second), i+1, fridge)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Send(sensetest.RealtimeUpdate(time.Now(), frames+1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkOutput checks the files a run with the fridge on leaves in directory.
+func checkOutput(t *testing.T, directory string) {
+	t.Helper()
+	for _, name := range []string{
+		rrd.FilePath(directory, ""),
+		rrd.FilePath(directory, "d1a2b3c4"),
+		filepath.Join(directory, rrd.ActiveFile),
+		filepath.Join(directory, energy.File),
+		filepath.Join(directory, gaps.StateFile),
+		filepath.Join(directory, timeline.File),
+	} {
+		if _, err := os.Stat(name); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	l := testLogger(t, server)
+
+	connected := server.Connected()
+	stop := start(t, l, (*logger).run)
+	select {
+	case <-connected:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the realtime feed to connect")
+	}
+	sendFrames(t, server, 5)
+	report := waitFor(t, l, "6 frames", func(m monitorReport) bool { return m.FramesReceived == 6 })
+	stop()
+
+	// The frame without devices is counted, but isn't written to the sinks.
+	if report.FramesWritten != 5 {
+		t.Errorf("got %d frames written, want 5", report.FramesWritten)
+	}
+	if report.FramesMissed != 0 {
+		t.Errorf("got %d frames missed, want 0", report.FramesMissed)
+	}
+	if report.EnergyKWh[energy.DeviceMeter("d1a2b3c4")] <= 0 {
+		t.Errorf("got energy totals %v, want some used by the fridge", report.EnergyKWh)
+	}
+	checkOutput(t, l.config.OutputDir)
+	data, err := os.ReadFile(filepath.Join(l.config.OutputDir, rrd.DeviceFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{}
+	if err := json.Unmarshal(data, &names); err != nil {
+		t.Fatal(err)
+	}
+	if names["d1a2b3c4"] != "Fridge" {
+		t.Errorf("got device names %v, want d1a2b3c4 named Fridge", names)
+	}
+	if _, err := os.Stat(l.config.Sinks.SQLite.Path); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+
+	// Record an archive to replay.
+	recording := testLogger(t, server)
+	recording.config.ArchiveDir = filepath.Join(recording.config.OutputDir, "archive")
+	connected := server.Connected()
+	stop := start(t, recording, (*logger).run)
+	select {
+	case <-connected:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the realtime feed to connect")
+	}
+	sendFrames(t, server, 5)
+	waitFor(t, recording, "6 frames", func(m monitorReport) bool { return m.FramesReceived == 6 })
+	stop()
+
+	l := testLogger(t, server)
+	l.config.Replay = recording.config.ArchiveDir
+	if err := l.replay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	report := l.status.report()
+	if len(report.Monitors) != 1 {
+		t.Fatalf("got %d monitors replayed, want 1", len(report.Monitors))
+	}
+	if m := report.Monitors[0]; m.FramesReceived != 6 || m.FramesWritten != 5 {
+		t.Errorf("got %d frames received and %d written, want 6 and 5", m.FramesReceived, m.FramesWritten)
+	}
+	// The archive holds a single monitor, so it replays straight into the
+	// output directory, as it was logged.
+	checkOutput(t, l.config.OutputDir)
+	// The device list the live run loaded was archived, so even the dryer,
+	// which never turned on, is named.
+	data, err := os.ReadFile(filepath.Join(l.config.OutputDir, rrd.DeviceFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{}
+	if err := json.Unmarshal(data, &names); err != nil {
+		t.Fatal(err)
+	}
+	if names["e5f6a7b8"] != "Dryer" {
+		t.Errorf("got device names %v after replaying, want e5f6a7b8 named Dryer", names)
+	}
+}
+
+func TestNewSinksClosesSinksOnError(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	l := testLogger(t, server)
+	l.config.Sinks.RRD.Enabled = false
+	l.config.Sinks.SQLite.Enabled = false
+	l.config.Sinks.InfluxDB.Enabled = true
+	l.config.Sinks.InfluxDB.URL = server.URL()
+	// The timeline can't make its directory where a file is.
+	l.config.OutputDir = filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(l.config.OutputDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	if _, err := l.newSinks(sense.MonitorInfo{ID: 1}, true, false); err == nil {
+		t.Fatal("got no error making the timeline in a file")
+	}
+	// The InfluxDB writer added before the timeline failed is closed, with
+	// its goroutines and the fanout's.
+	deadline := time.Now().Add(testTimeout)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d goroutines, want no more than the %d before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamroach/sense-logger/demand"
+	"github.com/adamroach/sense-logger/energy"
+	"github.com/adamroach/sense-logger/gaps"
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sink"
+)
+
+// status tracks how every monitor being logged is doing, for the status
+// endpoint, the liveness check and the systemd watchdog.
+type status struct {
+	started    time.Time
+	staleAfter time.Duration
+
+	mu       sync.Mutex
+	monitors []*monitorStatus
+}
+
+func newStatus(staleAfter time.Duration) *status {
+	return &status{started: time.Now(), staleAfter: staleAfter}
+}
+
+// monitorStatus tracks one monitor. Its client and stream are nil when
+// replaying an archive, and its detector, integrator and demand tracker are
+// nil if there is no output directory to keep their files in.
+type monitorStatus struct {
+	id         int
+	client     *sense.Client
+	sinks      *sink.Fanout
+	detector   *gaps.Detector
+	integrator *energy.Integrator
+	demand     *demand.Tracker
+
+	mu         sync.Mutex
+	stream     *sense.Stream
+	lastUpdate time.Time // when the latest update arrived
+	lastEpoch  int64
+	received   uint64
+	written    uint64
+}
+
+func (s *status) add(m *monitorStatus) {
+	s.mu.Lock()
+	s.monitors = append(s.monitors, m)
+	s.mu.Unlock()
+}
+
+func (m *monitorStatus) setStream(stream *sense.Stream) {
+	m.mu.Lock()
+	m.stream = stream
+	m.mu.Unlock()
+}
+
+// receive counts an update from the realtime feed, checks it for gaps, and
+// adds up the energy used and the demand.
+func (m *monitorStatus) receive(update *sense.RealtimeUpdate) {
+	if m.detector != nil {
+		m.detector.Observe(update)
+	}
+	if m.integrator != nil {
+		m.integrator.Observe(update)
+	}
+	if m.demand != nil {
+		m.demand.Observe(update)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastEpoch = update.Payload.EpochTimestamp
+	m.lastUpdate = time.Now()
+	m.received++
+}
+
+// write counts an update handed to every sink.
+func (m *monitorStatus) write() {
+	m.mu.Lock()
+	m.written++
+	m.mu.Unlock()
+}
+
+// problem returns why the monitor is unhealthy, or "" if it isn't: its feed
+// has stopped, or nothing has arrived from it for too long.
+func (s *status) problem(m *monitorStatus, now time.Time) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stream != nil {
+		if state, err := m.stream.State(); state == sense.StreamStopped {
+			if err != nil {
+				return fmt.Sprintf("feed stopped: %v", err)
+			}
+			return "feed stopped"
+		}
+	}
+	last := m.lastUpdate
+	if last.IsZero() {
+		last = s.started
+	}
+	if since := now.Sub(last); since > s.staleAfter {
+		return fmt.Sprintf("no updates for %v", since.Round(time.Second))
+	}
+	return ""
+}
+
+// problems returns why each unhealthy monitor is unhealthy.
+func (s *status) problems() []string {
+	now := time.Now()
+	s.mu.Lock()
+	monitors := s.monitors
+	s.mu.Unlock()
+	var problems []string
+	for _, m := range monitors {
+		if problem := s.problem(m, now); problem != "" {
+			problems = append(problems, fmt.Sprintf("monitor %d: %s", m.id, problem))
+		}
+	}
+	return problems
+}
+
+type statusReport struct {
+	Healthy  bool            `json:"healthy"`
+	Problems []string        `json:"problems,omitempty"`
+	Started  time.Time       `json:"started"`
+	Monitors []monitorReport `json:"monitors"`
+}
+
+type monitorReport struct {
+	ID              int                      `json:"id"`
+	State           string                   `json:"state"`
+	Error           string                   `json:"error,omitempty"`
+	LastUpdate      *time.Time               `json:"last_update,omitempty"`
+	LastUpdateEpoch int64                    `json:"last_update_epoch,omitempty"`
+	FramesReceived  uint64                   `json:"frames_received"`
+	FramesWritten   uint64                   `json:"frames_written"`
+	Gaps            map[gaps.Cause]uint64    `json:"gaps"`
+	FramesMissed    uint64                   `json:"frames_missed"`
+	EnergyKWh       map[energy.Meter]float64 `json:"energy_kwh,omitempty"`
+	Demand          *demand.Status           `json:"demand,omitempty"`
+	TokenExpiry     *time.Time               `json:"token_expiry,omitempty"`
+	Sinks           []sinkReport             `json:"sinks"`
+}
+
+type sinkReport struct {
+	Name    string `json:"name"`
+	Written uint64 `json:"written"`
+	Errors  uint64 `json:"errors"`
+	Dropped uint64 `json:"dropped"`
+}
+
+func (s *status) report() *statusReport {
+	s.mu.Lock()
+	monitors := s.monitors
+	s.mu.Unlock()
+	report := &statusReport{Started: s.started, Monitors: []monitorReport{}}
+	report.Problems = s.problems()
+	report.Healthy = len(report.Problems) == 0
+	for _, m := range monitors {
+		report.Monitors = append(report.Monitors, m.report())
+	}
+	return report
+}
+
+func (m *monitorStatus) report() monitorReport {
+	m.mu.Lock()
+	report := monitorReport{
+		ID:              m.id,
+		State:           "replaying",
+		LastUpdateEpoch: m.lastEpoch,
+		FramesReceived:  m.received,
+		FramesWritten:   m.written,
+		Gaps:            map[gaps.Cause]uint64{},
+		Sinks:           []sinkReport{},
+	}
+	if !m.lastUpdate.IsZero() {
+		lastUpdate := m.lastUpdate
+		report.LastUpdate = &lastUpdate
+	}
+	stream := m.stream
+	m.mu.Unlock()
+
+	if m.detector != nil {
+		stats := m.detector.Stats()
+		report.Gaps = stats.Gaps
+		report.FramesMissed = stats.FramesMissed
+	}
+	if m.integrator != nil {
+		report.EnergyKWh = m.integrator.Totals()
+	}
+	if m.demand != nil {
+		status := m.demand.Status()
+		report.Demand = &status
+	}
+	if m.client != nil {
+		report.State = sense.StreamConnecting.String()
+		if expiry := m.client.TokenExpiry(); !expiry.IsZero() {
+			report.TokenExpiry = &expiry
+		}
+	}
+	if stream != nil {
+		state, err := stream.State()
+		report.State = state.String()
+		if err != nil {
+			report.Error = err.Error()
+		}
+	}
+	for _, stats := range m.sinks.Stats() {
+		report.Sinks = append(report.Sinks, sinkReport(stats))
+	}
+	return report
+}
+
+// handleStatus serves the status of every monitor as JSON.
+func (s *status) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(s.report())
+}
+
+// handleHealth is the liveness check: it fails if any monitor's feed has
+// stopped or gone stale.
+func (s *status) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if problems := s.problems(); len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
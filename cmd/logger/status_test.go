@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+	"github.com/adamroach/sense-logger/sink"
+)
+
+func serve(handler http.HandlerFunc) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w
+}
+
+func TestHandleHealth(t *testing.T) {
+	s := newStatus(time.Minute)
+	m := &monitorStatus{id: 1, sinks: sink.NewFanout(sink.FanoutOptions{})}
+	defer m.sinks.Close()
+	s.add(m)
+
+	// A monitor that hasn't sent anything yet gets staleAfter from startup.
+	if w := serve(s.handleHealth); w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("got %d %q just after starting, want 200 ok", w.Code, w.Body)
+	}
+	s.started = time.Now().Add(-2 * time.Minute)
+	if w := serve(s.handleHealth); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "monitor 1: no updates for 2m0s") {
+		t.Errorf("got %d %q with nothing since startup, want 503 and the problem", w.Code, w.Body)
+	}
+
+	m.receive(sensetest.RealtimeUpdate(time.Now(), 1))
+	if w := serve(s.handleHealth); w.Code != http.StatusOK {
+		t.Errorf("got %d %q after an update, want 200", w.Code, w.Body)
+	}
+	m.lastUpdate = time.Now().Add(-90 * time.Second)
+	w := serve(s.handleHealth)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "no updates for 1m30s") {
+		t.Errorf("got %d %q with stale data, want 503 and the problem", w.Code, w.Body)
+	}
+
+	var report statusReport
+	if err := json.Unmarshal(serve(s.handleStatus).Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Healthy || len(report.Problems) != 1 || len(report.Monitors) != 1 || report.Monitors[0].FramesReceived != 1 {
+		t.Errorf("got status %+v, want one unhealthy monitor with one frame received", report)
+	}
+	if report.Monitors[0].State != "replaying" {
+		t.Errorf("got state %q for a monitor without a client, want replaying", report.Monitors[0].State)
+	}
+}
+
+func TestHandleHealthStoppedFeed(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := sense.NewClient(server.ClientOptions()...)
+	if err := client.Login(sensetest.DefaultEmail, sensetest.DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newStatus(time.Hour)
+	m := &monitorStatus{id: 1, client: client, sinks: sink.NewFanout(sink.FanoutOptions{})}
+	defer m.sinks.Close()
+	s.add(m)
+	stream := client.NewStream(sense.StreamConfig{})
+	m.setStream(stream)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stream.Run(ctx)
+
+	w := serve(s.handleHealth)
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "monitor 1: feed stopped\n" {
+		t.Errorf("got %d %q after the feed stopped, want 503 and feed stopped", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,62 @@
+package demand
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/adamroach/sense-logger/internal/atomicfile"
+)
+
+// File is the name of the file in a monitor's directory that holds its
+// monthly peaks.
+const File = "demand.json"
+
+// ReadPeaks returns the monthly peaks recorded in directory, oldest first.
+func ReadPeaks(directory string) ([]Peak, error) {
+	peaks, err := readPeaks(directory)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Peak, 0, len(peaks))
+	for _, peak := range peaks {
+		list = append(list, peak)
+	}
+	slices.SortFunc(list, func(a, b Peak) int {
+		return strings.Compare(a.Month, b.Month)
+	})
+	return list, nil
+}
+
+// readPeaks returns the monthly peaks recorded in directory, by month.
+func readPeaks(directory string) (map[string]Peak, error) {
+	peaks := map[string]Peak{}
+	data, err := os.ReadFile(filepath.Join(directory, File))
+	if os.IsNotExist(err) {
+		return peaks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v: %w", File, err)
+	}
+	if err := json.Unmarshal(data, &peaks); err != nil {
+		return nil, fmt.Errorf("error decoding JSON file %v: %w", File, err)
+	}
+	return peaks, nil
+}
+
+// save writes the monthly peaks.
+func (t *Tracker) save() error {
+	t.saved = time.Now()
+	if !t.dirty {
+		return nil
+	}
+	if err := atomicfile.WriteJSON(filepath.Join(t.directory, File), 0644, t.peaks); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
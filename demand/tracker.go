@@ -0,0 +1,279 @@
+// Package demand tracks peak demand, the highest average power drawn over a
+// window of time (15 minutes, typically), which some utilities charge for by
+// the month. It keeps each month's peak, with the devices that were on at
+// the time, and warns when the current window looks set to beat it.
+package demand
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+// Source is the reading demand is measured on.
+type Source string
+
+const (
+	// Grid is the power drawn from the grid; power sent to it counts as
+	// none.
+	Grid Source = "grid"
+	// Total is the power the house uses, wherever it comes from.
+	Total Source = "total"
+)
+
+type Options struct {
+	// Window is the length of time demand is averaged over. It defaults to
+	// 15 minutes.
+	Window time.Duration
+	// Source is the reading demand is measured on. It defaults to Grid.
+	Source Source
+	// Lead is how far ahead alerts look: OnAlert is called when the window
+	// would beat the month's peak if the power stayed as it is for Lead. It
+	// defaults to a third of Window.
+	Lead time.Duration
+	// MaxInterval is the longest time between two readings that the window
+	// continues across; after a longer gap it starts again. It defaults to
+	// 30 seconds.
+	MaxInterval time.Duration
+	// Location is the time zone months follow. It defaults to time.Local.
+	Location *time.Location
+	// OnPeak, if set, is called with every new monthly peak, once demand
+	// has stopped rising past it.
+	OnPeak func(Peak)
+	// OnAlert, if set, is called when demand is on course to set a new
+	// monthly peak. It is called at most once a window.
+	OnAlert func(Alert)
+}
+
+// Peak is the highest demand in a month, at the end of the window it was
+// averaged over, with the devices that were on then, biggest first.
+type Peak struct {
+	Month   string        `json:"month"` // such as "2025-07"
+	Time    time.Time     `json:"time"`
+	Watts   float64       `json:"watts"`
+	Window  time.Duration `json:"window_ns"`
+	Source  Source        `json:"source"`
+	Devices []Device      `json:"devices,omitempty"`
+}
+
+// Device is a device that was on when a peak was set.
+type Device struct {
+	ID    string  `json:"id"`
+	Name  string  `json:"name"`
+	Watts float64 `json:"watts"`
+}
+
+// Alert is a warning that demand is on course to set a new monthly peak.
+type Alert struct {
+	Time      time.Time
+	Watts     float64 // the demand over the window so far
+	Projected float64 // the demand if the power stays as it is for Options.Lead
+	Peak      Peak    // the month's peak so far
+}
+
+// Status is the current demand.
+type Status struct {
+	// Watts and Projected are 0 until readings span a whole window.
+	Watts     float64 `json:"watts"`
+	Projected float64 `json:"projected_watts"`
+	Peak      *Peak   `json:"month_peak,omitempty"`
+}
+
+// reading is a power reading, taken to hold from start until end.
+type reading struct {
+	start, end time.Time
+	watts      float64
+}
+
+// Tracker follows the demand in one monitor's realtime updates, as they
+// arrive and before any sampling, and keeps its monthly peaks in a file in
+// its directory. The file is saved at least once a minute while a new peak
+// is being set, and on Close.
+type Tracker struct {
+	directory string
+	options   Options
+
+	mu       sync.Mutex
+	readings []reading      // oldest first, covering at most the window
+	last     time.Time      // epoch of the latest update
+	watts    float64        // the latest reading
+	devices  []sense.Device // the devices on at the latest reading
+	status   Status
+	peaks    map[string]Peak
+	rising   bool // demand is above the month's peak, which is being set
+	alerted  time.Time
+	dirty    bool
+	saved    time.Time
+}
+
+// NewTracker returns a Tracker that keeps its monthly peaks in directory,
+// which is created if it does not already exist.
+func NewTracker(directory string, options Options) (*Tracker, error) {
+	if options.Window == 0 {
+		options.Window = 15 * time.Minute
+	}
+	if options.Source == "" {
+		options.Source = Grid
+	}
+	if options.Lead == 0 {
+		options.Lead = options.Window / 3
+	}
+	if options.MaxInterval == 0 {
+		options.MaxInterval = 30 * time.Second
+	}
+	if options.Location == nil {
+		options.Location = time.Local
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory %v: %w", directory, err)
+	}
+	peaks, err := readPeaks(directory)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracker{directory: directory, options: options, peaks: peaks, saved: time.Now()}, nil
+}
+
+// Observe takes the next realtime update.
+func (t *Tracker) Observe(update *sense.RealtimeUpdate) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Unix(update.Payload.EpochTimestamp, 0)
+	if !now.After(t.last) {
+		return
+	}
+	watts := update.Payload.TotalWatts
+	if t.options.Source == Grid {
+		watts = max(float64(update.Payload.GridWatts), 0)
+	}
+	if t.last.IsZero() || now.Sub(t.last) > t.options.MaxInterval {
+		t.readings = t.readings[:0]
+	} else {
+		t.readings = append(t.readings, reading{start: t.last, end: now, watts: t.watts})
+	}
+	// Each reading holds until the next, so the window up to now ends with
+	// the power and devices of the update before this one.
+	devices := t.devices
+	t.last, t.watts, t.devices = now, watts, update.Payload.Devices
+
+	windowStart := now.Add(-t.options.Window)
+	for len(t.readings) > 0 && !t.readings[0].end.After(windowStart) {
+		t.readings = t.readings[1:]
+	}
+	t.status.Watts, t.status.Projected = 0, 0
+	if len(t.readings) == 0 || t.readings[0].start.After(windowStart) {
+		// The readings don't span a whole window yet.
+		t.status.Peak = t.peak(now)
+		t.saveIfDue()
+		return
+	}
+	t.status.Watts = t.average(windowStart, now, 0)
+	// If the power stays as it is, the oldest part of the window will
+	// be replaced by readings like this one.
+	t.status.Projected = t.average(windowStart.Add(t.options.Lead), now, watts)
+
+	peak := t.peak(now)
+	switch {
+	case peak == nil || t.status.Watts > peak.Watts:
+		t.setPeak(now, devices)
+	case t.rising:
+		// Demand has dropped back below the peak it set.
+		t.rising = false
+		if t.options.OnPeak != nil {
+			t.options.OnPeak(*peak)
+		}
+	case t.status.Projected > peak.Watts && now.Sub(t.alerted) >= t.options.Window:
+		t.alerted = now
+		if t.options.OnAlert != nil {
+			t.options.OnAlert(Alert{Time: now, Watts: t.status.Watts, Projected: t.status.Projected, Peak: *peak})
+		}
+	}
+	t.status.Peak = t.peak(now)
+	t.saveIfDue()
+}
+
+// average returns the average power over the window that starts at start,
+// from the readings until now and taking the power after now to be extra
+// watts.
+func (t *Tracker) average(start, now time.Time, extra float64) float64 {
+	var energy float64 // watt-seconds
+	for _, r := range t.readings {
+		from := r.start
+		if from.Before(start) {
+			from = start
+		}
+		if r.end.After(from) {
+			energy += r.watts * r.end.Sub(from).Seconds()
+		}
+	}
+	if future := t.options.Window - now.Sub(start); future > 0 {
+		energy += extra * future.Seconds()
+	}
+	return energy / t.options.Window.Seconds()
+}
+
+// month returns the month that at falls in, such as "2025-07".
+func (t *Tracker) month(at time.Time) string {
+	return at.In(t.options.Location).Format("2006-01")
+}
+
+// peak returns a copy of the peak for the month now falls in, or nil.
+func (t *Tracker) peak(now time.Time) *Peak {
+	peak, ok := t.peaks[t.month(now)]
+	if !ok {
+		return nil
+	}
+	return &peak
+}
+
+// setPeak records the current demand as the month's peak.
+func (t *Tracker) setPeak(now time.Time, on []sense.Device) {
+	var devices []Device
+	for _, device := range on {
+		if device.Watts != nil && *device.Watts > 0 {
+			devices = append(devices, Device{ID: device.ID, Name: device.Name, Watts: *device.Watts})
+		}
+	}
+	slices.SortFunc(devices, func(a, b Device) int {
+		return cmp.Compare(b.Watts, a.Watts)
+	})
+	month := t.month(now)
+	t.peaks[month] = Peak{
+		Month:   month,
+		Time:    now,
+		Watts:   t.status.Watts,
+		Window:  t.options.Window,
+		Source:  t.options.Source,
+		Devices: devices,
+	}
+	t.rising = true
+	t.dirty = true
+}
+
+// Status returns the current demand.
+func (t *Tracker) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// Close saves the monthly peaks.
+func (t *Tracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.save()
+}
+
+func (t *Tracker) saveIfDue() {
+	if t.dirty && time.Since(t.saved) >= time.Minute {
+		if err := t.save(); err != nil {
+			log.Printf("Error saving peak demand: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package demand_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/demand"
+	"github.com/adamroach/sense-logger/sense"
+)
+
+var start = time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+
+// step is a reading of watts every second from one time to another, in
+// seconds after the test's start.
+type step struct {
+	from, to int
+	watts    float64
+}
+
+func update(at time.Time, watts float64) *sense.RealtimeUpdate {
+	return &sense.RealtimeUpdate{Payload: sense.RealtimeUpdatePayload{
+		EpochTimestamp: at.Unix(),
+		TotalWatts:     watts,
+		GridWatts:      int(watts),
+	}}
+}
+
+func TestTracker(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		start   time.Time // start, if not set
+		options demand.Options
+		steps   []step
+		// The status after the last step, with the month's peak in watts.
+		watts, projected, peak float64
+		// The peaks and alerts reported, in order, as "peak month watts@seconds"
+		// or "alert watts/projected over peak@seconds".
+		events []string
+		months []string // the months with peaks saved
+	}{{
+		name:   "not a whole window",
+		steps:  []step{{0, 59, 1000}},
+		months: []string{},
+	}, {
+		// The reading from 61s to 62s is the first at 4000 W; the
+		// projection takes the power to stay at 4000 W for the last 20s of
+		// the window.
+		name:      "rolling average",
+		steps:     []step{{0, 60, 1000}, {61, 62, 4000}},
+		watts:     (59*1000 + 4000) / 60.0,
+		projected: (39*1000 + 4000 + 20*4000) / 60.0,
+		peak:      (59*1000 + 4000) / 60.0,
+		events:    []string{"peak 2024-03 1000@60"},
+		months:    []string{"2024-03"},
+	}, {
+		name:      "longer lead",
+		options:   demand.Options{Lead: 30 * time.Second},
+		steps:     []step{{0, 60, 1000}, {61, 62, 4000}},
+		watts:     (59*1000 + 4000) / 60.0,
+		projected: (29*1000 + 4000 + 30*4000) / 60.0,
+		peak:      (59*1000 + 4000) / 60.0,
+		events:    []string{"peak 2024-03 1000@60"},
+		months:    []string{"2024-03"},
+	}, {
+		// After a gap the window starts again, and the peak set before it
+		// isn't reported until demand falls below it.
+		name:   "gap",
+		steps:  []step{{0, 60, 1000}, {70, 100, 1000}},
+		peak:   1000,
+		months: []string{"2024-03"},
+	}, {
+		// A peak is reported once demand stops rising past it. Demand
+		// on course to beat it raises one alert a window, then sets a new
+		// peak 20s after the power rose.
+		name:      "peaks and alerts",
+		steps:     []step{{0, 60, 1000}, {61, 120, 500}, {121, 185, 2000}},
+		watts:     2000,
+		projected: 2000,
+		peak:      2000,
+		events: []string{
+			"peak 2024-03 1000@60",
+			fmt.Sprintf("alert %.0f/%.0f over 1000@122", (59*500+2000)/60.0, (39*500+2000+20*2000)/60.0),
+			"peak 2024-03 2000@181",
+		},
+		months: []string{"2024-03"},
+	}, {
+		// A new month starts without a peak, so the first whole window in
+		// it sets one.
+		name:      "month rollover",
+		start:     time.Date(2024, 3, 31, 23, 58, 0, 0, time.UTC),
+		steps:     []step{{0, 150, 1000}},
+		watts:     1000,
+		projected: 1000,
+		peak:      1000,
+		events:    []string{"peak 2024-03 1000@60", "peak 2024-04 1000@120"},
+		months:    []string{"2024-03", "2024-04"},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			begin := test.start
+			if begin.IsZero() {
+				begin = start
+			}
+			seconds := func(t time.Time) int {
+				return int(t.Sub(begin).Seconds())
+			}
+			var events []string
+			options := test.options
+			options.Window = time.Minute
+			options.MaxInterval = 5 * time.Second
+			options.Location = time.UTC
+			options.OnPeak = func(peak demand.Peak) {
+				events = append(events, fmt.Sprintf("peak %s %.0f@%d", peak.Month, peak.Watts, seconds(peak.Time)))
+			}
+			options.OnAlert = func(alert demand.Alert) {
+				events = append(events, fmt.Sprintf("alert %.0f/%.0f over %.0f@%d", alert.Watts, alert.Projected, alert.Peak.Watts, seconds(alert.Time)))
+			}
+			directory := t.TempDir()
+			tracker, err := demand.NewTracker(directory, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range test.steps {
+				for s := step.from; s <= step.to; s++ {
+					tracker.Observe(update(begin.Add(time.Duration(s)*time.Second), step.watts))
+				}
+			}
+
+			status := tracker.Status()
+			if math.Abs(status.Watts-test.watts) > 1e-9 || math.Abs(status.Projected-test.projected) > 1e-9 {
+				t.Errorf("got %v W projected to %v W, want %v W projected to %v W", status.Watts, status.Projected, test.watts, test.projected)
+			}
+			switch {
+			case test.peak == 0 && status.Peak != nil:
+				t.Errorf("got peak %+v, want none", status.Peak)
+			case test.peak != 0 && (status.Peak == nil || math.Abs(status.Peak.Watts-test.peak) > 1e-9):
+				t.Errorf("got peak %+v, want %v W", status.Peak, test.peak)
+			}
+			if fmt.Sprint(events) != fmt.Sprint(test.events) {
+				t.Errorf("got events %q, want %q", events, test.events)
+			}
+
+			if err := tracker.Close(); err != nil {
+				t.Fatal(err)
+			}
+			peaks, err := demand.ReadPeaks(directory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var months []string
+			for _, peak := range peaks {
+				months = append(months, peak.Month)
+			}
+			if fmt.Sprint(months) != fmt.Sprint(test.months) {
+				t.Errorf("got peaks saved for %q, want %q", months, test.months)
+			}
+		})
+	}
+}
+
+func TestGridExport(t *testing.T) {
+	tracker, err := demand.NewTracker(t.TempDir(), demand.Options{Window: time.Minute, Location: time.UTC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+	// Power sent to the grid counts as none drawn from it.
+	for s := 0; s <= 60; s++ {
+		update := update(start.Add(time.Duration(s)*time.Second), 300)
+		update.Payload.GridWatts = -500
+		tracker.Observe(update)
+	}
+	if status := tracker.Status(); status.Watts != 0 || status.Peak == nil || status.Peak.Watts != 0 {
+		t.Errorf("got status %+v, want no demand", status)
+	}
+}
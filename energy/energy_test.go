@@ -0,0 +1,186 @@
+package energy_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/energy"
+	"github.com/adamroach/sense-logger/sense"
+)
+
+// india is 5:30 ahead of UTC, so its hours start on the half hour UTC.
+var india = time.FixedZone("IST", 5*3600+1800)
+
+var start = time.Date(2024, 3, 1, 10, 0, 0, 0, india)
+
+func update(seconds float64, total float64, devices ...sense.Device) *sense.RealtimeUpdate {
+	return &sense.RealtimeUpdate{Payload: sense.RealtimeUpdatePayload{
+		EpochTimestamp: start.Add(time.Duration(seconds * float64(time.Second))).Unix(),
+		TotalWatts:     total,
+		GridWatts:      int(total),
+		Channels:       []float64{total / 2, total / 2},
+		Devices:        devices,
+	}}
+}
+
+func device(id string, watts float64) sense.Device {
+	return sense.Device{ID: id, Watts: &watts}
+}
+
+func newIntegrator(t *testing.T, directory string) *energy.Integrator {
+	t.Helper()
+	i, err := energy.NewIntegrator(directory, energy.Options{Location: india})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func checkKWh(t *testing.T, what string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("got %v kWh %s, want %v", got, what, want)
+	}
+}
+
+func TestTrapezoidIntegration(t *testing.T) {
+	i := newIntegrator(t, t.TempDir())
+	defer i.Close()
+	i.Observe(update(0, 1000, device("kettle", 2000)))
+	// The power is taken to change steadily between readings: 1500 W
+	// average for 2 seconds.
+	i.Observe(update(2, 2000))
+	// A reading no later than the last is ignored.
+	i.Observe(update(2, 9000))
+	i.Observe(update(1, 9000))
+	// Across a gap longer than MaxInterval nothing is counted.
+	i.Observe(update(60, 2000))
+	i.Observe(update(61, 2000))
+	totals := i.Totals()
+	checkKWh(t, "in total", totals[energy.Total], (1500*2+2000*1)/3600.0/1000)
+	checkKWh(t, "on leg 1", totals[energy.Leg1], (750*2+1000*1)/3600.0/1000)
+	checkKWh(t, "drawn from the grid", totals[energy.GridImport], totals[energy.Total])
+	// A device missing from one end of an interval read zero there.
+	checkKWh(t, "for the kettle", totals[energy.DeviceMeter("kettle")], 1000*2/3600.0/1000)
+}
+
+func TestGridExport(t *testing.T) {
+	i := newIntegrator(t, t.TempDir())
+	defer i.Close()
+	solar := update(0, 500)
+	solar.Payload.GridWatts = -1500
+	i.Observe(solar)
+	solar = update(1, 500)
+	solar.Payload.GridWatts = -1500
+	i.Observe(solar)
+	totals := i.Totals()
+	checkKWh(t, "sent to the grid", totals[energy.GridExport], 1500/3600.0/1000)
+	checkKWh(t, "drawn from the grid", totals[energy.GridImport], 0)
+}
+
+func TestHour(t *testing.T) {
+	for _, test := range []struct {
+		t, want time.Time
+	}{
+		{time.Date(2024, 3, 1, 10, 59, 59, 0, india), time.Date(2024, 3, 1, 10, 0, 0, 0, india)},
+		// 05:00 UTC is 10:30 in India, in the hour that started at 04:30
+		// UTC.
+		{time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 10, 0, 0, 0, india)},
+		{time.Date(2024, 3, 1, 0, 15, 0, 0, india), time.Date(2024, 3, 1, 0, 0, 0, 0, india)},
+	} {
+		if got := energy.Hour(test.t, india); !got.Equal(test.want) {
+			t.Errorf("got hour %v for %v, want %v", got, test.t, test.want)
+		}
+	}
+}
+
+func TestHourlyTotalsAndRestart(t *testing.T) {
+	directory := t.TempDir()
+	i := newIntegrator(t, directory)
+	// Two intervals either side of 11:00 in India, each 1 kW for 2 seconds.
+	i.Observe(update(3598, 1000))
+	i.Observe(update(3600, 1000))
+	i.Observe(update(3602, 1000))
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarted, readings the first run already counted are skipped, as
+	// when an archive is replayed into the same directory.
+	i = newIntegrator(t, directory)
+	checkKWh(t, "carried over", i.Totals()[energy.Total], 4/3600.0)
+	i.Observe(update(3598, 1000))
+	i.Observe(update(3600, 1000))
+	i.Observe(update(3602, 1000))
+	// The first new reading has nothing before it to count from.
+	i.Observe(update(3604, 1000))
+	i.Observe(update(3606, 1000))
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := energy.Open(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	counted, err := store.Counted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !counted.Equal(start.Add(3606 * time.Second)) {
+		t.Errorf("got readings counted up to %v, want %v", counted, start.Add(3606*time.Second))
+	}
+	hours, err := store.Hours(start, start.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hours) != 2 || !hours[0].Start.Equal(start) || !hours[1].Start.Equal(start.Add(time.Hour)) {
+		t.Fatalf("got hours %v, want 10:00 and 11:00 in India", hours)
+	}
+	checkKWh(t, "from 10:00", hours[0].Energy[energy.Total], 2/3600.0)
+	// The first run's interval after 11:00, and the second run's.
+	checkKWh(t, "from 11:00", hours[1].Energy[energy.Total], 4/3600.0)
+}
+
+func TestRollup(t *testing.T) {
+	bucket := func(t time.Time, kWh float64) energy.Bucket {
+		return energy.Bucket{Start: t, End: t.Add(time.Hour), Energy: map[energy.Meter]float64{energy.Total: kWh}}
+	}
+	hours := []energy.Bucket{
+		bucket(time.Date(2024, 1, 31, 22, 0, 0, 0, india), 1),
+		bucket(time.Date(2024, 1, 31, 23, 0, 0, 0, india), 2),
+		bucket(time.Date(2024, 2, 1, 0, 0, 0, 0, india), 4),
+		bucket(time.Date(2024, 2, 2, 13, 0, 0, 0, india), 8),
+	}
+	if got := energy.Rollup(hours, energy.Hourly, india); len(got) != 4 {
+		t.Errorf("got %d hourly buckets, want the 4 hours", len(got))
+	}
+
+	days := energy.Rollup(hours, energy.Daily, india)
+	if len(days) != 3 {
+		t.Fatalf("got %d days, want 3", len(days))
+	}
+	for n, want := range []struct {
+		start time.Time
+		kWh   float64
+	}{
+		{time.Date(2024, 1, 31, 0, 0, 0, 0, india), 3},
+		{time.Date(2024, 2, 1, 0, 0, 0, 0, india), 4},
+		{time.Date(2024, 2, 2, 0, 0, 0, 0, india), 8},
+	} {
+		if !days[n].Start.Equal(want.start) || !days[n].End.Equal(want.start.AddDate(0, 0, 1)) || days[n].Energy[energy.Total] != want.kWh {
+			t.Errorf("got day %v to %v with %v, want %v with %v kWh", days[n].Start, days[n].End, days[n].Energy, want.start, want.kWh)
+		}
+	}
+
+	months := energy.Rollup(hours, energy.Monthly, india)
+	if len(months) != 2 || months[0].Energy[energy.Total] != 3 || months[1].Energy[energy.Total] != 12 ||
+		!months[1].End.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, india)) {
+		t.Errorf("got months %v, want January with 3 kWh and February with 12", months)
+	}
+	if sum := energy.Sum(months); sum[energy.Total] != 15 {
+		t.Errorf("got %v kWh in all, want 15", sum[energy.Total])
+	}
+}
@@ -0,0 +1,208 @@
+// Package energy adds up the energy a monitor measures, from the power
+// readings in the realtime feed: for each device, each leg of the mains, and
+// the energy drawn from and sent to the grid. It keeps running totals that
+// survive restarts, and hourly totals that reports roll up by day or month.
+package energy
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamroach/sense-logger/gaps"
+	"github.com/adamroach/sense-logger/sense"
+)
+
+// Meter names something whose energy is measured.
+type Meter string
+
+const (
+	Total      Meter = "total" // everything the house uses
+	Leg1       Meter = "leg1"  // the first leg of the mains
+	Leg2       Meter = "leg2"  // the second leg of the mains
+	GridImport Meter = "grid_import"
+	GridExport Meter = "grid_export"
+)
+
+const devicePrefix = "device:"
+
+// DeviceMeter returns the meter for the device with the given ID.
+func DeviceMeter(id string) Meter {
+	return Meter(devicePrefix + id)
+}
+
+// Device returns the ID of the device m measures, if it measures one.
+func (m Meter) Device() (id string, ok bool) {
+	return strings.CutPrefix(string(m), devicePrefix)
+}
+
+type Options struct {
+	// MaxInterval is the longest time between two readings that energy is
+	// counted across, assuming the power changed steadily between them. The
+	// energy used during longer gaps is unknown, and isn't counted. It
+	// defaults to gaps.DefaultMaxInterval, so that the energy left out is
+	// the energy used during the gaps in the gap log.
+	MaxInterval time.Duration
+	// Location is the time zone the hourly totals follow. It defaults to
+	// time.Local.
+	Location *time.Location
+}
+
+// Integrator adds up the energy in one monitor's realtime updates, as they
+// arrive and before any sampling, and keeps the totals in the energy database
+// in its directory. Totals are written out at least once a minute, so after
+// a crash up to a minute of energy may be lost. Readings no later than the
+// last one counted are ignored, so replaying an archive into a directory
+// whose totals already cover it doesn't count it twice.
+type Integrator struct {
+	store   *Store
+	options Options
+
+	mu      sync.Mutex
+	last    time.Time                   // epoch of the latest update
+	power   map[Meter]float64           // the latest readings, or nil before the first
+	totals  map[Meter]float64           // kWh, including what hasn't been written out
+	pending map[int64]map[Meter]float64 // kWh not yet written out, by hour
+	saved   time.Time
+}
+
+// NewIntegrator returns an Integrator that keeps its totals in directory,
+// which is created if it does not already exist, and carries on from the
+// totals already there.
+func NewIntegrator(directory string, options Options) (*Integrator, error) {
+	if options.MaxInterval == 0 {
+		options.MaxInterval = gaps.DefaultMaxInterval
+	}
+	if options.Location == nil {
+		options.Location = time.Local
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory %v: %w", directory, err)
+	}
+	store, err := Open(directory)
+	if err != nil {
+		return nil, err
+	}
+	totals, err := store.Totals()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	last, err := store.Counted()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return &Integrator{
+		store:   store,
+		options: options,
+		last:    last,
+		totals:  totals,
+		pending: map[int64]map[Meter]float64{},
+		saved:   time.Now(),
+	}, nil
+}
+
+// Observe adds the energy used since the update before.
+func (i *Integrator) Observe(update *sense.RealtimeUpdate) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := time.Unix(update.Payload.EpochTimestamp, 0)
+	if !now.After(i.last) {
+		return
+	}
+	power := readings(&update.Payload)
+	if elapsed := now.Sub(i.last); i.power != nil && elapsed <= i.options.MaxInterval {
+		hours := elapsed.Hours()
+		hour := Hour(i.last, i.options.Location).Unix()
+		bucket := i.pending[hour]
+		if bucket == nil {
+			bucket = map[Meter]float64{}
+			i.pending[hour] = bucket
+		}
+		// A meter missing from one end of the interval read zero there.
+		for meter, watts := range i.power {
+			kWh := (watts + power[meter]) / 2 * hours / 1000
+			bucket[meter] += kWh
+			i.totals[meter] += kWh
+		}
+		for meter, watts := range power {
+			if _, ok := i.power[meter]; !ok {
+				kWh := watts / 2 * hours / 1000
+				bucket[meter] += kWh
+				i.totals[meter] += kWh
+			}
+		}
+	}
+	i.last = now
+	i.power = power
+	if time.Since(i.saved) >= time.Minute {
+		if err := i.save(); err != nil {
+			log.Printf("Error saving energy totals: %v\n", err)
+		}
+	}
+}
+
+// readings returns the power each meter reads in payload, in watts.
+func readings(payload *sense.RealtimeUpdatePayload) map[Meter]float64 {
+	power := make(map[Meter]float64, len(payload.Devices)+5)
+	power[Total] = payload.TotalWatts
+	if len(payload.Channels) == 2 {
+		power[Leg1] = payload.Channels[0]
+		power[Leg2] = payload.Channels[1]
+	}
+	// Power from the grid is positive, and power sent to it negative.
+	grid := float64(payload.GridWatts)
+	power[GridImport] = max(grid, 0)
+	power[GridExport] = max(-grid, 0)
+	for _, device := range payload.Devices {
+		if device.ID != "" && device.Watts != nil {
+			power[DeviceMeter(device.ID)] += *device.Watts
+		}
+	}
+	return power
+}
+
+// Totals returns the energy each meter has measured, in kWh, since the
+// energy database was created.
+func (i *Integrator) Totals() map[Meter]float64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return maps.Clone(i.totals)
+}
+
+// Close writes out the totals and closes the energy database.
+func (i *Integrator) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	err := i.save()
+	if closeErr := i.store.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (i *Integrator) save() error {
+	i.saved = time.Now()
+	if len(i.pending) == 0 {
+		return nil
+	}
+	if err := i.store.Add(i.pending, i.last); err != nil {
+		return err
+	}
+	i.pending = map[int64]map[Meter]float64{}
+	return nil
+}
+
+// Hour returns the start of the hour, in loc, that t falls in. Hours are
+// counted from the local midnight, so they line up with local days even in
+// time zones whose offset isn't a whole number of hours.
+func Hour(t time.Time, loc *time.Location) time.Time {
+	_, offset := t.In(loc).Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(time.Hour).Add(-shift).In(loc)
+}
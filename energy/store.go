@@ -0,0 +1,215 @@
+package energy
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/adamroach/sense-logger/internal/sqlitedsn"
+)
+
+// File is the name of the energy database in a monitor's directory.
+const File = "energy.db"
+
+// schema creates the tables, if they don't already exist. hourly holds the
+// energy each meter measured in each hour, keyed by the Unix time the hour
+// starts; totals holds the running totals; and counted holds the time of the
+// last reading counted.
+const schema = `
+PRAGMA journal_mode = WAL;
+
+CREATE TABLE IF NOT EXISTS hourly (
+	hour  INTEGER NOT NULL,
+	meter TEXT NOT NULL,
+	kwh   REAL NOT NULL,
+	PRIMARY KEY (hour, meter)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS totals (
+	meter TEXT NOT NULL PRIMARY KEY,
+	kwh   REAL NOT NULL
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS counted (
+	id   INTEGER PRIMARY KEY CHECK (id = 1),
+	time INTEGER NOT NULL
+);
+`
+
+// Period is how long the energy totals read back each cover.
+type Period string
+
+const (
+	Hourly  Period = "hour"
+	Daily   Period = "day"
+	Monthly Period = "month"
+)
+
+// Bucket is the energy each meter measured, in kWh, from Start until End.
+type Bucket struct {
+	Start  time.Time         `json:"start"`
+	End    time.Time         `json:"end"`
+	Energy map[Meter]float64 `json:"energy_kwh"`
+}
+
+// Store is the energy database of one monitor.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens (creating, if necessary) the energy database in directory.
+func Open(directory string) (*Store, error) {
+	path := filepath.Join(directory, File)
+	db, err := sql.Open("sqlite3", sqlitedsn.File(path))
+	if err != nil {
+		return nil, fmt.Errorf("error opening database %v: %w", path, err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables in %v: %w", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Add adds energy, in kWh by meter for each hour, to the hourly totals and
+// the running totals, and records that the readings up to last have been
+// counted.
+func (s *Store) Add(energy map[int64]map[Meter]float64, last time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	hourly, err := tx.Prepare(`
+		INSERT INTO hourly (hour, meter, kwh) VALUES (?, ?, ?)
+		ON CONFLICT (hour, meter) DO UPDATE SET kwh = kwh + excluded.kwh`)
+	if err != nil {
+		return err
+	}
+	defer hourly.Close()
+	totals, err := tx.Prepare(`
+		INSERT INTO totals (meter, kwh) VALUES (?, ?)
+		ON CONFLICT (meter) DO UPDATE SET kwh = kwh + excluded.kwh`)
+	if err != nil {
+		return err
+	}
+	defer totals.Close()
+	for hour, meters := range energy {
+		for meter, kWh := range meters {
+			if _, err := hourly.Exec(hour, string(meter), kWh); err != nil {
+				return fmt.Errorf("error storing energy: %w", err)
+			}
+			if _, err := totals.Exec(string(meter), kWh); err != nil {
+				return fmt.Errorf("error storing energy: %w", err)
+			}
+		}
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO counted (id, time) VALUES (1, ?)`, last.Unix())
+	if err != nil {
+		return fmt.Errorf("error storing energy: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Counted returns the time of the last reading counted, or the zero time if
+// there is none.
+func (s *Store) Counted() (time.Time, error) {
+	var last int64
+	err := s.db.QueryRow(`SELECT time FROM counted WHERE id = 1`).Scan(&last)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading energy: %w", err)
+	}
+	return time.Unix(last, 0), nil
+}
+
+// Totals returns the running totals, in kWh.
+func (s *Store) Totals() (map[Meter]float64, error) {
+	rows, err := s.db.Query(`SELECT meter, kwh FROM totals`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading energy totals: %w", err)
+	}
+	defer rows.Close()
+	totals := map[Meter]float64{}
+	for rows.Next() {
+		var meter string
+		var kWh float64
+		if err := rows.Scan(&meter, &kWh); err != nil {
+			return nil, fmt.Errorf("error reading energy totals: %w", err)
+		}
+		totals[Meter(meter)] = kWh
+	}
+	return totals, rows.Err()
+}
+
+// Hours returns the hourly totals for the hours that start between start and
+// end, oldest first. Hours with nothing measured are left out.
+func (s *Store) Hours(start, end time.Time) ([]Bucket, error) {
+	rows, err := s.db.Query(`
+		SELECT hour, meter, kwh FROM hourly WHERE hour >= ? AND hour < ? ORDER BY hour`,
+		start.Unix(), end.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("error reading energy: %w", err)
+	}
+	defer rows.Close()
+	var buckets []Bucket
+	for rows.Next() {
+		var hour int64
+		var meter string
+		var kWh float64
+		if err := rows.Scan(&hour, &meter, &kWh); err != nil {
+			return nil, fmt.Errorf("error reading energy: %w", err)
+		}
+		if len(buckets) == 0 || buckets[len(buckets)-1].Start.Unix() != hour {
+			t := time.Unix(hour, 0)
+			buckets = append(buckets, Bucket{Start: t, End: t.Add(time.Hour), Energy: map[Meter]float64{}})
+		}
+		buckets[len(buckets)-1].Energy[Meter(meter)] = kWh
+	}
+	return buckets, rows.Err()
+}
+
+// Rollup adds up hourly buckets, oldest first, into buckets covering period
+// in loc.
+func Rollup(hours []Bucket, period Period, loc *time.Location) []Bucket {
+	if period == Hourly {
+		return hours
+	}
+	var buckets []Bucket
+	for _, hour := range hours {
+		t := hour.Start.In(loc)
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		end := start.AddDate(0, 0, 1)
+		if period == Monthly {
+			start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+			end = start.AddDate(0, 1, 0)
+		}
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Start.Equal(start) {
+			buckets = append(buckets, Bucket{Start: start, End: end, Energy: map[Meter]float64{}})
+		}
+		for meter, kWh := range hour.Energy {
+			buckets[len(buckets)-1].Energy[meter] += kWh
+		}
+	}
+	return buckets
+}
+
+// Sum adds up the energy in buckets.
+func Sum(buckets []Bucket) map[Meter]float64 {
+	sum := map[Meter]float64{}
+	for _, bucket := range buckets {
+		for meter, kWh := range bucket.Energy {
+			sum[meter] += kWh
+		}
+	}
+	return sum
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,241 @@
+// Package gaps finds the stretches of time a monitor's readings are missing
+// for, and records them, so that reports can tell no usage from no data.
+package gaps
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/adamroach/sense-logger/internal/atomicfile"
+	"github.com/adamroach/sense-logger/sense"
+)
+
+const (
+	LogFile   = "gaps.jsonl"
+	StateFile = "gaps-state.json"
+)
+
+// Cause is why readings are missing.
+type Cause string
+
+const (
+	// MissedFrames means the realtime feed skipped frame numbers.
+	MissedFrames Cause = "missed_frames"
+	// Disconnected means the realtime feed was down.
+	Disconnected Cause = "disconnected"
+	// EpochJump means the feed stayed up, but its timestamps jumped
+	// forward.
+	EpochJump Cause = "epoch_jump"
+	// Stopped means the logger wasn't running.
+	Stopped Cause = "stopped"
+)
+
+// Gap is a stretch of time without readings, between the last reading before
+// it and the first after it.
+type Gap struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Cause  Cause     `json:"cause"`
+	Frames int       `json:"frames,omitempty"` // frames missed, for MissedFrames
+}
+
+// Duration returns the length of the gap.
+func (g Gap) Duration() time.Duration {
+	return g.End.Sub(g.Start)
+}
+
+// DefaultMaxInterval is the longest time between two readings that isn't a
+// gap; the feed normally sends two readings a second.
+const DefaultMaxInterval = 3 * time.Second
+
+type Options struct {
+	// MaxInterval is the longest time between two readings that isn't a
+	// gap. It defaults to DefaultMaxInterval.
+	MaxInterval time.Duration
+	// OnGap, if set, is called with every gap found.
+	OnGap func(Gap)
+}
+
+// Stats counts the gaps a Detector has found.
+type Stats struct {
+	Gaps         map[Cause]uint64
+	FramesMissed uint64
+}
+
+// Detector watches one monitor's realtime updates, as they arrive and before
+// any sampling, for gaps, and appends them to the gap log in its directory.
+// It also remembers the last reading it saw, so that the time the logger
+// spends stopped is recorded as a gap when it starts again; that reading is
+// saved at least once a minute, so after a crash the gap may start up to a
+// minute early.
+type Detector struct {
+	directory string
+	options   Options
+
+	mu           sync.Mutex
+	resumed      time.Time // epoch of the latest update before the Detector started
+	last         time.Time // epoch of the latest update
+	lastFrame    int
+	seen         bool // an update has arrived since the Detector started
+	disconnected bool // the feed has been down since the latest update
+	saved        time.Time
+	stats        Stats
+}
+
+type state struct {
+	Last time.Time `json:"last"`
+}
+
+// NewDetector returns a Detector that keeps its log and state in directory,
+// which is created if it does not already exist. A state file that can't be
+// decoded is logged and ignored, losing only the gap for the time the logger
+// was stopped.
+func NewDetector(directory string, options Options) (*Detector, error) {
+	if options.MaxInterval == 0 {
+		options.MaxInterval = DefaultMaxInterval
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory %v: %w", directory, err)
+	}
+	d := &Detector{
+		directory: directory,
+		options:   options,
+		stats:     Stats{Gaps: map[Cause]uint64{}},
+	}
+	data, err := os.ReadFile(filepath.Join(directory, StateFile))
+	if err == nil {
+		var s state
+		if err := json.Unmarshal(data, &s); err != nil {
+			log.Printf("Ignoring gap state: error decoding JSON file %v: %v\n", StateFile, err)
+		} else {
+			d.last = s.Last
+			d.resumed = s.Last
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading %v: %w", StateFile, err)
+	}
+	return d, nil
+}
+
+// Observe checks an update against the one before it.
+func (d *Detector) Observe(update *sense.RealtimeUpdate) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	epoch := time.Unix(update.Payload.EpochTimestamp, 0)
+	frame := update.Payload.FrameNumber
+
+	switch {
+	case !d.seen:
+		if !d.last.IsZero() && epoch.Sub(d.last) > d.options.MaxInterval {
+			d.record(Gap{Start: d.last, End: epoch, Cause: Stopped})
+		}
+	case d.disconnected:
+		if epoch.Sub(d.last) > d.options.MaxInterval {
+			d.record(Gap{Start: d.last, End: epoch, Cause: Disconnected})
+		}
+	case frame > d.lastFrame+1:
+		// Frame numbers count up through a connection, so a jump forward
+		// means frames went missing.
+		d.record(Gap{Start: d.last, End: epoch, Cause: MissedFrames, Frames: frame - d.lastFrame - 1})
+	case epoch.Sub(d.last) > d.options.MaxInterval:
+		d.record(Gap{Start: d.last, End: epoch, Cause: EpochJump})
+	}
+
+	// A clock that goes backwards would make later gaps nonsense, so the
+	// latest time only moves forward.
+	if epoch.After(d.last) {
+		d.last = epoch
+	}
+	d.lastFrame = frame
+	d.seen = true
+	d.disconnected = false
+	if time.Since(d.saved) >= time.Minute {
+		if err := d.save(); err != nil {
+			log.Printf("Error saving gap state: %v\n", err)
+		}
+	}
+}
+
+// Disconnect notes that the realtime feed has gone down, so that the time
+// until the next update is recorded as a Disconnected gap.
+func (d *Detector) Disconnect() {
+	d.mu.Lock()
+	if d.seen {
+		d.disconnected = true
+	}
+	d.mu.Unlock()
+}
+
+// Stats returns the gaps found since the Detector started.
+func (d *Detector) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := Stats{Gaps: make(map[Cause]uint64, len(d.stats.Gaps)), FramesMissed: d.stats.FramesMissed}
+	for cause, n := range d.stats.Gaps {
+		stats.Gaps[cause] = n
+	}
+	return stats
+}
+
+// Close saves the time of the latest update.
+func (d *Detector) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.save()
+}
+
+func (d *Detector) record(gap Gap) {
+	// A gap that ended before the latest update of an earlier run was found
+	// by that run, as when an archive is replayed into the same directory
+	// again, and is already in the log.
+	if !gap.End.After(d.resumed) {
+		return
+	}
+	d.stats.Gaps[gap.Cause]++
+	d.stats.FramesMissed += uint64(gap.Frames)
+	if err := appendGap(filepath.Join(d.directory, LogFile), gap); err != nil {
+		log.Printf("Error recording gap: %v\n", err)
+	}
+	if d.options.OnGap != nil {
+		d.options.OnGap(gap)
+	}
+}
+
+func appendGap(filePath string, gap Gap) error {
+	data, err := json.Marshal(gap)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening gap log %v: %w", filePath, err)
+	}
+	defer file.Close()
+	// A crash part way through a write can leave the last line unfinished;
+	// start a new one rather than add to it.
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			data = append([]byte{'\n'}, data...)
+		}
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing gap log %v: %w", filePath, err)
+	}
+	return file.Sync()
+}
+
+// save writes the state file, atomically so that it is never left
+// half-written.
+func (d *Detector) save() error {
+	if d.last.IsZero() {
+		return nil
+	}
+	d.saved = time.Now()
+	return atomicfile.WriteJSON(filepath.Join(d.directory, StateFile), 0644, state{Last: d.last})
+}
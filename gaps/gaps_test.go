@@ -0,0 +1,194 @@
+package gaps_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/gaps"
+	"github.com/adamroach/sense-logger/sense"
+)
+
+var start = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func update(seconds float64, frame int) *sense.RealtimeUpdate {
+	return &sense.RealtimeUpdate{Payload: sense.RealtimeUpdatePayload{
+		EpochTimestamp: start.Add(time.Duration(seconds * float64(time.Second))).Unix(),
+		FrameNumber:    frame,
+	}}
+}
+
+// newDetector returns a Detector for directory that collects the gaps it
+// finds.
+func newDetector(t *testing.T, directory string) (*gaps.Detector, *[]gaps.Gap) {
+	t.Helper()
+	var found []gaps.Gap
+	d, err := gaps.NewDetector(directory, gaps.Options{OnGap: func(gap gaps.Gap) { found = append(found, gap) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, &found
+}
+
+func at(seconds int) time.Time {
+	return start.Add(time.Duration(seconds) * time.Second)
+}
+
+func checkGaps(t *testing.T, got []gaps.Gap, want ...gaps.Gap) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got gaps %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i].Start.Equal(want[i].Start) || !got[i].End.Equal(want[i].End) || got[i].Cause != want[i].Cause || got[i].Frames != want[i].Frames {
+			t.Errorf("got gap %v, want %v", got[i], want[i])
+		}
+	}
+}
+
+func TestObserve(t *testing.T) {
+	directory := t.TempDir()
+	d, found := newDetector(t, directory)
+	d.Observe(update(0, 1))
+	d.Observe(update(1, 2))
+	// Frames 3 to 5 go missing.
+	d.Observe(update(3, 6))
+	// The feed stays up, but its clock jumps.
+	d.Observe(update(13, 7))
+	// The feed drops; a quick reconnect isn't a gap, a slow one is. Frame
+	// numbers start again on a new connection.
+	d.Disconnect()
+	d.Observe(update(14, 1))
+	d.Disconnect()
+	d.Observe(update(30, 1))
+	// A clock that goes backwards doesn't move the latest time back.
+	d.Observe(update(20, 2))
+	d.Observe(update(31, 3))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []gaps.Gap{
+		{Start: at(1), End: at(3), Cause: gaps.MissedFrames, Frames: 3},
+		{Start: at(3), End: at(13), Cause: gaps.EpochJump},
+		{Start: at(14), End: at(30), Cause: gaps.Disconnected},
+	}
+	checkGaps(t, *found, want...)
+	stats := d.Stats()
+	if stats.Gaps[gaps.MissedFrames] != 1 || stats.Gaps[gaps.EpochJump] != 1 || stats.Gaps[gaps.Disconnected] != 1 || stats.FramesMissed != 3 {
+		t.Errorf("got stats %v, want one gap of each kind and 3 frames missed", stats)
+	}
+	logged, err := gaps.Read(directory, at(0), at(60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGaps(t, logged, want...)
+
+	// The next run records the time it was stopped for.
+	d, found = newDetector(t, directory)
+	d.Observe(update(100, 1))
+	checkGaps(t, *found, gaps.Gap{Start: at(31), End: at(100), Cause: gaps.Stopped})
+	d.Close()
+}
+
+func TestReplayDoesNotRecordGapsAgain(t *testing.T) {
+	directory := t.TempDir()
+	observe := func() []gaps.Gap {
+		d, found := newDetector(t, directory)
+		d.Observe(update(0, 1))
+		d.Observe(update(1, 4))
+		d.Observe(update(2, 5))
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return *found
+	}
+	checkGaps(t, observe(), gaps.Gap{Start: at(0), End: at(1), Cause: gaps.MissedFrames, Frames: 2})
+	// Replaying the same updates into the same directory finds nothing new.
+	checkGaps(t, observe())
+	logged, err := gaps.Read(directory, at(0), at(60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logged) != 1 {
+		t.Errorf("got %d gaps logged, want 1", len(logged))
+	}
+}
+
+func TestCorruptState(t *testing.T) {
+	directory := t.TempDir()
+	if err := os.WriteFile(filepath.Join(directory, gaps.StateFile), []byte(`{"last": "2024-03`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, found := newDetector(t, directory)
+	d.Observe(update(0, 1))
+	d.Observe(update(1, 2))
+	if len(*found) != 0 {
+		t.Errorf("got gaps %v, want none without a usable state file", *found)
+	}
+	// The state file is good again once saved.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, found = newDetector(t, directory)
+	d.Observe(update(10, 1))
+	checkGaps(t, *found, gaps.Gap{Start: at(1), End: at(10), Cause: gaps.Stopped})
+}
+
+func TestRead(t *testing.T) {
+	directory := t.TempDir()
+	// Out of order, with a line left unfinished by a crash.
+	log := `{"start":"2024-03-01T12:00:30Z","end":"2024-03-01T12:00:40Z","cause":"disconnected"}
+{"start":"2024-03-01T12:00:10Z","end":"2024-03-01T12:00:20Z","cause":"epoch_jump"}
+{"start":"2024-03-01T12:01:00Z","end":"2024-03-0`
+	if err := os.WriteFile(filepath.Join(directory, gaps.LogFile), []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := gaps.Read(directory, at(15), at(35))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGaps(t, got,
+		gaps.Gap{Start: at(10), End: at(20), Cause: gaps.EpochJump},
+		gaps.Gap{Start: at(30), End: at(40), Cause: gaps.Disconnected})
+
+	// Gaps recorded after the crash go on a line of their own.
+	d, _ := newDetector(t, directory)
+	d.Observe(update(100, 1))
+	d.Observe(update(110, 2))
+	d.Close()
+	got, err = gaps.Read(directory, at(50), at(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGaps(t, got, gaps.Gap{Start: at(100), End: at(110), Cause: gaps.EpochJump})
+
+	if got, err := gaps.Read(t.TempDir(), at(0), at(60)); got != nil || err != nil {
+		t.Errorf("got %v, %v without a gap log, want nothing", got, err)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	list := []gaps.Gap{
+		{Start: at(0), End: at(10)},
+		{Start: at(5), End: at(15)}, // overlaps the first
+		{Start: at(6), End: at(8)},  // inside both
+		{Start: at(20), End: at(30)},
+		{Start: at(40), End: at(50)},
+	}
+	for _, test := range []struct {
+		from, to int
+		want     int
+	}{
+		{0, 60, 35},
+		{3, 25, 17},
+		{12, 18, 3},
+		{16, 19, 0},
+		{45, 100, 5},
+	} {
+		if got := gaps.Missing(list, at(test.from), at(test.to)); got != time.Duration(test.want)*time.Second {
+			t.Errorf("got %v missing from %d to %d, want %ds", got, test.from, test.to, test.want)
+		}
+	}
+}
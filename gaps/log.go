@@ -0,0 +1,67 @@
+package gaps
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Read returns the gaps recorded in directory that overlap start to end, in
+// the order they start.
+func Read(directory string, start, end time.Time) ([]Gap, error) {
+	filePath := filepath.Join(directory, LogFile)
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading gap log %v: %w", filePath, err)
+	}
+	defer file.Close()
+
+	var gaps []Gap
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var gap Gap
+		if err := json.Unmarshal(scanner.Bytes(), &gap); err != nil {
+			// A crash can leave a line unfinished; the rest of the log is
+			// still good.
+			log.Printf("Skipping line %d of gap log %v: %v\n", line, filePath, err)
+			continue
+		}
+		if gap.End.After(start) && gap.Start.Before(end) {
+			gaps = append(gaps, gap)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading gap log %v: %w", filePath, err)
+	}
+	slices.SortStableFunc(gaps, func(a, b Gap) int { return a.Start.Compare(b.Start) })
+	return gaps, nil
+}
+
+// Missing returns how much of start to end the gaps, in the order they
+// start, cover, counting time covered by more than one gap once.
+func Missing(gaps []Gap, start, end time.Time) time.Duration {
+	var missing time.Duration
+	covered := start // everything before this is already counted
+	for _, gap := range gaps {
+		from, to := gap.Start, gap.End
+		if from.Before(covered) {
+			from = covered
+		}
+		if to.After(end) {
+			to = end
+		}
+		if to.After(from) {
+			missing += to.Sub(from)
+			covered = to
+		}
+	}
+	return missing
+}
@@ -0,0 +1,51 @@
+package influx
+
+import (
+	"strconv"
+	"strings"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// tag is a tag key and value.
+type tag struct {
+	key   string
+	value string
+}
+
+// field is a float field key and value.
+type field struct {
+	key   string
+	value float64
+}
+
+// appendLine appends a line of line protocol to b. Tags with empty values are
+// left out, since line protocol can't represent them.
+func appendLine(b []byte, measurement string, tags []tag, fields []field, timestamp int64) []byte {
+	b = append(b, measurementEscaper.Replace(measurement)...)
+	for _, t := range tags {
+		if t.value == "" {
+			continue
+		}
+		b = append(b, ',')
+		b = append(b, tagEscaper.Replace(t.key)...)
+		b = append(b, '=')
+		b = append(b, tagEscaper.Replace(t.value)...)
+	}
+	for i, f := range fields {
+		if i == 0 {
+			b = append(b, ' ')
+		} else {
+			b = append(b, ',')
+		}
+		b = append(b, tagEscaper.Replace(f.key)...)
+		b = append(b, '=')
+		b = strconv.AppendFloat(b, f.value, 'f', -1, 64)
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, timestamp, 10)
+	return append(b, '\n')
+}
@@ -0,0 +1,82 @@
+package influx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const spoolSuffix = ".lp"
+
+// spool keeps batches that couldn't be sent in a directory, one file per
+// batch, named so that they sort in the order they were written.
+type spool struct {
+	directory string
+	maxBytes  int64
+}
+
+func newSpool(directory string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory %v: %w", directory, err)
+	}
+	return &spool{directory: directory, maxBytes: maxBytes}, nil
+}
+
+// add writes batch to the spool, discarding the oldest batches if the spool
+// would otherwise grow beyond maxBytes.
+func (s *spool) add(batch []byte) error {
+	if s.maxBytes > 0 {
+		if err := s.trim(s.maxBytes - int64(len(batch))); err != nil {
+			return err
+		}
+	}
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + spoolSuffix
+	path := filepath.Join(s.directory, name)
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, batch, 0644); err != nil {
+		return fmt.Errorf("error writing spool file %v: %w", temp, err)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return fmt.Errorf("error writing spool file %v: %w", path, err)
+	}
+	return nil
+}
+
+// files returns the paths of the spooled batches, oldest first.
+func (s *spool) files() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.directory, "*"+spoolSuffix))
+	if err != nil {
+		return nil, err
+	}
+	// The names are all nanosecond timestamps of the same length for the
+	// foreseeable future, so they sort chronologically.
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// trim removes the oldest batches until the spool holds no more than limit
+// bytes.
+func (s *spool) trim(limit int64) error {
+	paths, err := s.files()
+	if err != nil {
+		return err
+	}
+	sizes := make([]int64, len(paths))
+	var total int64
+	for i, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; i < len(paths) && total > limit; i++ {
+		if err := os.Remove(paths[i]); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing spool file %v: %w", paths[i], err)
+		}
+		total -= sizes[i]
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+// Package influx writes realtime updates to InfluxDB using line protocol over
+// HTTP. Writes are batched, and batches that can't be delivered are kept in a
+// spool directory and sent once InfluxDB is reachable again.
+package influx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sink"
+)
+
+const (
+	defaultMeasurement   = "sense"
+	defaultBatchSize     = 500
+	defaultFlushInterval = 10 * time.Second
+	defaultMaxSpoolBytes = 100 << 20
+	defaultTimeout       = 10 * time.Second
+	defaultCloseTimeout  = 30 * time.Second
+)
+
+var (
+	ErrWriteFailed = fmt.Errorf("InfluxDB write failed")
+	// ErrRejected means InfluxDB refused a batch as malformed; it is dropped
+	// rather than spooled, since sending it again wouldn't help.
+	ErrRejected = fmt.Errorf("InfluxDB rejected batch")
+)
+
+type Config struct {
+	// URL is the base URL of the InfluxDB server, such as
+	// http://localhost:8086.
+	URL string
+	// Org, Bucket and Token select where InfluxDB 2.x writes go.
+	Org    string
+	Bucket string
+	Token  string
+	// Database, if set, writes to InfluxDB 1.x instead, with the optional
+	// Username and Password.
+	Database string
+	Username string
+	Password string
+	// Measurement names the measurement for monitor readings; device
+	// readings go in the same name with "_device" appended. It defaults to
+	// "sense".
+	Measurement string
+	// BatchSize is the number of lines sent at once. It defaults to 500.
+	BatchSize int
+	// FlushInterval is the longest a line waits before it is sent. It
+	// defaults to 10 seconds.
+	FlushInterval time.Duration
+	// SpoolDirectory, if set, keeps batches that can't be sent until they
+	// can be. Without it, they are dropped.
+	SpoolDirectory string
+	// MaxSpoolBytes limits the size of the spool; the oldest batches are
+	// discarded to stay under it. It defaults to 100 MiB.
+	MaxSpoolBytes int64
+	// Client is used for the requests. It defaults to a client with a 10
+	// second timeout.
+	Client *http.Client
+	// CloseTimeout bounds how long Close spends on the last flush, so that an
+	// unresponsive InfluxDB can't hold up shutdown; whatever can't be sent by
+	// then is spooled. It defaults to 30 seconds.
+	CloseTimeout time.Duration
+}
+
+var _ sink.Sink = (*Writer)(nil)
+
+// Writer writes the updates from one monitor, tagged with the monitor ID.
+type Writer struct {
+	config   Config
+	writeURL string
+	monitor  string
+	spool    *spool
+	// ctx is cancelled once Close has run out of time, abandoning any
+	// request in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	buffer      []byte
+	lines       int
+	devices     map[string]sense.Device
+	unavailable bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a Writer for monitor. Its spool, if any, is kept in a
+// subdirectory of config.SpoolDirectory named after the monitor ID.
+func New(config Config, monitor sense.MonitorInfo) (*Writer, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no InfluxDB URL")
+	}
+	if config.Measurement == "" {
+		config.Measurement = defaultMeasurement
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultFlushInterval
+	}
+	if config.MaxSpoolBytes <= 0 {
+		config.MaxSpoolBytes = defaultMaxSpoolBytes
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: defaultTimeout}
+	}
+	if config.CloseTimeout <= 0 {
+		config.CloseTimeout = defaultCloseTimeout
+	}
+	w := &Writer{
+		config:   config,
+		writeURL: writeURL(config),
+		monitor:  strconv.Itoa(monitor.ID),
+		devices:  map[string]sense.Device{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if config.SpoolDirectory != "" {
+		var err error
+		w.spool, err = newSpool(filepath.Join(config.SpoolDirectory, w.monitor), config.MaxSpoolBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	go w.flushPeriodically()
+	return w, nil
+}
+
+func writeURL(config Config) string {
+	query := url.Values{"precision": {"s"}}
+	if config.Database != "" {
+		query.Set("db", config.Database)
+		if config.Username != "" {
+			query.Set("u", config.Username)
+			query.Set("p", config.Password)
+		}
+		return strings.TrimSuffix(config.URL, "/") + "/write?" + query.Encode()
+	}
+	query.Set("org", config.Org)
+	query.Set("bucket", config.Bucket)
+	return strings.TrimSuffix(config.URL, "/") + "/api/v2/write?" + query.Encode()
+}
+
+// Write adds the monitor readings and the readings of every active device in
+// update to the batch, sending it if it is full.
+func (w *Writer) Write(update *sense.RealtimeUpdate) error {
+	payload := &update.Payload
+	monitorTags := []tag{{"monitor", w.monitor}}
+	fields := make([]field, 0, 6+len(payload.Voltage)+len(payload.Channels))
+	for i, volts := range payload.Voltage {
+		fields = append(fields, field{"voltage_" + strconv.Itoa(i+1), volts})
+	}
+	for i, watts := range payload.Channels {
+		fields = append(fields, field{"channel_" + strconv.Itoa(i+1) + "_watts", watts})
+	}
+	fields = append(fields,
+		field{"total_watts", payload.TotalWatts},
+		field{"device_watts", float64(payload.DeviceWatts)},
+		field{"grid_watts", float64(payload.GridWatts)},
+		field{"frequency_hz", payload.FrequencyHz},
+	)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buffer = appendLine(w.buffer, w.config.Measurement, monitorTags, fields, payload.EpochTimestamp)
+	w.lines++
+	for _, device := range payload.Devices {
+		w.buffer = appendLine(w.buffer, w.config.Measurement+"_device", w.deviceTags(device), deviceFields(device), payload.EpochTimestamp)
+		w.lines++
+	}
+	if w.lines >= w.config.BatchSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// deviceTags must be called with w.mu held. Names and types come from the
+// device list where possible, since devices in realtime updates carry few
+// tags.
+func (w *Writer) deviceTags(device sense.Device) []tag {
+	name, typ := device.Name, deviceType(device)
+	if known, ok := w.devices[device.ID]; ok {
+		name = known.Name
+		if t := deviceType(known); t != "" {
+			typ = t
+		}
+	}
+	return []tag{
+		{"monitor", w.monitor},
+		{"device_id", device.ID},
+		{"device_name", name},
+		{"device_type", typ},
+	}
+}
+
+func deviceType(device sense.Device) string {
+	if device.Tags.UserDeviceType != nil {
+		return *device.Tags.UserDeviceType
+	}
+	if device.Tags.Type != nil {
+		return *device.Tags.Type
+	}
+	return ""
+}
+
+func deviceFields(device sense.Device) []field {
+	fields := make([]field, 0, 5)
+	if device.Watts != nil {
+		fields = append(fields, field{"watts", *device.Watts})
+	}
+	if device.AlwaysOnWatts != nil {
+		fields = append(fields, field{"always_on_watts", *device.AlwaysOnWatts})
+	}
+	if sd := device.StatusDetails; sd != nil {
+		fields = append(fields,
+			field{"current", sd.Current},
+			field{"voltage", sd.Voltage},
+			field{"energy_used", sd.EnergyUsed},
+		)
+	}
+	if len(fields) == 0 {
+		// A line needs at least one field.
+		fields = append(fields, field{"watts", 0})
+	}
+	return fields
+}
+
+// UpdateDevices records the device names and types used to tag device
+// readings.
+func (w *Writer) UpdateDevices(devices []sense.Device) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, device := range devices {
+		w.devices[device.ID] = device
+	}
+	return nil
+}
+
+// Flush sends the current batch, along with any spooled ones.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+// Close stops the periodic flush and flushes one last time, giving up after
+// CloseTimeout.
+func (w *Writer) Close() error {
+	select {
+	case <-w.stop:
+		return nil
+	default:
+	}
+	timer := time.AfterFunc(w.config.CloseTimeout, w.cancel)
+	defer timer.Stop()
+	defer w.cancel()
+	close(w.stop)
+	<-w.done
+	return w.Flush()
+}
+
+func (w *Writer) flushPeriodically() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				log.Printf("InfluxDB flush failed: %v\n", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// flush must be called with w.mu held. A batch that can't be sent is
+// spooled, and only if that fails too is an error returned.
+func (w *Writer) flush() error {
+	batch := w.buffer
+	w.buffer = nil
+	w.lines = 0
+
+	err := w.sendSpooled()
+	if err == nil && len(batch) > 0 {
+		err = w.send(w.ctx, batch)
+		if errors.Is(err, ErrRejected) {
+			return err
+		}
+	}
+	if err == nil {
+		if w.unavailable {
+			log.Printf("InfluxDB available again\n")
+			w.unavailable = false
+		}
+		return nil
+	}
+	if !w.unavailable {
+		log.Printf("InfluxDB unavailable: %v\n", err)
+		w.unavailable = true
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	if w.spool == nil {
+		return err
+	}
+	return w.spool.add(batch)
+}
+
+// sendSpooled sends spooled batches, oldest first, until one fails.
+func (w *Writer) sendSpooled() error {
+	if w.spool == nil {
+		return nil
+	}
+	paths, err := w.spool.files()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		batch, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading spool file %v: %w", path, err)
+		}
+		err = w.send(w.ctx, batch)
+		if errors.Is(err, ErrRejected) {
+			log.Printf("Dropping spooled batch %v: %v\n", path, err)
+		} else if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing spool file %v: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (w *Writer) send(ctx context.Context, batch []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.writeURL, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.config.Token)
+	}
+	resp, err := w.config.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWriteFailed, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return fmt.Errorf("%w: %s: %s", ErrRejected, resp.Status, bytes.TrimSpace(body))
+	}
+	return fmt.Errorf("%w: %s: %s", ErrWriteFailed, resp.Status, bytes.TrimSpace(body))
+}
@@ -0,0 +1,182 @@
+package influx_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/influx"
+	"github.com/adamroach/sense-logger/influxtest"
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+var monitor = sensetest.DefaultMonitors()[0]
+
+// newWriter returns a Writer for server that only flushes when asked to or
+// when a batch fills up.
+func newWriter(t *testing.T, url string, config influx.Config) *influx.Writer {
+	t.Helper()
+	config.URL = url
+	config.Org = "home"
+	config.Bucket = "sense"
+	config.FlushInterval = time.Hour
+	w, err := influx.New(config, monitor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+// write writes an update with one active device, which makes two lines.
+func write(t *testing.T, w *influx.Writer, frame int) {
+	t.Helper()
+	update := sensetest.RealtimeUpdate(time.Unix(1700000000+int64(frame), 0), frame, sense.Device{ID: "d1a2b3c4"})
+	if err := w.Write(update); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func spooled(t *testing.T, directory string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(directory, "1", "*.lp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestBatching(t *testing.T) {
+	server := influxtest.NewServer()
+	defer server.Close()
+	w := newWriter(t, server.URL(), influx.Config{BatchSize: 3})
+	w.UpdateDevices(sensetest.DefaultDevices().Devices)
+
+	write(t, w, 1)
+	if n := server.RequestCount(); n != 0 {
+		t.Fatalf("got %d requests before the batch filled, want 0", n)
+	}
+	write(t, w, 2)
+	if n := server.RequestCount(); n != 1 {
+		t.Fatalf("got %d requests once the batch filled, want 1", n)
+	}
+	lines := server.Lines()
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4: %q", len(lines), lines)
+	}
+	if !strings.HasPrefix(lines[0], "sense,monitor=1 ") || !strings.HasSuffix(lines[0], " 1700000001") {
+		t.Errorf("got monitor line %q", lines[0])
+	}
+	// Device names and types come from the device list.
+	if want := "sense_device,monitor=1,device_id=d1a2b3c4,device_name=Fridge,device_type=Fridge watts="; !strings.HasPrefix(lines[1], want) {
+		t.Errorf("got device line %q, want it to start with %q", lines[1], want)
+	}
+
+	write(t, w, 3)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.Lines()); n != 6 {
+		t.Errorf("got %d lines after Close, want 6", n)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	server := influxtest.NewServer()
+	defer server.Close()
+	spool := t.TempDir()
+	w := newWriter(t, server.URL(), influx.Config{SpoolDirectory: spool})
+
+	server.SetStatus(http.StatusServiceUnavailable)
+	write(t, w, 1)
+	if err := w.Flush(); err != nil {
+		t.Fatalf("got error %v, want the batch spooled", err)
+	}
+	write(t, w, 2)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(spooled(t, spool)); n != 2 {
+		t.Fatalf("got %d spooled batches, want 2", n)
+	}
+
+	// Once InfluxDB is back, the spooled batches go first, in order.
+	server.SetStatus(http.StatusNoContent)
+	write(t, w, 3)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lines := server.Lines()
+	if len(lines) != 6 {
+		t.Fatalf("got %d lines, want 6", len(lines))
+	}
+	for i, want := range []string{"1700000001", "1700000002", "1700000003"} {
+		if !strings.HasSuffix(lines[2*i], " "+want) {
+			t.Errorf("got line %q, want timestamp %s", lines[2*i], want)
+		}
+	}
+	if n := len(spooled(t, spool)); n != 0 {
+		t.Errorf("got %d spooled batches after replaying them, want 0", n)
+	}
+}
+
+func TestRejectedBatchDropped(t *testing.T) {
+	server := influxtest.NewServer()
+	defer server.Close()
+	spool := t.TempDir()
+	w := newWriter(t, server.URL(), influx.Config{SpoolDirectory: spool})
+
+	server.SetStatus(http.StatusBadRequest)
+	write(t, w, 1)
+	if err := w.Flush(); !errors.Is(err, influx.ErrRejected) {
+		t.Errorf("got error %v, want %v", err, influx.ErrRejected)
+	}
+	if n := len(spooled(t, spool)); n != 0 {
+		t.Errorf("got %d spooled batches, want the rejected one dropped", n)
+	}
+	server.SetStatus(http.StatusNoContent)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.Lines()); n != 0 {
+		t.Errorf("got %d lines, want the rejected batch not sent again", n)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	// A server that never answers.
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer server.Close()
+	defer close(hung)
+	spool := t.TempDir()
+	w := newWriter(t, server.URL, influx.Config{SpoolDirectory: spool, CloseTimeout: 100 * time.Millisecond})
+
+	write(t, w, 1)
+	start := time.Now()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Close took %v", elapsed)
+	}
+	paths := spooled(t, spool)
+	if len(paths) != 1 {
+		t.Fatalf("got %d spooled batches, want the unsent one", len(paths))
+	}
+	batch, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(batch), "\n"); n != 2 {
+		t.Errorf("got %d spooled lines, want 2", n)
+	}
+}
@@ -0,0 +1,105 @@
+// Package influxtest provides a stand-in for the InfluxDB write endpoints,
+// for exercising the influx package without a real server.
+package influxtest
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Server accepts writes on both the InfluxDB 2.x /api/v2/write and 1.x /write
+// endpoints and keeps every line it receives. It is safe for concurrent use.
+type Server struct {
+	httpServer *httptest.Server
+	mux        *http.ServeMux
+
+	mu       sync.Mutex
+	status   int
+	lines    []string
+	requests int
+}
+
+// New returns a Server that is not listening on any address. It implements
+// http.Handler, so it can be mounted on any listener.
+func New() *Server {
+	s := &Server{
+		mux:    http.NewServeMux(),
+		status: http.StatusNoContent,
+	}
+	s.mux.HandleFunc("POST /api/v2/write", s.handleWrite)
+	s.mux.HandleFunc("POST /write", s.handleWrite)
+	return s
+}
+
+// NewServer returns a Server listening on a loopback address. Callers should
+// call Close when finished.
+func NewServer() *Server {
+	s := New()
+	s.httpServer = httptest.NewServer(s)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close shuts down the listener, if the Server was created with NewServer.
+func (s *Server) Close() {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// URL returns the base URL of the Server, suitable for influx.Config.URL.
+func (s *Server) URL() string {
+	if s.httpServer == nil {
+		return ""
+	}
+	return s.httpServer.URL
+}
+
+// SetStatus makes every following write fail with the given HTTP status, or
+// succeed again if it is 2xx. Failed writes are not kept.
+func (s *Server) SetStatus(status int) {
+	s.mu.Lock()
+	s.status = status
+	s.mu.Unlock()
+}
+
+// Lines returns every line received so far, in order.
+func (s *Server) Lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+// RequestCount returns the number of write requests received, including
+// failed ones.
+func (s *Server) RequestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) handleWrite(w http.ResponseWriter, r *http.Request) {
+	var lines []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.status/100 != 2 {
+		http.Error(w, http.StatusText(s.status), s.status)
+		return
+	}
+	s.lines = append(s.lines, lines...)
+	w.WriteHeader(s.status)
+}
@@ -0,0 +1,53 @@
+// Package atomicfile replaces files so that readers, and the next run after a
+// crash or power cut, see either the old contents or the new, never a
+// truncated mix.
+package atomicfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile replaces the file at path with what write writes to it, giving
+// it the permissions perm. It writes a temporary file in the same directory,
+// syncs it to disk and renames it into place.
+func WriteFile(path string, perm os.FileMode, write func(io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating %v: %w", path, err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	// CreateTemp makes the file private.
+	if err := file.Chmod(perm); err != nil {
+		return fmt.Errorf("error creating %v: %w", path, err)
+	}
+	if err := write(file); err != nil {
+		return fmt.Errorf("error writing %v: %w", path, err)
+	}
+	// Without the sync, the rename can reach the disk before the data
+	// does, leaving an empty file after a power cut.
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error writing %v: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error writing %v: %w", path, err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("error writing %v: %w", path, err)
+	}
+	return nil
+}
+
+// WriteJSON replaces the file at path with value encoded as indented JSON,
+// as WriteFile does.
+func WriteJSON(path string, perm os.FileMode, value any) error {
+	return WriteFile(path, perm, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	})
+}
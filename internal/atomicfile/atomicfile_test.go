@@ -0,0 +1,63 @@
+package atomicfile_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/adamroach/sense-logger/internal/atomicfile"
+)
+
+func TestWriteJSON(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "state.json")
+	if err := atomicfile.WriteJSON(path, 0600, map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomicfile.WriteJSON(path, 0600, map[string]int{"b": 2}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "{\n  \"b\": 2\n}\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("got permissions %v, want 0600", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(directory); len(entries) != 1 {
+		t.Errorf("got %d files, want the temporary file removed", len(entries))
+	}
+}
+
+func TestWriteFileFailure(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "state.json")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	broken := errors.New("broken")
+	err := atomicfile.WriteFile(path, 0644, func(w io.Writer) error {
+		io.WriteString(w, "new")
+		return broken
+	})
+	if !errors.Is(err, broken) {
+		t.Errorf("got error %v, want %v", err, broken)
+	}
+	// A failed write leaves the old file as it was, and nothing else.
+	if data, _ := os.ReadFile(path); string(data) != "old" {
+		t.Errorf("got %q after a failed write, want the old contents", data)
+	}
+	if entries, _ := os.ReadDir(directory); len(entries) != 1 {
+		t.Errorf("got %d files, want the temporary file removed", len(entries))
+	}
+}
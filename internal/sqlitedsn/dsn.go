@@ -0,0 +1,27 @@
+// Package sqlitedsn builds the data source names the SQLite stores are opened
+// with.
+package sqlitedsn
+
+import (
+	"net/url"
+	"path/filepath"
+)
+
+// busyTimeout is how many milliseconds a connection waits for a lock held by
+// another (such as a second logger sharing the database) before failing.
+const busyTimeout = "5000"
+
+// File returns the data source name for the SQLite database at path. The path
+// is escaped, so that characters such as '?', '#' and '%' in it are taken
+// literally rather than as part of the URI.
+func File(path string) string {
+	u := url.URL{
+		Scheme: "file",
+		// Cleaning collapses a leading "//", which would otherwise be read
+		// as an authority.
+		Path:     filepath.ToSlash(filepath.Clean(path)),
+		OmitHost: true,
+		RawQuery: url.Values{"_busy_timeout": {busyTimeout}}.Encode(),
+	}
+	return u.String()
+}
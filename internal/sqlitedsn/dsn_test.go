@@ -0,0 +1,53 @@
+package sqlitedsn_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adamroach/sense-logger/internal/sqlitedsn"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestFile(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		{"/var/lib/sense/sense.db", "file:/var/lib/sense/sense.db?_busy_timeout=5000"},
+		{"out/sense.db", "file:out/sense.db?_busy_timeout=5000"},
+		{"//srv/sense.db", "file:/srv/sense.db?_busy_timeout=5000"},
+		{"/data/a?b#c 50%.db", "file:/data/a%3Fb%23c%2050%25.db?_busy_timeout=5000"},
+	} {
+		if got := sqlitedsn.File(test.path); got != test.want {
+			t.Errorf("got %q for %q, want %q", got, test.path, test.want)
+		}
+	}
+}
+
+func TestOpenAwkwardPath(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "we?ird #dir %20x")
+	if err := os.Mkdir(directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(directory, "sense.db")
+	db, err := sql.Open("sqlite3", sqlitedsn.File(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE t (x INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	var timeout int
+	if err := db.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil {
+		t.Fatal(err)
+	}
+	if timeout != 5000 {
+		t.Errorf("got busy timeout %d, want 5000", timeout)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("database not created at %q: %v", path, err)
+	}
+}
@@ -0,0 +1,188 @@
+// Package metrics exports the latest realtime readings from Sense monitors as
+// Prometheus gauges.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sink"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sense"
+
+var (
+	monitorLabels = []string{"monitor"}
+	deviceLabels  = []string{"monitor", "device_id", "device_name"}
+)
+
+// Exporter holds the gauges for every monitor. Each monitor writes to it
+// through its own Sink, returned by ForMonitor.
+type Exporter struct {
+	registry *prometheus.Registry
+
+	voltage     *prometheus.GaugeVec
+	channel     *prometheus.GaugeVec
+	totalWatts  *prometheus.GaugeVec
+	deviceWatts *prometheus.GaugeVec
+	gridWatts   *prometheus.GaugeVec
+	frequency   *prometheus.GaugeVec
+	lastUpdate  *prometheus.GaugeVec
+
+	devicePower    *prometheus.GaugeVec
+	deviceCurrent  *prometheus.GaugeVec
+	deviceVoltage  *prometheus.GaugeVec
+	deviceAlwaysOn *prometheus.GaugeVec
+}
+
+func NewExporter() *Exporter {
+	gauge := func(name, help string, labels ...string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, labels)
+	}
+	e := &Exporter{
+		registry: prometheus.NewRegistry(),
+
+		voltage:     gauge("voltage_volts", "Voltage of each leg of the service.", "monitor", "leg"),
+		channel:     gauge("channel_power_watts", "Power measured on each channel.", "monitor", "channel"),
+		totalWatts:  gauge("total_power_watts", "Total power measured by the monitor.", monitorLabels...),
+		deviceWatts: gauge("detected_power_watts", "Power attributed to detected devices.", monitorLabels...),
+		gridWatts:   gauge("grid_power_watts", "Power drawn from the grid.", monitorLabels...),
+		frequency:   gauge("frequency_hertz", "Line frequency.", monitorLabels...),
+		lastUpdate:  gauge("last_update_timestamp_seconds", "Time of the latest realtime update.", monitorLabels...),
+
+		devicePower:    gauge("device_power_watts", "Power drawn by each active device.", deviceLabels...),
+		deviceCurrent:  gauge("device_current_amperes", "Current drawn by each active device.", deviceLabels...),
+		deviceVoltage:  gauge("device_voltage_volts", "Voltage seen by each active device.", deviceLabels...),
+		deviceAlwaysOn: gauge("device_always_on_power_watts", "Always-on power of each active device.", deviceLabels...),
+	}
+	e.registry.MustRegister(
+		e.voltage, e.channel, e.totalWatts, e.deviceWatts, e.gridWatts, e.frequency, e.lastUpdate,
+		e.devicePower, e.deviceCurrent, e.deviceVoltage, e.deviceAlwaysOn,
+	)
+	return e
+}
+
+// Handler serves the gauges in the Prometheus exposition format.
+func (e *Exporter) Handler() http.Handler {
+	return promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{})
+}
+
+// ForMonitor returns a Sink that sets the gauges for one monitor.
+func (e *Exporter) ForMonitor(monitor sense.MonitorInfo) sink.Sink {
+	return &monitorSink{
+		exporter: e,
+		monitor:  strconv.Itoa(monitor.ID),
+		names:    map[string]string{},
+		active:   map[deviceKey]struct{}{},
+	}
+}
+
+type deviceKey struct {
+	id   string
+	name string
+}
+
+type monitorSink struct {
+	exporter *Exporter
+	monitor  string
+
+	mu     sync.Mutex
+	names  map[string]string // device names from UpdateDevices, by ID
+	active map[deviceKey]struct{}
+}
+
+func (s *monitorSink) Write(update *sense.RealtimeUpdate) error {
+	e := s.exporter
+	payload := &update.Payload
+	for i, volts := range payload.Voltage {
+		e.voltage.WithLabelValues(s.monitor, strconv.Itoa(i+1)).Set(volts)
+	}
+	for i, watts := range payload.Channels {
+		e.channel.WithLabelValues(s.monitor, strconv.Itoa(i+1)).Set(watts)
+	}
+	e.totalWatts.WithLabelValues(s.monitor).Set(payload.TotalWatts)
+	e.deviceWatts.WithLabelValues(s.monitor).Set(float64(payload.DeviceWatts))
+	e.gridWatts.WithLabelValues(s.monitor).Set(float64(payload.GridWatts))
+	e.frequency.WithLabelValues(s.monitor).Set(payload.FrequencyHz)
+	e.lastUpdate.WithLabelValues(s.monitor).Set(float64(payload.EpochTimestamp))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Only active devices appear in an update; the series of those that have
+	// turned off are removed rather than left at their last reading.
+	active := make(map[deviceKey]struct{}, len(payload.Devices))
+	for _, device := range payload.Devices {
+		name := device.Name
+		if known, ok := s.names[device.ID]; ok {
+			name = known
+		}
+		key := deviceKey{id: device.ID, name: name}
+		active[key] = struct{}{}
+		labels := []string{s.monitor, key.id, key.name}
+
+		watts, alwaysOn := 0.0, 0.0
+		if device.Watts != nil {
+			watts = *device.Watts
+		}
+		if device.AlwaysOnWatts != nil {
+			alwaysOn = *device.AlwaysOnWatts
+		}
+		e.devicePower.WithLabelValues(labels...).Set(watts)
+		e.deviceAlwaysOn.WithLabelValues(labels...).Set(alwaysOn)
+		if device.StatusDetails != nil {
+			e.deviceCurrent.WithLabelValues(labels...).Set(device.StatusDetails.Current)
+			e.deviceVoltage.WithLabelValues(labels...).Set(device.StatusDetails.Voltage)
+		}
+	}
+	for key := range s.active {
+		if _, ok := active[key]; !ok {
+			s.delete(key)
+		}
+	}
+	s.active = active
+	return nil
+}
+
+// UpdateDevices records the device names, so that a rename shows up in the
+// labels without waiting for the realtime feed to catch up.
+func (s *monitorSink) UpdateDevices(devices []sense.Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, device := range devices {
+		s.names[device.ID] = device.Name
+	}
+	return nil
+}
+
+func (s *monitorSink) Flush() error {
+	return nil
+}
+
+// Close removes every gauge for the monitor.
+func (s *monitorSink) Close() error {
+	e := s.exporter
+	labels := prometheus.Labels{"monitor": s.monitor}
+	for _, vec := range []*prometheus.GaugeVec{
+		e.voltage, e.channel, e.totalWatts, e.deviceWatts, e.gridWatts, e.frequency, e.lastUpdate,
+		e.devicePower, e.deviceCurrent, e.deviceVoltage, e.deviceAlwaysOn,
+	} {
+		vec.DeletePartialMatch(labels)
+	}
+	return nil
+}
+
+// delete must be called with s.mu held.
+func (s *monitorSink) delete(key deviceKey) {
+	e := s.exporter
+	for _, vec := range []*prometheus.GaugeVec{e.devicePower, e.deviceCurrent, e.deviceVoltage, e.deviceAlwaysOn} {
+		vec.DeleteLabelValues(s.monitor, key.id, key.name)
+	}
+}
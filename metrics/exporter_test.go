@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+// gather returns every sample in the registry as "name{label=value,...}",
+// mapped to its value.
+func gather(t *testing.T, e *Exporter) map[string]float64 {
+	t.Helper()
+	families, err := e.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
+			sort.Strings(labels)
+			samples[fmt.Sprintf("%s{%s}", family.GetName(), strings.Join(labels, ","))] = metric.GetGauge().GetValue()
+		}
+	}
+	return samples
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestExporter(t *testing.T) {
+	e := NewExporter()
+	home := e.ForMonitor(sense.MonitorInfo{ID: 1})
+	cabin := e.ForMonitor(sense.MonitorInfo{ID: 2})
+
+	home.UpdateDevices([]sense.Device{{ID: "d1a2b3c4", Name: "Kitchen Fridge"}})
+	update := &sense.RealtimeUpdate{Payload: sense.RealtimeUpdatePayload{
+		Voltage:        []float64{121, 119},
+		Channels:       []float64{300, 200},
+		TotalWatts:     500,
+		DeviceWatts:    450,
+		GridWatts:      480,
+		FrequencyHz:    60,
+		EpochTimestamp: 1700000000,
+		Devices: []sense.Device{
+			{ID: "d1a2b3c4", Name: "Fridge", Watts: ptr(150.0), AlwaysOnWatts: ptr(5.0),
+				StatusDetails: &sense.StatusDetails{Current: 1.25, Voltage: 120}},
+			{ID: "e5f6a7b8", Name: "Dryer", Watts: ptr(300.0)},
+		},
+	}}
+	if err := home.Write(update); err != nil {
+		t.Fatal(err)
+	}
+	if err := cabin.Write(&sense.RealtimeUpdate{Payload: sense.RealtimeUpdatePayload{TotalWatts: 75}}); err != nil {
+		t.Fatal(err)
+	}
+
+	samples := gather(t, e)
+	for name, want := range map[string]float64{
+		"sense_voltage_volts{leg=1,monitor=1}":                                                        121,
+		"sense_voltage_volts{leg=2,monitor=1}":                                                        119,
+		"sense_channel_power_watts{channel=2,monitor=1}":                                              200,
+		"sense_total_power_watts{monitor=1}":                                                          500,
+		"sense_total_power_watts{monitor=2}":                                                          75,
+		"sense_detected_power_watts{monitor=1}":                                                       450,
+		"sense_grid_power_watts{monitor=1}":                                                           480,
+		"sense_frequency_hertz{monitor=1}":                                                            60,
+		"sense_last_update_timestamp_seconds{monitor=1}":                                              1700000000,
+		"sense_device_power_watts{device_id=d1a2b3c4,device_name=Kitchen Fridge,monitor=1}":           150,
+		"sense_device_always_on_power_watts{device_id=d1a2b3c4,device_name=Kitchen Fridge,monitor=1}": 5,
+		"sense_device_current_amperes{device_id=d1a2b3c4,device_name=Kitchen Fridge,monitor=1}":       1.25,
+		"sense_device_voltage_volts{device_id=d1a2b3c4,device_name=Kitchen Fridge,monitor=1}":         120,
+		"sense_device_power_watts{device_id=e5f6a7b8,device_name=Dryer,monitor=1}":                    300,
+	} {
+		got, ok := samples[name]
+		if !ok {
+			t.Errorf("missing %s", name)
+		} else if got != want {
+			t.Errorf("got %s = %v, want %v", name, got, want)
+		}
+	}
+	// The dryer reports no status details, so it has no current or voltage.
+	if _, ok := samples["sense_device_current_amperes{device_id=e5f6a7b8,device_name=Dryer,monitor=1}"]; ok {
+		t.Error("got a current for a device without status details")
+	}
+
+	// A device that turns off loses its series.
+	update.Payload.Devices = update.Payload.Devices[:1]
+	home.Write(update)
+	samples = gather(t, e)
+	if _, ok := samples["sense_device_power_watts{device_id=e5f6a7b8,device_name=Dryer,monitor=1}"]; ok {
+		t.Error("got power for a device that turned off")
+	}
+
+	// Closing a monitor's sink removes its series, and only its series.
+	home.Close()
+	for name := range gather(t, e) {
+		if strings.Contains(name, "monitor=1") {
+			t.Errorf("got %s after closing monitor 1", name)
+		}
+	}
+	if _, ok := gather(t, e)["sense_total_power_watts{monitor=2}"]; !ok {
+		t.Error("lost monitor 2's series when closing monitor 1")
+	}
+}
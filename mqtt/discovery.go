@@ -0,0 +1,208 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+// iconMap translates the icon names Sense uses into Material Design Icons,
+// where they differ.
+var iconMap = map[string]string{
+	"ac":            "air-conditioner",
+	"aquarium":      "fish",
+	"car":           "car-electric",
+	"computer":      "desktop-classic",
+	"cup":           "coffee",
+	"dehumidifier":  "water-off",
+	"dishes":        "dishwasher",
+	"drill":         "toolbox",
+	"freezer":       "fridge-top",
+	"fridge":        "fridge-bottom",
+	"game":          "gamepad-variant",
+	"grill":         "stove",
+	"heat":          "fire",
+	"heater":        "radiator",
+	"humidifier":    "water",
+	"leafblower":    "leaf",
+	"media_console": "set-top-box",
+	"modem":         "router-wireless",
+	"outlet":        "power-socket-us",
+	"papershredder": "shredder",
+	"pump":          "water-pump",
+	"settings":      "cog",
+	"skillet":       "pot",
+	"smartcamera":   "webcam",
+	"socket":        "power-plug",
+	"solar_alt":     "solar-power",
+	"sound":         "speaker",
+	"trash":         "trash-can",
+	"tv":            "television",
+	"vacuum":        "robot-vacuum",
+	"washer":        "washing-machine",
+}
+
+// discoveryConfig is a Home Assistant MQTT discovery config for one sensor.
+type discoveryConfig struct {
+	component string // "sensor" or "binary_sensor"
+	objectID  string
+	payload   map[string]any
+}
+
+// sensor describes one value in a state topic's JSON object.
+type sensor struct {
+	key         string
+	name        string
+	unit        string
+	deviceClass string
+}
+
+var (
+	deviceSensors = []sensor{
+		{"watts", "Power", "W", "power"},
+		{"current", "Current", "A", "current"},
+		{"voltage", "Voltage", "V", "voltage"},
+		{"always_on_watts", "Always on power", "W", "power"},
+	}
+	mainsSensors = []sensor{
+		{"total_watts", "Total power", "W", "power"},
+		{"device_watts", "Detected power", "W", "power"},
+		{"grid_watts", "Grid power", "W", "power"},
+		{"frequency_hz", "Frequency", "Hz", "frequency"},
+		{"voltage_1", "Voltage L1", "V", "voltage"},
+		{"voltage_2", "Voltage L2", "V", "voltage"},
+		{"channel_1_watts", "Power L1", "W", "power"},
+		{"channel_2_watts", "Power L2", "W", "power"},
+	}
+)
+
+func (p *Publisher) mainsDevice() map[string]any {
+	return map[string]any{
+		"identifiers":  []string{"sense_" + p.monitor},
+		"name":         "Sense " + p.monitor,
+		"manufacturer": "Sense",
+		"model":        "Energy monitor",
+	}
+}
+
+func (p *Publisher) mainsConfigs() []discoveryConfig {
+	var configs []discoveryConfig
+	for _, s := range mainsSensors {
+		objectID := "sense_" + p.monitor + "_" + s.key
+		configs = append(configs, discoveryConfig{
+			component: "sensor",
+			objectID:  objectID,
+			payload:   p.sensorPayload(s, objectID, p.mainsTopic(), p.mainsDevice()),
+		})
+	}
+	return configs
+}
+
+// deviceConfigs returns the configs for a device: a sensor for each reading,
+// and a binary sensor for whether it is on. Devices are named after
+// Device.Name, with the model taken from the user's device type.
+func (p *Publisher) deviceConfigs(device sense.Device) []discoveryConfig {
+	base := "sense_" + p.monitor + "_" + topicSafe(device.ID)
+	haDevice := map[string]any{
+		"identifiers":  []string{base},
+		"name":         device.Name,
+		"manufacturer": "Sense",
+		"via_device":   "sense_" + p.monitor,
+	}
+	if device.Tags.UserDeviceType != nil {
+		haDevice["model"] = *device.Tags.UserDeviceType
+	}
+	topic := p.deviceTopic(device.ID)
+	icon := deviceIcon(device)
+
+	var configs []discoveryConfig
+	for _, s := range deviceSensors {
+		payload := p.sensorPayload(s, base+"_"+s.key, topic, haDevice)
+		if icon != "" && s.key == "watts" {
+			payload["icon"] = icon
+		}
+		configs = append(configs, discoveryConfig{
+			component: "sensor",
+			objectID:  base + "_" + s.key,
+			payload:   payload,
+		})
+	}
+	power := map[string]any{
+		"name":               nil, // named after the device itself
+		"unique_id":          base + "_state",
+		"object_id":          base + "_state",
+		"state_topic":        topic,
+		"value_template":     "{{ value_json.state }}",
+		"payload_on":         "on",
+		"payload_off":        "off",
+		"device_class":       "power",
+		"availability_topic": p.statusTopic(),
+		"device":             haDevice,
+	}
+	if icon != "" {
+		power["icon"] = icon
+	}
+	configs = append(configs, discoveryConfig{
+		component: "binary_sensor",
+		objectID:  base + "_state",
+		payload:   power,
+	})
+	return configs
+}
+
+func (p *Publisher) sensorPayload(s sensor, objectID, topic string, device map[string]any) map[string]any {
+	return map[string]any{
+		"name":                s.name,
+		"unique_id":           objectID,
+		"object_id":           objectID,
+		"state_topic":         topic,
+		"value_template":      "{{ value_json." + s.key + " | default(0) }}",
+		"unit_of_measurement": s.unit,
+		"device_class":        s.deviceClass,
+		"state_class":         "measurement",
+		"availability_topic":  p.statusTopic(),
+		"device":              device,
+	}
+}
+
+// publishConfigs publishes configs, unless the broker is unreachable, in
+// which case they are published on reconnection instead.
+func (p *Publisher) publishConfigs(configs []discoveryConfig) error {
+	if !p.client.IsConnectionOpen() {
+		return nil
+	}
+	for _, config := range configs {
+		payload, err := json.Marshal(config.payload)
+		if err != nil {
+			return err
+		}
+		topic := p.config.DiscoveryPrefix + "/" + config.component + "/" + config.objectID + "/config"
+		if err := p.publish(topic, true, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deviceIcon(device sense.Device) string {
+	if device.Icon == nil || *device.Icon == "" {
+		return ""
+	}
+	if icon, ok := iconMap[*device.Icon]; ok {
+		return "mdi:" + icon
+	}
+	return "mdi:" + *device.Icon
+}
+
+// topicSafe replaces the characters that have a meaning in MQTT topics, or
+// that Home Assistant doesn't allow in object IDs.
+func topicSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,114 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// decode round-trips a discovery payload through JSON, as Home Assistant
+// would see it.
+func decode(t *testing.T, config discoveryConfig) map[string]any {
+	t.Helper()
+	data, err := json.Marshal(config.payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestDeviceConfigs(t *testing.T) {
+	p := &Publisher{config: Config{TopicPrefix: "sense", DiscoveryPrefix: "homeassistant"}, monitor: "1"}
+	configs := p.deviceConfigs(sense.Device{
+		ID:   "d1a2/b3+c4",
+		Name: "Fridge",
+		Icon: ptr("fridge"),
+		Tags: sense.DeviceTags{UserDeviceType: ptr("Refrigerator")},
+	})
+	if len(configs) != len(deviceSensors)+1 {
+		t.Fatalf("got %d configs, want %d", len(configs), len(deviceSensors)+1)
+	}
+
+	watts := configs[0]
+	if watts.component != "sensor" || watts.objectID != "sense_1_d1a2_b3_c4_watts" {
+		t.Errorf("got %s %s, want sensor sense_1_d1a2_b3_c4_watts", watts.component, watts.objectID)
+	}
+	payload := decode(t, watts)
+	for key, want := range map[string]any{
+		"name":                "Power",
+		"unique_id":           "sense_1_d1a2_b3_c4_watts",
+		"state_topic":         "sense/1/devices/d1a2_b3_c4",
+		"value_template":      "{{ value_json.watts | default(0) }}",
+		"unit_of_measurement": "W",
+		"device_class":        "power",
+		"state_class":         "measurement",
+		"availability_topic":  "sense/1/status",
+		"icon":                "mdi:fridge-bottom",
+	} {
+		if payload[key] != want {
+			t.Errorf("got %s %v, want %v", key, payload[key], want)
+		}
+	}
+	device, _ := payload["device"].(map[string]any)
+	if device["name"] != "Fridge" || device["model"] != "Refrigerator" || device["via_device"] != "sense_1" {
+		t.Errorf("got device %v, want the Fridge, a Refrigerator, via sense_1", device)
+	}
+	// Only the power sensor gets the device's icon.
+	if _, ok := decode(t, configs[1])["icon"]; ok {
+		t.Error("got an icon on the current sensor")
+	}
+
+	state := configs[len(configs)-1]
+	if state.component != "binary_sensor" || state.objectID != "sense_1_d1a2_b3_c4_state" {
+		t.Errorf("got %s %s, want binary_sensor sense_1_d1a2_b3_c4_state", state.component, state.objectID)
+	}
+	payload = decode(t, state)
+	if name, ok := payload["name"]; !ok || name != nil {
+		t.Errorf("got name %v, want null so that the sensor takes the device's name", name)
+	}
+	if payload["payload_on"] != "on" || payload["payload_off"] != "off" || payload["value_template"] != "{{ value_json.state }}" {
+		t.Errorf("got state payload %v", payload)
+	}
+}
+
+func TestMainsConfigs(t *testing.T) {
+	p := &Publisher{config: Config{TopicPrefix: "home/sense"}, monitor: "12"}
+	configs := p.mainsConfigs()
+	if len(configs) != len(mainsSensors) {
+		t.Fatalf("got %d configs, want %d", len(configs), len(mainsSensors))
+	}
+	payload := decode(t, configs[3])
+	if configs[3].objectID != "sense_12_frequency_hz" || payload["unit_of_measurement"] != "Hz" ||
+		payload["state_topic"] != "home/sense/12/mains" {
+		t.Errorf("got %s with %v, want the frequency sensor on home/sense/12/mains", configs[3].objectID, payload)
+	}
+	device, _ := payload["device"].(map[string]any)
+	if ids, _ := device["identifiers"].([]any); len(ids) != 1 || ids[0] != "sense_12" {
+		t.Errorf("got device identifiers %v, want [sense_12]", device["identifiers"])
+	}
+}
+
+func TestDeviceIcon(t *testing.T) {
+	for _, test := range []struct {
+		icon *string
+		want string
+	}{
+		{nil, ""},
+		{ptr(""), ""},
+		{ptr("tv"), "mdi:television"},
+		{ptr("lightbulb"), "mdi:lightbulb"},
+	} {
+		if got := deviceIcon(sense.Device{Icon: test.icon}); got != test.want {
+			t.Errorf("got icon %q, want %q", got, test.want)
+		}
+	}
+}
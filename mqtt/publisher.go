@@ -0,0 +1,270 @@
+// Package mqtt publishes realtime readings to an MQTT broker, along with
+// Home Assistant discovery configs so that they show up as sensors.
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sink"
+)
+
+const (
+	defaultTopicPrefix     = "sense"
+	defaultDiscoveryPrefix = "homeassistant"
+	defaultClientID        = "sense-logger"
+	publishTimeout         = 10 * time.Second
+
+	online  = "online"
+	offline = "offline"
+)
+
+var ErrPublishTimeout = fmt.Errorf("timed out publishing to MQTT broker")
+
+type Config struct {
+	// Broker is the URL of the broker, such as tcp://localhost:1883.
+	Broker   string
+	Username string
+	Password string
+	// ClientID identifies the connection to the broker; the monitor ID is
+	// appended to it. It defaults to "sense-logger".
+	ClientID string
+	// TopicPrefix is the root of the topics readings are published on. It
+	// defaults to "sense".
+	TopicPrefix string
+	// DiscoveryPrefix is the Home Assistant discovery prefix. It defaults to
+	// "homeassistant".
+	DiscoveryPrefix string
+	// NoDiscovery turns off the Home Assistant discovery configs.
+	NoDiscovery bool
+	// QoS is the quality of service for every message.
+	QoS byte
+}
+
+var _ sink.Sink = (*Publisher)(nil)
+
+// Publisher publishes the readings from one monitor. The mains readings go
+// to <prefix>/<monitor>/mains as a JSON object, and each device's to
+// <prefix>/<monitor>/devices/<id>. <prefix>/<monitor>/status is "online"
+// while the Publisher is connected.
+type Publisher struct {
+	config  Config
+	monitor string
+	client  paho.Client
+
+	mu         sync.Mutex
+	devices    map[string]sense.Device // from the device list and updates
+	discovered map[string]bool         // device IDs with published configs
+	active     map[string]bool         // device IDs in the latest update
+}
+
+// New connects to the broker and returns a Publisher for monitor. It keeps
+// reconnecting in the background if the connection is lost.
+func New(config Config, monitor sense.MonitorInfo) (*Publisher, error) {
+	if config.Broker == "" {
+		return nil, fmt.Errorf("no MQTT broker")
+	}
+	if config.ClientID == "" {
+		config.ClientID = defaultClientID
+	}
+	if config.TopicPrefix == "" {
+		config.TopicPrefix = defaultTopicPrefix
+	}
+	if config.DiscoveryPrefix == "" {
+		config.DiscoveryPrefix = defaultDiscoveryPrefix
+	}
+	p := &Publisher{
+		config:     config,
+		monitor:    strconv.Itoa(monitor.ID),
+		devices:    map[string]sense.Device{},
+		discovered: map[string]bool{},
+		active:     map[string]bool{},
+	}
+	options := paho.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID+"-"+p.monitor).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(p.statusTopic(), offline, config.QoS, true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(client paho.Client, err error) {
+			log.Printf("MQTT connection to %v lost: %v\n", config.Broker, err)
+		})
+	p.client = paho.NewClient(options)
+	// With SetConnectRetry, Connect keeps trying in the background, so a
+	// broker that isn't up yet doesn't stop the logger.
+	p.client.Connect()
+	return p, nil
+}
+
+// onConnect announces the Publisher and (re)publishes every discovery config,
+// in case the broker lost its retained messages.
+func (p *Publisher) onConnect(client paho.Client) {
+	go func() {
+		if err := p.publish(p.statusTopic(), true, []byte(online)); err != nil {
+			return
+		}
+		if p.config.NoDiscovery {
+			return
+		}
+		p.publishConfigs(p.mainsConfigs())
+		p.mu.Lock()
+		var configs []discoveryConfig
+		for id := range p.discovered {
+			configs = append(configs, p.deviceConfigs(p.devices[id])...)
+		}
+		p.mu.Unlock()
+		p.publishConfigs(configs)
+	}()
+}
+
+// Write publishes the mains readings and those of every active device. A
+// device that has dropped out of the update is published once more with zero
+// power, so that it doesn't look stuck on. Updates that arrive while the
+// broker is unreachable are dropped.
+func (p *Publisher) Write(update *sense.RealtimeUpdate) error {
+	if !p.client.IsConnectionOpen() {
+		return nil
+	}
+	payload := &update.Payload
+	mains := map[string]any{
+		"total_watts":  payload.TotalWatts,
+		"device_watts": payload.DeviceWatts,
+		"grid_watts":   payload.GridWatts,
+		"frequency_hz": payload.FrequencyHz,
+		"timestamp":    payload.EpochTimestamp,
+	}
+	for i, volts := range payload.Voltage {
+		mains["voltage_"+strconv.Itoa(i+1)] = volts
+	}
+	for i, watts := range payload.Channels {
+		mains["channel_"+strconv.Itoa(i+1)+"_watts"] = watts
+	}
+	if err := p.publishJSON(p.mainsTopic(), mains); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	var configs []discoveryConfig
+	active := make(map[string]bool, len(payload.Devices))
+	for _, device := range payload.Devices {
+		active[device.ID] = true
+		if _, ok := p.devices[device.ID]; !ok {
+			p.devices[device.ID] = device
+		}
+		if !p.config.NoDiscovery && !p.discovered[device.ID] {
+			p.discovered[device.ID] = true
+			configs = append(configs, p.deviceConfigs(p.devices[device.ID])...)
+		}
+	}
+	var inactive []string
+	for id := range p.active {
+		if !active[id] {
+			inactive = append(inactive, id)
+		}
+	}
+	p.active = active
+	p.mu.Unlock()
+
+	if err := p.publishConfigs(configs); err != nil {
+		return err
+	}
+	for _, device := range payload.Devices {
+		if err := p.publishJSON(p.deviceTopic(device.ID), deviceState(device, payload.EpochTimestamp)); err != nil {
+			return err
+		}
+	}
+	for _, id := range inactive {
+		off := map[string]any{"state": "off", "watts": 0, "timestamp": payload.EpochTimestamp}
+		if err := p.publishJSON(p.deviceTopic(id), off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deviceState(device sense.Device, timestamp int64) map[string]any {
+	state := map[string]any{"state": "on", "timestamp": timestamp}
+	if device.Watts != nil {
+		state["watts"] = *device.Watts
+	}
+	if device.AlwaysOnWatts != nil {
+		state["always_on_watts"] = *device.AlwaysOnWatts
+	}
+	if sd := device.StatusDetails; sd != nil {
+		state["current"] = sd.Current
+		state["voltage"] = sd.Voltage
+	}
+	return state
+}
+
+// UpdateDevices publishes discovery configs for every device, so that they
+// appear in Home Assistant before they first turn on, and updates the names
+// of those already published.
+func (p *Publisher) UpdateDevices(devices []sense.Device) error {
+	p.mu.Lock()
+	var configs []discoveryConfig
+	for _, device := range devices {
+		p.devices[device.ID] = device
+		if !p.config.NoDiscovery {
+			p.discovered[device.ID] = true
+			configs = append(configs, p.deviceConfigs(device)...)
+		}
+	}
+	p.mu.Unlock()
+	return p.publishConfigs(configs)
+}
+
+func (p *Publisher) Flush() error {
+	return nil
+}
+
+// Close marks the monitor offline and disconnects from the broker.
+func (p *Publisher) Close() error {
+	var err error
+	if p.client.IsConnectionOpen() {
+		err = p.publish(p.statusTopic(), true, []byte(offline))
+	}
+	p.client.Disconnect(uint(publishTimeout / time.Millisecond))
+	return err
+}
+
+func (p *Publisher) publishJSON(topic string, value any) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return p.publish(topic, false, payload)
+}
+
+func (p *Publisher) publish(topic string, retained bool, payload []byte) error {
+	token := p.client.Publish(topic, p.config.QoS, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return ErrPublishTimeout
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("error publishing to %v: %w", topic, err)
+	}
+	return nil
+}
+
+func (p *Publisher) statusTopic() string {
+	return p.config.TopicPrefix + "/" + p.monitor + "/status"
+}
+
+func (p *Publisher) mainsTopic() string {
+	return p.config.TopicPrefix + "/" + p.monitor + "/mains"
+}
+
+func (p *Publisher) deviceTopic(id string) string {
+	return p.config.TopicPrefix + "/" + p.monitor + "/devices/" + topicSafe(id)
+}
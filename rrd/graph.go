@@ -0,0 +1,81 @@
+package rrd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ziutek/rrd"
+)
+
+// colors are used in turn for the lines on a graph.
+var colors = []string{
+	"1f77b4", "ff7f0e", "2ca02c", "d62728", "9467bd",
+	"8c564b", "e377c2", "7f7f7f", "bcbd22", "17becf",
+}
+
+type GraphOptions struct {
+	// Devices lists the IDs of the devices to plot. Without any, the total
+	// and grid power from the main file are plotted instead.
+	Devices []string
+	// Names labels the devices in the legend; devices without one are
+	// labelled with their ID.
+	Names  map[string]string
+	Start  time.Time
+	End    time.Time
+	Title  string
+	Width  uint
+	Height uint
+	// Format is the image format, such as "PNG" or "SVG". It defaults to
+	// PNG.
+	Format string
+}
+
+// Graph draws the power recorded in directory between options.Start and
+// options.End, returning the image.
+func Graph(directory string, options GraphOptions) ([]byte, error) {
+	g := rrd.NewGrapher()
+	g.SetVLabel("Watts")
+	if options.Title != "" {
+		g.SetTitle(options.Title)
+	}
+	if options.Width > 0 && options.Height > 0 {
+		g.SetSize(options.Width, options.Height)
+	}
+	if options.Format != "" {
+		g.SetImageFormat(options.Format)
+	}
+
+	if len(options.Devices) == 0 {
+		mainFilePath := FilePath(directory, "")
+		if _, err := os.Stat(mainFilePath); err != nil {
+			return nil, fmt.Errorf("error reading RRD file %v: %w", mainFilePath, err)
+		}
+		g.Def("wt", mainFilePath, "wt", "AVERAGE")
+		g.Def("wg", mainFilePath, "wg", "AVERAGE")
+		g.Area("wt", colors[0], "Total")
+		g.Line(1, "wg", colors[1], "Grid")
+	}
+	for i, id := range options.Devices {
+		deviceFilePath := FilePath(directory, id)
+		if _, err := os.Stat(deviceFilePath); err != nil {
+			return nil, fmt.Errorf("error reading RRD file %v: %w", deviceFilePath, err)
+		}
+		name := options.Names[id]
+		if name == "" {
+			name = id
+		}
+		// Colons separate the fields of rrdtool graph arguments.
+		name = strings.ReplaceAll(name, ":", `\:`)
+		vname := fmt.Sprintf("w%d", i)
+		g.Def(vname, deviceFilePath, "w", "AVERAGE")
+		g.Line(1, vname, colors[i%len(colors)], name)
+	}
+
+	_, image, err := g.Graph(options.Start, options.End)
+	if err != nil {
+		return nil, fmt.Errorf("error drawing graph: %w", err)
+	}
+	return image, nil
+}
@@ -0,0 +1,85 @@
+package rrd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ziutek/rrd"
+)
+
+// Series is a run of averaged readings fetched from an RRD file. Rows[i]
+// holds the average of every data source in Names over the step that ends at
+// Start + (i+1)*Step; missing readings are NaN.
+type Series struct {
+	Start time.Time
+	Step  time.Duration
+	Names []string
+	Rows  [][]float64
+}
+
+// Time returns the time of row i, the end of the step it averages.
+func (s *Series) Time(i int) time.Time {
+	return s.Start.Add(time.Duration(i+1) * s.Step)
+}
+
+// FilePath returns the path of the RRD file for deviceID in directory, or of
+// the main file if deviceID is empty.
+func FilePath(directory, deviceID string) string {
+	if deviceID == "" {
+		return fmt.Sprintf("%s/%s", directory, MainFile)
+	}
+	return fmt.Sprintf("%s/%s.rrd", directory, deviceID)
+}
+
+// Fetch reads the averaged readings between start and end from the RRD file
+// for deviceID in directory (the main file if deviceID is empty). RRD picks
+// the finest archive that covers the range at no finer than step.
+func Fetch(directory, deviceID string, start, end time.Time, step time.Duration) (*Series, error) {
+	filePath := FilePath(directory, deviceID)
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, fmt.Errorf("error reading RRD file %v: %w", filePath, err)
+	}
+	result, err := rrd.Fetch(filePath, "AVERAGE", start, end, step)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RRD file %v: %w", filePath, err)
+	}
+	defer result.FreeValues()
+
+	// RRD rounds start and end to the step, and returns the steps ending
+	// after start up to end. RowCnt counts one more, past end.
+	rows := 0
+	if result.Step > 0 {
+		rows = min(result.RowCnt, int(result.End.Sub(result.Start)/result.Step))
+	}
+	series := &Series{
+		Start: result.Start,
+		Step:  result.Step,
+		Names: result.DsNames,
+		Rows:  make([][]float64, max(rows, 0)),
+	}
+	for i := range series.Rows {
+		row := make([]float64, len(result.DsNames))
+		for j := range row {
+			row[j] = result.ValueAt(j, i)
+		}
+		series.Rows[i] = row
+	}
+	return series, nil
+}
+
+// DeviceNames returns the device names recorded in directory, by ID.
+func DeviceNames(directory string) (map[string]string, error) {
+	filePath := fmt.Sprintf("%s/%s", directory, DeviceFile)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening JSON file %v: %w", filePath, err)
+	}
+	defer file.Close()
+	names := make(map[string]string)
+	if err := json.NewDecoder(file).Decode(&names); err != nil {
+		return nil, fmt.Errorf("error decoding JSON file %v: %w", filePath, err)
+	}
+	return names, nil
+}
@@ -0,0 +1,19 @@
+package rrd_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/rrd"
+)
+
+func TestSeriesTime(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	series := &rrd.Series{Start: start, Step: time.Hour, Rows: make([][]float64, 2)}
+	// Each row is stamped with the end of the step it averages.
+	for i, want := range []time.Time{start.Add(time.Hour), start.Add(2 * time.Hour)} {
+		if got := series.Time(i); !got.Equal(want) {
+			t.Errorf("got row %d at %v, want %v", i, got, want)
+		}
+	}
+}
@@ -4,9 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/adamroach/sense-logger/internal/atomicfile"
 	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sink"
 	"github.com/ziutek/rrd"
 )
 
@@ -21,27 +25,66 @@ const (
 	WMax       = VMax * IMax
 )
 
+var _ sink.Sink = (*Writer)(nil)
+
 type Writer struct {
 	directory  string
 	lastReport time.Time
 }
 
 func NewWriter(directory string) (*Writer, error) {
+	if err := checkDirectory(directory); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		directory: directory,
+	}, nil
+}
+
+// NewMonitorWriter returns a Writer that keeps the files for a single monitor
+// in their own subdirectory of directory, named after the monitor ID. The
+// subdirectory is created if it does not already exist.
+func NewMonitorWriter(directory string, monitor sense.MonitorInfo) (*Writer, error) {
+	if err := checkDirectory(directory); err != nil {
+		return nil, err
+	}
+	monitorDirectory := filepath.Join(directory, strconv.Itoa(monitor.ID))
+	if err := os.MkdirAll(monitorDirectory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory %v: %w", monitorDirectory, err)
+	}
+	return NewWriter(monitorDirectory)
+}
+
+// checkDirectory returns an error unless directory is an existing directory.
+func checkDirectory(directory string) error {
 	info, err := os.Stat(directory)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("directory does not exist: %s", directory)
+			return fmt.Errorf("directory does not exist: %s", directory)
 		}
-		return nil, fmt.Errorf("error checking directory: %w", err)
+		return fmt.Errorf("error checking directory: %w", err)
 	}
 
 	if !info.IsDir() {
-		return nil, fmt.Errorf("path is not a directory: %s", directory)
+		return fmt.Errorf("path is not a directory: %s", directory)
 	}
+	return nil
+}
 
-	return &Writer{
-		directory: directory,
-	}, nil
+// UpdateDevices records the names of devices.
+func (w *Writer) UpdateDevices(devices []sense.Device) error {
+	return w.UpdateDeviceNames(devices)
+}
+
+// Flush does nothing, since every update is written to the RRD files as it
+// arrives.
+func (w *Writer) Flush() error {
+	return nil
+}
+
+// Close does nothing; the Writer holds no open files between updates.
+func (w *Writer) Close() error {
+	return nil
 }
 
 func (w *Writer) UpdateDeviceNames(devices []sense.Device) error {
@@ -64,19 +107,7 @@ func (w *Writer) UpdateDeviceNames(devices []sense.Device) error {
 	}
 
 	// Write the updated names map back to the JSON file
-	file, err = os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("error creating JSON file %v: %w", filePath, err)
-	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(names); err != nil {
-		return fmt.Errorf("error encoding JSON file %v: %w", filePath, err)
-	}
-
-	return nil
+	return writeJSONFile(filePath, names)
 }
 
 func (w *Writer) Write(update *sense.RealtimeUpdate) error {
@@ -90,7 +121,7 @@ func (w *Writer) Write(update *sense.RealtimeUpdate) error {
 	// Ensure the main RRD file exists
 	if _, err := os.Stat(mainFilePath); os.IsNotExist(err) {
 		fmt.Printf("%s does not exist; creating\n", mainFilePath)
-		c := rrd.NewCreator(mainFilePath, time.Now().Add(-1*time.Hour), 1)
+		c := rrd.NewCreator(mainFilePath, reportTime.Add(-1*time.Hour), 1)
 		setCreatorParameters(c)
 		/*
 			Voltage:        [122.5346309842862 122.60344311894005]
@@ -139,16 +170,8 @@ func (w *Writer) Write(update *sense.RealtimeUpdate) error {
 		}
 		// Update the active devices file
 		activeFilePath := fmt.Sprintf("%s/%s", w.directory, ActiveFile)
-		file, err := os.Create(activeFilePath)
-		if err != nil {
-			return fmt.Errorf("error creating JSON file %v: %w", activeFilePath, err)
-		}
-		defer file.Close()
-
-		encoder := json.NewEncoder(file)
-		encoder.SetIndent("", "  ")
-		if err := encoder.Encode(active); err != nil {
-			return fmt.Errorf("error encoding JSON file %v: %w", activeFilePath, err)
+		if err := writeJSONFile(activeFilePath, active); err != nil {
+			return err
 		}
 	}
 
@@ -157,7 +180,7 @@ func (w *Writer) Write(update *sense.RealtimeUpdate) error {
 		deviceFilePath := fmt.Sprintf("%s/%s.rrd", w.directory, device.ID)
 		if _, err := os.Stat(deviceFilePath); os.IsNotExist(err) {
 			fmt.Printf("%s does not exist; creating\n", deviceFilePath)
-			c := rrd.NewCreator(deviceFilePath, time.Now().Add(-1*time.Hour), 1)
+			c := rrd.NewCreator(deviceFilePath, reportTime.Add(-1*time.Hour), 1)
 			setCreatorParameters(c)
 			c.DS("w", "GAUGE", Heartbeat, -WMax, WMax)
 			c.DS("i", "GAUGE", Heartbeat, 0, IMax)
@@ -199,6 +222,13 @@ func (w *Writer) Write(update *sense.RealtimeUpdate) error {
 	return nil
 }
 
+// writeJSONFile replaces the file at filePath with value encoded as JSON,
+// atomically, so readers never see a half-written file, even if the process
+// is killed part way through.
+func writeJSONFile(filePath string, value any) error {
+	return atomicfile.WriteJSON(filePath, 0644, value)
+}
+
 func setCreatorParameters(c *rrd.Creator) {
 	// Every second for a week = 604800 seconds
 	c.RRA("AVERAGE", 0.9, 1, 604800)
@@ -0,0 +1,120 @@
+package rrd_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/rrd"
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+// readJSON decodes the JSON file name in directory into value.
+func readJSON(t *testing.T, directory, name string, value any) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(directory, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWriteFromFakeCloud logs a few realtime updates from the fake cloud,
+// as the logger does, and checks the files written.
+func TestWriteFromFakeCloud(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := sense.NewClient(server.ClientOptions()...)
+	if err := client.Login(sensetest.DefaultEmail, sensetest.DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	directory := t.TempDir()
+	w, err := rrd.NewWriter(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := client.GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.UpdateDeviceNames(devices.Devices); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connected := server.Connected()
+	updates := make(chan *sense.RealtimeUpdate)
+	go func() {
+		defer close(updates)
+		for range 3 {
+			update, err := client.GetRealtimeUpdateContext(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			updates <- update
+		}
+	}()
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the realtime feed to connect")
+	}
+	first := time.Now().Add(-3 * time.Second)
+	for i := range 3 {
+		// The fridge is on throughout; the dryer only in the last update.
+		active := []sense.Device{{ID: "d1a2b3c4"}}
+		if i == 2 {
+			active = append(active, sense.Device{ID: "e5f6a7b8"})
+		}
+		if err := server.Send(sensetest.RealtimeUpdate(first.Add(time.Duration(i)*time.Second), i+1, active...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for update := range updates {
+		if err := w.Write(update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{rrd.MainFile, "d1a2b3c4.rrd", "e5f6a7b8.rrd"} {
+		if _, err := os.Stat(filepath.Join(directory, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	names := map[string]string{}
+	readJSON(t, directory, rrd.DeviceFile, &names)
+	if names["d1a2b3c4"] != "Fridge" || names["e5f6a7b8"] != "Dryer" {
+		t.Errorf("got device names %v, want the fridge and dryer named", names)
+	}
+	var active []string
+	readJSON(t, directory, rrd.ActiveFile, &active)
+	slices.Sort(active)
+	if want := []string{"d1a2b3c4", "e5f6a7b8"}; !slices.Equal(active, want) {
+		t.Errorf("got active devices %v, want %v", active, want)
+	}
+}
+
+func TestNewMonitorWriter(t *testing.T) {
+	directory := t.TempDir()
+	if _, err := rrd.NewMonitorWriter(directory, sense.MonitorInfo{ID: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(directory, "42")); err != nil || !info.IsDir() {
+		t.Errorf("got %v, want the monitor's subdirectory created", err)
+	}
+	// The output directory itself must already exist.
+	if _, err := rrd.NewMonitorWriter(filepath.Join(directory, "missing"), sense.MonitorInfo{ID: 42}); err == nil {
+		t.Error("got no error for a missing directory")
+	}
+}
@@ -0,0 +1,71 @@
+// Package sdnotify tells systemd how a service is doing, using the
+// sd_notify protocol: readiness, status text, shutdown and watchdog pings.
+// Outside a systemd service with a notify socket, everything here does
+// nothing.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notify sends state, a newline-separated list of assignments such as
+// "READY=1", to systemd. It reports whether there was a notify socket to send
+// it to.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ready tells systemd that the service has finished starting up, along with
+// a status line.
+func Ready(status string) (bool, error) {
+	return Notify("READY=1\nSTATUS=" + status)
+}
+
+// Status updates the status line systemd shows for the service.
+func Status(status string) (bool, error) {
+	return Notify("STATUS=" + status)
+}
+
+// Stopping tells systemd that the service is shutting down.
+func Stopping() (bool, error) {
+	return Notify("STOPPING=1")
+}
+
+// Watchdog tells systemd that the service is still healthy. It must be sent
+// more often than WatchdogInterval, or systemd will restart the service.
+func Watchdog() (bool, error) {
+	return Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns how often systemd expects watchdog pings, or 0 if
+// the watchdog isn't enabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
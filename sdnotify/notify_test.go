@@ -0,0 +1,107 @@
+package sdnotify_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sdnotify"
+)
+
+// listen listens on a unixgram socket at name, as systemd does, and points
+// NOTIFY_SOCKET at it.
+func listen(t *testing.T, name, env string) *net.UnixConn {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", env)
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn := listen(t, path, path)
+
+	for _, test := range []struct {
+		send func() (bool, error)
+		want string
+	}{
+		{func() (bool, error) { return sdnotify.Ready("logging 1 monitor") }, "READY=1\nSTATUS=logging 1 monitor"},
+		{func() (bool, error) { return sdnotify.Status("reconnecting") }, "STATUS=reconnecting"},
+		{sdnotify.Watchdog, "WATCHDOG=1"},
+		{sdnotify.Stopping, "STOPPING=1"},
+	} {
+		sent, err := test.send()
+		if err != nil || !sent {
+			t.Fatalf("got %v, %v, want the state sent", sent, err)
+		}
+		if got := receive(t, conn); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestNotifyAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux only")
+	}
+	name := fmt.Sprintf("sdnotify-test-%d", os.Getpid())
+	conn := listen(t, "\x00"+name, "@"+name)
+	if sent, err := sdnotify.Notify("READY=1"); err != nil || !sent {
+		t.Fatalf("got %v, %v, want the state sent", sent, err)
+	}
+	if got := receive(t, conn); got != "READY=1" {
+		t.Errorf("got %q, want READY=1", got)
+	}
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := sdnotify.Ready("ready"); sent || err != nil {
+		t.Errorf("got %v, %v, want nothing sent and no error", sent, err)
+	}
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if sent, err := sdnotify.Ready("ready"); sent || err == nil {
+		t.Errorf("got %v, %v, want an error for a missing socket", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, test := range []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", pid, 30 * time.Second},
+		{"30000000", "1", 0},
+		{"0", "", 0},
+		{"soon", "", 0},
+	} {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		if got := sdnotify.WatchdogInterval(); got != test.want {
+			t.Errorf("got %v for WATCHDOG_USEC=%q WATCHDOG_PID=%q, want %v", got, test.usec, test.pid, test.want)
+		}
+	}
+}
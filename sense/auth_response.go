@@ -12,9 +12,11 @@ type AuthResponse struct {
 	BridgeServer string        `json:"bridge_server"` // only in the response from the login endpoint
 	DateCreated  string        `json:"date_created"`  // only in the response from the login endpoint
 	TotpEnabled  bool          `json:"totp_enabled"`
-	Settings     UserSettings  `json:"settings"` // only in the response from the login endpoint
-	Monitors     []MonitorInfo `json:"monitors"` // only in the response from the login endpoint
-	Expires      time.Time     `json:"expires"`  // only in the response from the refresh token endpoint
+	Settings     UserSettings  `json:"settings"`     // only in the response from the login endpoint
+	Monitors     []MonitorInfo `json:"monitors"`     // only in the response from the login endpoint
+	Expires      time.Time     `json:"expires"`      // only in the response from the refresh token endpoint
+	MfaToken     string        `json:"mfa_token"`    // only in a login response challenging for a second factor
+	ErrorReason  string        `json:"error_reason"` // only in failed responses
 }
 
 type UserSettings struct {
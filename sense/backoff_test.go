@@ -0,0 +1,30 @@
+package sense
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	const minDelay, maxDelay = time.Second, time.Minute
+	for _, test := range []struct {
+		failures int
+		base     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{40, time.Minute},
+		{100, time.Minute},
+	} {
+		for range 100 {
+			delay := backoffDelay(minDelay, maxDelay, test.failures)
+			if delay < test.base/2 || delay > test.base {
+				t.Fatalf("got delay %v after %d failures, want between %v and %v",
+					delay, test.failures, test.base/2, test.base)
+			}
+		}
+	}
+}
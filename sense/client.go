@@ -1,12 +1,15 @@
 package sense
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"text/template"
@@ -19,13 +22,18 @@ const (
 	// DefaultHost is the default host for the Sense API
 	ApiHost                = "api.sense.com"
 	WebsocketHost          = "clientrt.sense.com"
-	AuthEndpoint           = "https://" + ApiHost + "/apiservice/api/v1/authenticate"
-	RefreshEndpoint        = "https://" + ApiHost + "/apiservice/api/v1/renew"
-	LabsTemplate           = "https://{{.ApiHost}}/apiservice/api/v1/app/monitors/{{.MonitorID}}/labs_content"
-	DeviceOverviewTemplate = "https://{{.ApiHost}}/apiservice/api/v1/app/monitors/{{.MonitorID}}/devices/overview?" +
+	DefaultApiURL          = "https://" + ApiHost
+	DefaultWebsocketURL    = "wss://" + WebsocketHost
+	AuthPath               = "/apiservice/api/v1/authenticate"
+	RefreshPath            = "/apiservice/api/v1/renew"
+	MfaPath                = "/apiservice/api/v1/authenticate/mfa"
+	AuthEndpoint           = DefaultApiURL + AuthPath
+	RefreshEndpoint        = DefaultApiURL + RefreshPath
+	LabsTemplate           = "{{.ApiURL}}/apiservice/api/v1/app/monitors/{{.MonitorID}}/labs_content"
+	DeviceOverviewTemplate = "{{.ApiURL}}/apiservice/api/v1/app/monitors/{{.MonitorID}}/devices/overview?" +
 		"include_merged={{.IncludeMerged}}"
-	DeviceDetailTemplate = "https://{{.ApiHost}}/apiservice/api/v1/app/monitors/{{.MonitorID}}/devices/{{.DeviceID}}"
-	WebsocketTemplate    = "wss://{{.WebsocketHost}}/monitors/{{.MonitorID}}/realtimefeed?" +
+	DeviceDetailTemplate = "{{.ApiURL}}/apiservice/api/v1/app/monitors/{{.MonitorID}}/devices/{{.DeviceID}}"
+	WebsocketTemplate    = "{{.WebsocketURL}}/monitors/{{.MonitorID}}/realtimefeed?" +
 		"access_token={{.AccessToken}}&" +
 		"sense_device_id={{.DeviceID}}&" +
 		"sense_protocol_version={{.ProtocolVersion}}&" +
@@ -36,7 +44,7 @@ const (
 )
 
 type WebsocketParams struct {
-	WebsocketHost   string
+	WebsocketURL    string
 	MonitorID       int
 	AccessToken     string
 	DeviceID        string
@@ -46,51 +54,91 @@ type WebsocketParams struct {
 }
 
 type DeviceOverviewParams struct {
-	ApiHost       string
+	ApiURL        string
 	MonitorID     int
 	IncludeMerged bool
 }
 
 type DeviceDetailParams struct {
-	ApiHost   string
+	ApiURL    string
 	MonitorID int
 	DeviceID  string
 }
 
 type LabsReportParams struct {
-	ApiHost   string
+	ApiURL    string
 	MonitorID int
 }
 
 var (
 	ErrAuthenticationFailed = fmt.Errorf("authentication failed")
+	ErrMFARequired          = fmt.Errorf("two-factor authentication required but no TOTP source configured")
 	ErrNotAuthenticated     = fmt.Errorf("not authenticated")
+	ErrTokenRejected        = fmt.Errorf("access token rejected")
 	ErrNoDevicesLoaded      = fmt.Errorf("no devices loaded")
 	ErrDeviceNotFound       = fmt.Errorf("device not found")
 	ErrFailedToLoadDevices  = fmt.Errorf("failed to load devices")
+	ErrNoMonitors           = fmt.Errorf("account has no monitors")
+	ErrMonitorNotFound      = fmt.Errorf("monitor not found")
 )
 
 type Client struct {
 	client       *http.Client
+	dialer       *websocket.Dialer
+	apiURL       string
+	websocketURL string
 	clientId     string
-	authResponse *AuthResponse
-	devices      *Devices
+	session      *session
+	monitor      string
+	totp         TOTPFunc
+	tokens       TokenStore
+	handlers     MessageHandlers
+	recorder     FrameRecorder
+	registry     *registry
+	deviceEvents DeviceEventHandler
 	updates      chan *RealtimeUpdate
 	watchdog     *time.Timer
 	conn         *websocket.Conn
 	mu           sync.Mutex
 }
 
-func NewClient() *Client {
-	return &Client{
-		client:   &http.Client{Timeout: 10 * time.Second},
-		clientId: generateRandomClientID(128),
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		client:       &http.Client{Timeout: 10 * time.Second},
+		dialer:       websocket.DefaultDialer,
+		apiURL:       DefaultApiURL,
+		websocketURL: DefaultWebsocketURL,
+		clientId:     generateRandomClientID(128),
+		session:      &session{},
+		registry:     newRegistry(),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 func (c *Client) Login(username, password string) error {
-	form := "email=" + username + "&password=" + password
-	req, err := http.NewRequest("POST", AuthEndpoint, strings.NewReader(form))
+	return c.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext is like Login, but the requests it makes are bound to ctx.
+func (c *Client) LoginContext(ctx context.Context, username, password string) error {
+	if c.tokens != nil {
+		err := c.resume(ctx, username)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errNoStoredToken) && !errors.Is(err, ErrAuthenticationFailed) && !errors.Is(err, ErrTokenRejected) {
+			return err
+		}
+	}
+
+	form := url.Values{
+		"email":    {username},
+		"password": {password},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.apiURL+AuthPath, strings.NewReader(form.Encode()))
 	if err != nil {
 		return err
 	}
@@ -102,28 +150,52 @@ func (c *Client) Login(username, password string) error {
 	}
 	defer resp.Body.Close()
 
-	c.authResponse = &AuthResponse{
+	authResponse := &AuthResponse{
 		Expires: time.Now().Add(defaultTokenExpiry),
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&c.authResponse); err != nil {
+	if err := json.NewDecoder(resp.Body).Decode(authResponse); err != nil {
 		return err
 	}
-	if !c.authResponse.Authorized {
+	if !authResponse.Authorized && authResponse.MfaToken != "" {
+		authResponse, err = c.validateMFA(ctx, authResponse.MfaToken)
+		if err != nil {
+			return err
+		}
+	}
+	c.session.setAuth(authResponse)
+	if !authResponse.Authorized {
 		return ErrAuthenticationFailed
 	}
-	return c.loadDevices()
+	c.session.setUsername(username)
+	c.saveToken(authResponse)
+	return c.loadDevices(ctx)
 }
 
 func (c *Client) Refresh() (until time.Time, err error) {
-	if c.authResponse == nil || !c.authResponse.Authorized {
-		return time.Time{}, ErrNotAuthenticated
+	return c.RefreshContext(context.Background())
+}
+
+// RefreshContext is like Refresh, but the request it makes is bound to ctx.
+func (c *Client) RefreshContext(ctx context.Context) (until time.Time, err error) {
+	// Clients returned by ForMonitor share a session; only one of them may
+	// use the refresh token at a time.
+	c.session.refreshMu.Lock()
+	defer c.session.refreshMu.Unlock()
+	return c.refresh(ctx)
+}
+
+// refresh must be called with c.session.refreshMu held.
+func (c *Client) refresh(ctx context.Context) (until time.Time, err error) {
+	auth, err := c.auth()
+	if err != nil {
+		return time.Time{}, err
 	}
 	form := fmt.Sprintf(
 		"user_id=%d&is_access_token=true&refresh_token=%s",
-		c.authResponse.UserID,
-		c.authResponse.RefreshToken,
+		auth.UserID,
+		auth.RefreshToken,
 	)
-	req, err := http.NewRequest("POST", RefreshEndpoint, strings.NewReader(form))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.apiURL+RefreshPath, strings.NewReader(form))
 	if err != nil {
 		return time.Time{}, err
 	}
@@ -135,22 +207,32 @@ func (c *Client) Refresh() (until time.Time, err error) {
 	}
 	defer resp.Body.Close()
 
-	// We overwrite the authResponse with the new one, leaving any fields not present in the new response as-is
-	c.authResponse.Expires = time.Now().Add(defaultTokenExpiry)
-	if err := json.NewDecoder(resp.Body).Decode(&c.authResponse); err != nil {
+	// A rejected refresh token gets an error body without an "authorized"
+	// field, which would otherwise leave the copy below looking authorized.
+	if resp.StatusCode == http.StatusUnauthorized {
+		return time.Time{}, ErrAuthenticationFailed
+	}
+
+	// We overwrite a copy of the authResponse with the new one, leaving any fields not present in the new response as-is
+	authResponse := *auth
+	authResponse.Expires = time.Now().Add(defaultTokenExpiry)
+	if err := json.NewDecoder(resp.Body).Decode(&authResponse); err != nil {
 		return time.Time{}, err
 	}
-	if !c.authResponse.Authorized {
+	c.session.setAuth(&authResponse)
+	if !authResponse.Authorized {
 		return time.Time{}, ErrAuthenticationFailed
 	}
-	return c.authResponse.Expires, nil
+	c.saveToken(&authResponse)
+	return authResponse.Expires, nil
 }
 
 func (c *Client) TokenExpiry() time.Time {
-	if c.authResponse == nil || !c.authResponse.Authorized {
+	auth, err := c.auth()
+	if err != nil {
 		return time.Time{}
 	}
-	return c.authResponse.Expires
+	return auth.Expires
 }
 
 func (c *Client) Close() error {
@@ -167,14 +249,22 @@ func (c *Client) Close() error {
 	return nil
 }
 
-func (c *Client) loadDevices() error {
-	if c.authResponse == nil || !c.authResponse.Authorized {
-		return ErrNotAuthenticated
+func (c *Client) loadDevices(ctx context.Context) error {
+	// Taken before the monitor is looked up, so that a list loaded for a
+	// monitor that has since been switched away from is dropped.
+	generation := c.registry.currentGeneration()
+	auth, err := c.auth()
+	if err != nil {
+		return err
+	}
+	monitor, err := c.monitorInfo(auth)
+	if err != nil {
+		return err
 	}
 
 	params := DeviceOverviewParams{
-		ApiHost:       ApiHost,
-		MonitorID:     c.authResponse.Monitors[0].ID,
+		ApiURL:        c.apiURL,
+		MonitorID:     monitor.ID,
 		IncludeMerged: true,
 	}
 
@@ -190,11 +280,11 @@ func (c *Client) loadDevices() error {
 
 	DeviceOverviewEndpoint := deviceOverviewEndpointBuilder.String()
 
-	req, err := http.NewRequest("GET", DeviceOverviewEndpoint, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", DeviceOverviewEndpoint, nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", "bearer "+c.authResponse.AccessToken)
+	req.Header.Set("Authorization", "bearer "+auth.AccessToken)
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -202,6 +292,9 @@ func (c *Client) loadDevices() error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%w: %s", ErrTokenRejected, resp.Status)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("%w: %s", ErrFailedToLoadDevices, resp.Status)
 	}
@@ -211,40 +304,66 @@ func (c *Client) loadDevices() error {
 		return err
 	}
 
-	c.devices = &Devices{}
-	if err := json.Unmarshal(bodyBytes, c.devices); err != nil {
+	devices := &Devices{}
+	if err := json.Unmarshal(bodyBytes, devices); err != nil {
 		return err
 	}
 
+	events, ok := c.registry.replace(devices, generation)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	handler := c.deviceEvents
+	c.mu.Unlock()
+	if len(events) > 0 && handler != nil {
+		handler(events, c.registry.snapshot())
+	}
 	return nil
 }
 
+// GetDevices returns a copy of the device list, with the latest realtime
+// readings of every device.
 func (c *Client) GetDevices() (*Devices, error) {
-	if c.devices == nil {
+	devices := c.registry.snapshot()
+	if devices == nil {
 		return nil, ErrNoDevicesLoaded
 	}
-	return c.devices, nil
+	return devices, nil
 }
 
+// GetDeviceByID returns a copy of the device with the given ID, with its
+// latest realtime readings.
 func (c *Client) GetDeviceByID(id string) (*Device, error) {
-	if c.devices == nil {
+	if c.registry.snapshot() == nil {
 		return nil, ErrNoDevicesLoaded
 	}
-	device := c.devices.GetDeviceByID(id)
-	if device == nil {
+	device, ok := c.registry.device(id)
+	if !ok {
 		return nil, ErrDeviceNotFound
 	}
 	return device, nil
 }
 
 func (c *Client) GetDeviceDetails(deviceID string) (*DeviceDetails, error) {
-	if c.authResponse == nil || !c.authResponse.Authorized {
-		return nil, ErrNotAuthenticated
+	return c.GetDeviceDetailsContext(context.Background(), deviceID)
+}
+
+// GetDeviceDetailsContext is like GetDeviceDetails, but the request it makes
+// is bound to ctx.
+func (c *Client) GetDeviceDetailsContext(ctx context.Context, deviceID string) (*DeviceDetails, error) {
+	auth, err := c.auth()
+	if err != nil {
+		return nil, err
+	}
+	monitor, err := c.monitorInfo(auth)
+	if err != nil {
+		return nil, err
 	}
 
 	params := DeviceDetailParams{
-		ApiHost:   ApiHost,
-		MonitorID: c.authResponse.Monitors[0].ID,
+		ApiURL:    c.apiURL,
+		MonitorID: monitor.ID,
 		DeviceID:  deviceID,
 	}
 
@@ -260,11 +379,11 @@ func (c *Client) GetDeviceDetails(deviceID string) (*DeviceDetails, error) {
 
 	deviceDetailEndpoint := deviceDetailEndpointBuilder.String()
 
-	req, err := http.NewRequest("GET", deviceDetailEndpoint, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", deviceDetailEndpoint, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "bearer "+c.authResponse.AccessToken)
+	req.Header.Set("Authorization", "bearer "+auth.AccessToken)
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -272,6 +391,9 @@ func (c *Client) GetDeviceDetails(deviceID string) (*DeviceDetails, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%w: %s", ErrTokenRejected, resp.Status)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("failed to fetch device details: %s", resp.Status)
 	}
@@ -290,51 +412,62 @@ func (c *Client) GetDeviceDetails(deviceID string) (*DeviceDetails, error) {
 }
 
 func (c *Client) GetRealtimeUpdate() (*RealtimeUpdate, error) {
-	if c.authResponse == nil || !c.authResponse.Authorized {
-		return nil, ErrNotAuthenticated
+	return c.GetRealtimeUpdateContext(context.Background())
+}
+
+// GetRealtimeUpdateContext is like GetRealtimeUpdate, but gives up and returns
+// ctx.Err() if ctx is done before the websocket is connected or before the
+// next update arrives. The websocket is left open in the latter case.
+func (c *Client) GetRealtimeUpdateContext(ctx context.Context) (*RealtimeUpdate, error) {
+	if _, err := c.auth(); err != nil {
+		return nil, err
 	}
-	c.mu.Lock()
-	if c.conn == nil {
-		if err := c.startRealtimeUpdates(); err != nil {
-			c.mu.Unlock()
-			return nil, err
-		}
-		c.watchdog = time.AfterFunc(watchdogInterval, func() { c.Close() })
+	updates, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var update *RealtimeUpdate
+	select {
+	case update = <-updates:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	c.mu.Unlock()
-	update := <-c.updates
 	if update == nil {
 		return nil, io.EOF
 	}
-	for i := range update.Payload.Devices {
-		if update.Payload.Devices[i].ID == "" {
-			continue
-		}
-		device, err := c.GetDeviceByID(update.Payload.Devices[i].ID)
-		if err != nil {
-			continue
-		}
-		// Update the device with the latest data from the realtime update
-		device.Attrs = update.Payload.Devices[i].Attrs
-		device.Watts = update.Payload.Devices[i].Watts
-		device.Cirumference = update.Payload.Devices[i].Cirumference
-		device.StatusDetails = update.Payload.Devices[i].StatusDetails
-		device.AlwaysOnState = update.Payload.Devices[i].AlwaysOnState
-		device.AlwaysOnWatts = update.Payload.Devices[i].AlwaysOnWatts
-		update.Payload.Devices[i] = *device
-	}
-
+	c.mergeDevices(update)
 	return update, nil
 }
 
+// mergeDevices fills in the devices in a realtime update, which only carry
+// their ID and current readings, with the rest of their details from the
+// device list, and records the readings in the list. A device that isn't on
+// the list yet has it reloaded.
+func (c *Client) mergeDevices(update *RealtimeUpdate) {
+	if c.registry.merge(update) {
+		c.reloadDevicesIfChanged("")
+	}
+}
+
 func (c *Client) GetLabsReport() (*LabsReport, error) {
-	if c.authResponse == nil || !c.authResponse.Authorized {
-		return nil, ErrNotAuthenticated
+	return c.GetLabsReportContext(context.Background())
+}
+
+// GetLabsReportContext is like GetLabsReport, but the request it makes is
+// bound to ctx.
+func (c *Client) GetLabsReportContext(ctx context.Context) (*LabsReport, error) {
+	auth, err := c.auth()
+	if err != nil {
+		return nil, err
+	}
+	monitor, err := c.monitorInfo(auth)
+	if err != nil {
+		return nil, err
 	}
 
 	params := LabsReportParams{
-		ApiHost:   ApiHost,
-		MonitorID: c.authResponse.Monitors[0].ID,
+		ApiURL:    c.apiURL,
+		MonitorID: monitor.ID,
 	}
 
 	tmpl, err := template.New("labsReportEndpoint").Parse(LabsTemplate)
@@ -349,11 +482,11 @@ func (c *Client) GetLabsReport() (*LabsReport, error) {
 
 	labsReportEndpoint := labsReportEndpointBuilder.String()
 
-	req, err := http.NewRequest("GET", labsReportEndpoint, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", labsReportEndpoint, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "bearer "+c.authResponse.AccessToken)
+	req.Header.Set("Authorization", "bearer "+auth.AccessToken)
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -361,6 +494,9 @@ func (c *Client) GetLabsReport() (*LabsReport, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%w: %s", ErrTokenRejected, resp.Status)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("failed to fetch labs report: %s", resp.Status)
 	}
@@ -378,17 +514,34 @@ func (c *Client) GetLabsReport() (*LabsReport, error) {
 	return labsReport, nil
 }
 
-func (c *Client) startRealtimeUpdates() error {
-	if c.authResponse == nil || !c.authResponse.Authorized {
-		return ErrNotAuthenticated
+// connect opens the realtime websocket if it isn't already open, and returns
+// the channel its updates are delivered on.
+func (c *Client) connect(ctx context.Context) (chan *RealtimeUpdate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.startRealtimeUpdates(ctx); err != nil {
+			return nil, err
+		}
 	}
+	return c.updates, nil
+}
 
-	c.updates = make(chan *RealtimeUpdate, 1024)
+// startRealtimeUpdates must be called with c.mu held.
+func (c *Client) startRealtimeUpdates(ctx context.Context) error {
+	auth, err := c.auth()
+	if err != nil {
+		return err
+	}
+	monitor, err := selectedMonitor(auth.Monitors, c.monitor)
+	if err != nil {
+		return err
+	}
 
 	params := WebsocketParams{
-		WebsocketHost:   WebsocketHost,
-		MonitorID:       c.authResponse.Monitors[0].ID,
-		AccessToken:     c.authResponse.AccessToken,
+		WebsocketURL:    c.websocketURL,
+		MonitorID:       monitor.ID,
+		AccessToken:     auth.AccessToken,
 		DeviceID:        c.clientId,
 		ProtocolVersion: 11,
 		ClientType:      "web",
@@ -406,17 +559,31 @@ func (c *Client) startRealtimeUpdates() error {
 	}
 
 	websocketURI := websocketURIBuilder.String()
-	c.conn, _, err = websocket.DefaultDialer.Dial(websocketURI, nil)
+	conn, resp, err := c.dialer.DialContext(ctx, websocketURI, nil)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("failed to connect to WebSocket: %w: %s", ErrTokenRejected, resp.Status)
+		}
 		return fmt.Errorf("failed to connect to WebSocket: %w", err)
 	}
 
+	// The goroutine below works on its own copies of the connection state, so
+	// that a reconnect can't leave it touching a newer connection. The
+	// watchdog is armed before the goroutine starts so that a feed which
+	// stalls immediately is still torn down.
+	updates := make(chan *RealtimeUpdate, 1024)
+	watchdog := time.AfterFunc(watchdogInterval, func() { conn.Close() })
+	c.conn = conn
+	c.updates = updates
+	c.watchdog = watchdog
+
 	go func() {
 		defer func() {
+			watchdog.Stop()
 			c.mu.Lock()
-			close(c.updates)
-			if c.conn != nil {
-				c.conn.Close()
+			close(updates)
+			conn.Close()
+			if c.conn == conn {
 				c.conn = nil
 			}
 			c.mu.Unlock()
@@ -424,37 +591,49 @@ func (c *Client) startRealtimeUpdates() error {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Printf("WebSocket goroutine panicked: %v\n", r)
-				c.mu.Lock()
-				c.conn = nil
-				c.mu.Unlock()
-				return
 			}
 		}()
 		for {
-			_, message, err := c.conn.ReadMessage()
+			_, message, err := conn.ReadMessage()
 			if err != nil {
-				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				// Close clears c.conn before closing it, so an error
+				// caused by Close isn't worth reporting.
+				c.mu.Lock()
+				closed := c.conn != conn
+				c.mu.Unlock()
+				if !closed && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
 					log.Printf("WebSocket read error: %v\n", err)
 				}
 				return
 			}
+			if c.recorder != nil {
+				c.recorder.RecordFrame(monitor.ID, time.Now(), message)
+			}
 
-			update := &RealtimeUpdate{}
-			if err := json.Unmarshal(message, update); err != nil {
+			msg := &Message{}
+			if err := json.Unmarshal(message, msg); err != nil {
 				log.Printf("Failed to unmarshal WebSocket message: %v\n", err)
 				continue
 			}
 
-			if update.Type != "realtime_update" {
-				log.Printf("Unexpected WebSocket message type: %s\n", update.Type)
+			if msg.Type != MessageRealtimeUpdate {
+				if err := c.handleMessage(msg); err != nil {
+					log.Printf("Failed to unmarshal %s message: %v\n", msg.Type, err)
+				}
+				continue
+			}
+
+			update, err := msg.RealtimeUpdate()
+			if err != nil {
+				log.Printf("Failed to unmarshal WebSocket message: %v\n", err)
 				continue
 			}
 
 			if len(update.Payload.Devices) > 0 {
-				c.watchdog.Reset(watchdogInterval)
+				watchdog.Reset(watchdogInterval)
 			}
 
-			c.updates <- update
+			updates <- update
 		}
 	}()
 
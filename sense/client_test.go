@@ -0,0 +1,536 @@
+package sense_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+const timeout = 5 * time.Second
+
+func login(t *testing.T, server *sensetest.Server) *sense.Client {
+	t.Helper()
+	client := sense.NewClient(server.ClientOptions()...)
+	if err := client.Login(sensetest.DefaultEmail, sensetest.DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// runStream runs a Stream for client until the test ends, and returns a
+// subscription to it.
+func runStream(t *testing.T, client *sense.Client) (*sense.Stream, *sense.Subscription) {
+	t.Helper()
+	return runStreamConfig(t, client, sense.StreamConfig{})
+}
+
+// runStreamConfig is like runStream, but uses the given config, with short
+// backoff delays unless it sets its own.
+func runStreamConfig(t *testing.T, client *sense.Client, config sense.StreamConfig) (*sense.Stream, *sense.Subscription) {
+	t.Helper()
+	if config.MinBackoff == 0 {
+		config.MinBackoff = 10 * time.Millisecond
+		config.MaxBackoff = 50 * time.Millisecond
+	}
+	stream := client.NewStream(config)
+	sub := stream.Subscribe(sense.SubscribeOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- stream.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v, want %v", err, context.Canceled)
+		}
+	})
+	return stream, sub
+}
+
+func waitConnected(t *testing.T, connected <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-connected:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the realtime feed to connect")
+	}
+}
+
+// receive returns the next realtime update from client, reconnecting if
+// the websocket has closed. It gives up when the test ends.
+func receive(t *testing.T, client *sense.Client) <-chan *sense.RealtimeUpdate {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	updates := make(chan *sense.RealtimeUpdate, 1)
+	go func() {
+		for {
+			update, err := client.GetRealtimeUpdateContext(ctx)
+			if errors.Is(err, io.EOF) {
+				continue
+			}
+			updates <- update
+			return
+		}
+	}()
+	return updates
+}
+
+// send sends a realtime update with the given frame number, and waits for it
+// to arrive on updates.
+func send(t *testing.T, server *sensetest.Server, updates <-chan *sense.RealtimeUpdate, frame int) *sense.RealtimeUpdate {
+	t.Helper()
+	fridge := sense.Device{ID: "d1a2b3c4"}
+	if err := server.Send(sensetest.RealtimeUpdate(time.Now(), frame, fridge)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case update, ok := <-updates:
+		if !ok || update == nil {
+			t.Fatalf("got no update, want frame %d", frame)
+		}
+		if update.Payload.FrameNumber != frame {
+			t.Fatalf("got frame %d, want %d", update.Payload.FrameNumber, frame)
+		}
+		return update
+	case <-time.After(timeout):
+		t.Fatalf("timed out waiting for frame %d", frame)
+	}
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	devices, err := client.GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(devices.Devices); n != 4 {
+		t.Errorf("got %d devices, want 4", n)
+	}
+	device, err := client.GetDeviceByID("d1a2b3c4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Name != "Fridge" {
+		t.Errorf("got device name %q, want %q", device.Name, "Fridge")
+	}
+	if _, err := client.GetDeviceByID("nonexistent"); !errors.Is(err, sense.ErrDeviceNotFound) {
+		t.Errorf("got error %v, want %v", err, sense.ErrDeviceNotFound)
+	}
+}
+
+func TestLoginFailure(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+
+	client := sense.NewClient(server.ClientOptions()...)
+	if err := client.Login(sensetest.DefaultEmail, "wrong"); !errors.Is(err, sense.ErrAuthenticationFailed) {
+		t.Errorf("got error %v with the wrong password, want %v", err, sense.ErrAuthenticationFailed)
+	}
+	server.FailAuth(true)
+	if err := client.Login(sensetest.DefaultEmail, sensetest.DefaultPassword); !errors.Is(err, sense.ErrAuthenticationFailed) {
+		t.Errorf("got error %v while logins fail, want %v", err, sense.ErrAuthenticationFailed)
+	}
+	if _, err := client.GetDevices(); err == nil {
+		t.Error("got devices without logging in")
+	}
+}
+
+func TestLoginEscapesCredentials(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	// Characters with a meaning of their own in a form.
+	const email, password = "a+b@example.com", "p&ss=w+rd%20 ok"
+	server.SetCredentials(email, password)
+
+	client := sense.NewClient(server.ClientOptions()...)
+	if err := client.Login(email, password); err != nil {
+		t.Fatalf("got %v logging in with %q, want no error", err, password)
+	}
+}
+
+func TestRefreshExpiredToken(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	server.ExpireAccessToken()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := client.GetRealtimeUpdateContext(ctx); !errors.Is(err, sense.ErrTokenRejected) {
+		t.Fatalf("got error %v with an expired token, want %v", err, sense.ErrTokenRejected)
+	}
+	if _, err := client.RefreshContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	connected := server.Connected()
+	updates := make(chan *sense.RealtimeUpdate)
+	go func() {
+		update, err := client.GetRealtimeUpdateContext(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		updates <- update
+	}()
+	waitConnected(t, connected)
+	if err := server.Send(sensetest.RealtimeUpdate(time.Now(), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if update := <-updates; update == nil || update.Payload.FrameNumber != 1 {
+		t.Errorf("got update %v after refreshing, want frame 1", update)
+	}
+}
+
+func TestReconnectAfterDrop(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	connected := server.Connected()
+	updates := receive(t, client)
+	waitConnected(t, connected)
+	send(t, server, updates, 1)
+
+	// The drop ends the updates with io.EOF, and the next call reconnects.
+	connected = server.Connected()
+	server.DropConnections()
+	updates = receive(t, client)
+	waitConnected(t, connected)
+	send(t, server, updates, 2)
+}
+
+func TestSkipsMalformedFrames(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	connected := server.Connected()
+	updates := receive(t, client)
+	waitConnected(t, connected)
+	for _, frame := range []string{
+		`not json`,
+		`{"type":"realtime_update","payload":"not an object"}`,
+		`{"type":"realtime_update","payload":{"frame":"not a number"}}`,
+	} {
+		if err := server.SendRaw([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the good frame comes through, on the same connection.
+	send(t, server, updates, 1)
+	if n := server.RequestCount("/monitors/1/realtimefeed"); n != 1 {
+		t.Errorf("got %d connections, want 1", n)
+	}
+}
+
+func TestStreamRenewsExpiredToken(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	server.ExpireAccessToken()
+	connected := server.Connected()
+	_, sub := runStream(t, client)
+	waitConnected(t, connected)
+	send(t, server, sub.Updates(), 1)
+	if n := server.RequestCount(sense.RefreshPath); n != 1 {
+		t.Errorf("got %d refreshes, want 1", n)
+	}
+}
+
+func TestStreamReconnectsAfterDrop(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	connected := server.Connected()
+	stream, sub := runStream(t, client)
+	waitConnected(t, connected)
+	send(t, server, sub.Updates(), 1)
+
+	connected = server.Connected()
+	server.DropConnections()
+	waitConnected(t, connected)
+	send(t, server, sub.Updates(), 2)
+	if state, _ := stream.State(); state != sense.StreamConnected {
+		t.Errorf("got state %v after reconnecting, want %v", state, sense.StreamConnected)
+	}
+}
+
+func TestStreamSkipsMalformedFrames(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	connected := server.Connected()
+	_, sub := runStream(t, client)
+	waitConnected(t, connected)
+
+	for _, frame := range []string{
+		`not json`,
+		`{"type":"realtime_update","payload":"not an object"}`,
+		`{"type":"realtime_update","payload":{"frame":"not a number"}}`,
+		`{"type":"hello","payload":[]}`,
+	} {
+		if err := server.SendRaw([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the good frame comes through, on the same connection.
+	send(t, server, sub.Updates(), 1)
+	if n := server.RequestCount("/monitors/1/realtimefeed"); n != 1 {
+		t.Errorf("got %d connections, want 1", n)
+	}
+}
+
+// stateRecorder collects the states a Stream reports to OnStateChange.
+type stateRecorder struct {
+	mu     sync.Mutex
+	states []sense.StreamState
+}
+
+func (r *stateRecorder) record(state sense.StreamState, err error) {
+	r.mu.Lock()
+	r.states = append(r.states, state)
+	r.mu.Unlock()
+}
+
+func (r *stateRecorder) count(state sense.StreamState) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, s := range r.states {
+		if s == state {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStreamStateChanges(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	var recorder stateRecorder
+	connected := server.Connected()
+	_, sub := runStreamConfig(t, client, sense.StreamConfig{OnStateChange: recorder.record})
+	waitConnected(t, connected)
+	send(t, server, sub.Updates(), 1)
+
+	connected = server.Connected()
+	server.DropConnections()
+	waitConnected(t, connected)
+	send(t, server, sub.Updates(), 2)
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	want := []sense.StreamState{
+		sense.StreamConnecting, sense.StreamConnected,
+		sense.StreamWaiting,
+		sense.StreamConnecting, sense.StreamConnected,
+	}
+	if len(recorder.states) != len(want) {
+		t.Fatalf("got states %v, want %v", recorder.states, want)
+	}
+	for i := range want {
+		if recorder.states[i] != want[i] {
+			t.Fatalf("got states %v, want %v", recorder.states, want)
+		}
+	}
+}
+
+func TestStreamLogsInWhenRefreshRejected(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	server.ExpireAccessToken()
+	server.RejectRefresh(true)
+	logins := 0
+	connected := server.Connected()
+	_, sub := runStreamConfig(t, client, sense.StreamConfig{
+		Login: func(ctx context.Context) error {
+			logins++
+			return client.LoginContext(ctx, sensetest.DefaultEmail, sensetest.DefaultPassword)
+		},
+	})
+	waitConnected(t, connected)
+	send(t, server, sub.Updates(), 1)
+	if logins != 1 {
+		t.Errorf("got %d logins, want 1", logins)
+	}
+}
+
+func TestStreamStopsWhenRefreshRejected(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	server.ExpireAccessToken()
+	server.RejectRefresh(true)
+	stream := client.NewStream(sense.StreamConfig{MinBackoff: 10 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := stream.Run(ctx); !errors.Is(err, sense.ErrAuthenticationFailed) {
+		t.Errorf("Run returned %v without a Login func, want %v", err, sense.ErrAuthenticationFailed)
+	}
+	if state, _ := stream.State(); state != sense.StreamStopped {
+		t.Errorf("got state %v, want %v", state, sense.StreamStopped)
+	}
+}
+
+func TestStreamRefreshesBeforeExpiry(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	// Tokens live for 24 hours, so this refreshes 200ms after each one is
+	// issued, and reconnects with the new token.
+	var recorder stateRecorder
+	runStreamConfig(t, client, sense.StreamConfig{
+		RefreshMargin:      24*time.Hour - 200*time.Millisecond,
+		MinRefreshInterval: 10 * time.Millisecond,
+		OnStateChange:      recorder.record,
+	})
+	deadline := time.Now().Add(timeout)
+	for server.RequestCount(sense.RefreshPath) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the token to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := server.RequestCount("/monitors/1/realtimefeed"); n < 2 {
+		t.Errorf("got %d connections, want at least 2", n)
+	}
+	if n := recorder.count(sense.StreamRefreshing); n < 2 {
+		t.Errorf("got %d refreshing states, want at least 2", n)
+	}
+	if n := recorder.count(sense.StreamWaiting); n != 0 {
+		t.Errorf("got %d waiting states, want none", n)
+	}
+}
+
+func TestStreamRefreshIsRateLimited(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	// Every token expires within the margin as soon as it is issued. It is
+	// refreshed on connecting, but not again within MinRefreshInterval.
+	connected := server.Connected()
+	_, sub := runStreamConfig(t, client, sense.StreamConfig{
+		RefreshMargin:      25 * time.Hour,
+		MinRefreshInterval: time.Hour,
+	})
+	waitConnected(t, connected)
+	send(t, server, sub.Updates(), 1)
+	time.Sleep(200 * time.Millisecond)
+	send(t, server, sub.Updates(), 2)
+	if n := server.RequestCount(sense.RefreshPath); n != 1 {
+		t.Errorf("got %d refreshes, want 1", n)
+	}
+	if n := server.RequestCount("/monitors/1/realtimefeed"); n != 1 {
+		t.Errorf("got %d connections, want 1", n)
+	}
+}
+
+func TestReconnectAfterClose(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	connected := server.Connected()
+	updates := receive(t, client)
+	waitConnected(t, connected)
+	send(t, server, updates, 1)
+
+	// A normal close ends the updates just as a drop does.
+	connected = server.Connected()
+	server.CloseConnections()
+	updates = receive(t, client)
+	waitConnected(t, connected)
+	send(t, server, updates, 2)
+}
+
+func TestStreamReconnectsAfterClose(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	connected := server.Connected()
+	stream, sub := runStream(t, client)
+	waitConnected(t, connected)
+	send(t, server, sub.Updates(), 1)
+
+	// Sense closing the feed normally doesn't stop the stream.
+	connected = server.Connected()
+	server.CloseConnections()
+	waitConnected(t, connected)
+	send(t, server, sub.Updates(), 2)
+	if state, _ := stream.State(); state != sense.StreamConnected {
+		t.Errorf("got state %v after reconnecting, want %v", state, sense.StreamConnected)
+	}
+	if n := server.RequestCount("/monitors/1/realtimefeed"); n != 2 {
+		t.Errorf("got %d connections, want 2", n)
+	}
+}
+
+func TestGetDeviceDetails(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	notes := "Replaced in 2023"
+	server.SetDeviceDetails("d1a2b3c4", &sense.DeviceDetails{
+		Device: sense.Device{ID: "d1a2b3c4", Name: "Fridge"},
+		Notes:  &notes,
+		Usage:  sense.Usage{AvgWatts: 150, CurrentMonthRuns: 42},
+	})
+	details, err := client.GetDeviceDetails("d1a2b3c4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Device.Name != "Fridge" || details.Notes == nil || *details.Notes != notes ||
+		details.Usage.AvgWatts != 150 || details.Usage.CurrentMonthRuns != 42 {
+		t.Errorf("got details %+v, want the fridge's", details)
+	}
+	if n := server.RequestCount("/apiservice/api/v1/app/monitors/1/devices/d1a2b3c4"); n != 1 {
+		t.Errorf("got %d requests for the details, want 1", n)
+	}
+
+	if _, err := client.GetDeviceDetails("nonexistent"); err == nil {
+		t.Error("got no error for an unknown device")
+	}
+}
+
+func TestGetLabsReport(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	report := &sense.LabsReport{MotorStallRawCSV: "time,watts\n"}
+	report.FaultDetectionJSON.PowerQuality.DisplaySupport = true
+	report.FaultDetectionJSON.PowerQuality.Data.Latest = map[string]sense.VoltageData{
+		"2024-03-01": {V0: 121.5, V1: 119.8},
+	}
+	server.SetLabsReport(report)
+	got, err := client.GetLabsReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	quality := got.FaultDetectionJSON.PowerQuality
+	if !quality.DisplaySupport || quality.Data.Latest["2024-03-01"].V0 != 121.5 || got.MotorStallRawCSV != report.MotorStallRawCSV {
+		t.Errorf("got report %+v, want the one set", got)
+	}
+}
@@ -121,11 +121,35 @@ type PeerName struct {
 }
 
 // GetDeviceByID returns the device with the given ID, or nil if not found.
+// The device is the one in the list, not a copy.
 func (d *Devices) GetDeviceByID(id string) *Device {
-	for _, device := range d.Devices {
-		if device.ID == id {
-			return &device
+	for i := range d.Devices {
+		if d.Devices[i].ID == id {
+			return &d.Devices[i]
 		}
 	}
 	return nil
 }
+
+// MergeRealtimeUpdate fills in the devices in a realtime update, which only
+// carry their ID and current readings, with the rest of their details from
+// this device list.
+func (d *Devices) MergeRealtimeUpdate(update *RealtimeUpdate) {
+	for i := range update.Payload.Devices {
+		if update.Payload.Devices[i].ID == "" {
+			continue
+		}
+		device := d.GetDeviceByID(update.Payload.Devices[i].ID)
+		if device == nil {
+			continue
+		}
+		// Update the device with the latest data from the realtime update
+		device.Attrs = update.Payload.Devices[i].Attrs
+		device.Watts = update.Payload.Devices[i].Watts
+		device.Cirumference = update.Payload.Devices[i].Cirumference
+		device.StatusDetails = update.Payload.Devices[i].StatusDetails
+		device.AlwaysOnState = update.Payload.Devices[i].AlwaysOnState
+		device.AlwaysOnWatts = update.Payload.Devices[i].AlwaysOnWatts
+		update.Payload.Devices[i] = *device
+	}
+}
@@ -0,0 +1,77 @@
+package sense_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+func TestDevicesGetDeviceByID(t *testing.T) {
+	devices := sensetest.DefaultDevices()
+	fridge := devices.GetDeviceByID("d1a2b3c4")
+	if fridge == nil || fridge.Name != "Fridge" {
+		t.Fatalf("got %+v, want the fridge", fridge)
+	}
+	// The device returned is the one in the list, so changes to it stick.
+	fridge.Name = "Kitchen Fridge"
+	if devices.Devices[2].Name != "Kitchen Fridge" {
+		t.Errorf("got %q in the list, want the change made through GetDeviceByID", devices.Devices[2].Name)
+	}
+	if devices.GetDeviceByID("nonexistent") != nil {
+		t.Error("got a device for an unknown ID")
+	}
+
+	watts := 150.0
+	update := sensetest.RealtimeUpdate(time.Now(), 1, sense.Device{ID: "e5f6a7b8", Watts: &watts})
+	devices.MergeRealtimeUpdate(update)
+	if dryer := devices.GetDeviceByID("e5f6a7b8"); dryer.Watts == nil || *dryer.Watts != watts {
+		t.Errorf("got dryer %+v, want the update's reading merged into the list", dryer)
+	}
+}
+
+func TestReloadOnDataChange(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+	events := make(chan []sense.DeviceEvent, 1)
+	client.SetDeviceEventHandler(func(e []sense.DeviceEvent, devices *sense.Devices) {
+		events <- e
+	})
+	const overview = "/apiservice/api/v1/app/monitors/1/devices/overview"
+	loads := server.RequestCount(overview)
+
+	connected := server.Connected()
+	_, sub := runStream(t, client)
+	waitConnected(t, connected)
+
+	// An unchanged checksum doesn't reload the list.
+	if err := server.Send(map[string]any{"type": "data_change", "payload": map[string]any{"device_data_checksum": "checksum-1"}}); err != nil {
+		t.Fatal(err)
+	}
+	send(t, server, sub.Updates(), 1)
+	if n := server.RequestCount(overview); n != loads {
+		t.Errorf("got %d device list loads after an unchanged checksum, want %d", n, loads)
+	}
+
+	devices := sensetest.DefaultDevices()
+	devices.Devices[2].Name = "Kitchen Fridge"
+	devices.Devices = append(devices.Devices[:3], sense.Device{ID: "f9e8d7c6", Name: "Heat Pump"})
+	devices.DeviceDataChecksum = "checksum-2"
+	server.SetDevices(1, devices)
+	if err := server.Send(map[string]any{"type": "data_change", "payload": map[string]any{"device_data_checksum": "checksum-2"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if len(e) != 3 || e[0].Type != sense.DeviceRenamed || e[1].Type != sense.DeviceAdded || e[2].Type != sense.DeviceRemoved {
+			t.Errorf("got events %+v, want the fridge renamed, the heat pump added and the dryer removed", e)
+		}
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the device list to reload")
+	}
+	if device, err := client.GetDeviceByID("f9e8d7c6"); err != nil || device.Name != "Heat Pump" {
+		t.Errorf("got %+v, %v, want the heat pump", device, err)
+	}
+}
@@ -0,0 +1,175 @@
+package sense
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Message types sent on the realtime feed.
+const (
+	MessageHello            = "hello"
+	MessageMonitorInfo      = "monitor_info"
+	MessageDeviceStates     = "device_states"
+	MessageDataChange       = "data_change"
+	MessageNewTimelineEvent = "new_timeline_event"
+	MessageRealtimeUpdate   = "realtime_update"
+)
+
+// Message is the envelope every realtime feed message arrives in.
+type Message struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// RealtimeUpdate decodes a message of type MessageRealtimeUpdate.
+func (m *Message) RealtimeUpdate() (*RealtimeUpdate, error) {
+	update := &RealtimeUpdate{Type: m.Type}
+	if err := json.Unmarshal(m.Payload, &update.Payload); err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// HelloPayload is sent once when the feed connects.
+type HelloPayload struct {
+	Online bool `json:"online"`
+}
+
+// MonitorInfoPayload describes the monitor the feed belongs to.
+type MonitorInfoPayload struct {
+	Features string `json:"features"`
+}
+
+// DeviceStatesPayload reports the state of some or all devices.
+type DeviceStatesPayload struct {
+	States     []DeviceState `json:"states"`
+	UpdateType string        `json:"update_type"`
+}
+
+type DeviceState struct {
+	DeviceID string `json:"device_id"`
+	Mode     string `json:"mode"`
+	State    string `json:"state"`
+}
+
+// DataChangePayload announces that data held by the server has changed; in
+// particular, a new DeviceDataChecksum means the device list (as returned by
+// the devices/overview endpoint) has changed.
+type DataChangePayload struct {
+	DeviceDataChecksum      string         `json:"device_data_checksum"`
+	MonitorOverviewChecksum string         `json:"monitor_overview_checksum"`
+	PartnerChecksum         string         `json:"partner_checksum"`
+	PendingEvents           map[string]any `json:"pending_events"`
+	SettingsVersion         int            `json:"settings_version"`
+	UserVersion             int            `json:"user_version"`
+}
+
+// NewTimelineEventPayload lists timeline items (such as a device turning on or
+// off) that have been added, updated or removed.
+type NewTimelineEventPayload struct {
+	ItemsAdded   []TimelineItem `json:"items_added"`
+	ItemsUpdated []TimelineItem `json:"items_updated"`
+	ItemsRemoved []TimelineItem `json:"items_removed"`
+}
+
+type TimelineItem struct {
+	Time                      time.Time `json:"time"`
+	Type                      string    `json:"type"`
+	Icon                      string    `json:"icon"`
+	Body                      string    `json:"body"`
+	DeviceID                  string    `json:"device_id"`
+	DeviceState               string    `json:"device_state"`
+	DeviceTransitionFromState string    `json:"device_transition_from_state"`
+	UserDeviceType            string    `json:"user_device_type"`
+	ShowAction                bool      `json:"show_action"`
+	Guid                      string    `json:"guid"`
+}
+
+// MessageHandlers are called as messages other than realtime updates arrive
+// on the feed. They are called from the goroutine reading the websocket, so
+// they must not block. Any of them may be nil.
+type MessageHandlers struct {
+	Hello            func(*HelloPayload)
+	MonitorInfo      func(*MonitorInfoPayload)
+	DeviceStates     func(*DeviceStatesPayload)
+	DataChange       func(*DataChangePayload)
+	NewTimelineEvent func(*NewTimelineEventPayload)
+	// Other is called with messages of any other type.
+	Other func(*Message)
+}
+
+// FrameRecorder is given every raw message read from the realtime feed,
+// before it is decoded, along with the ID of the monitor it came from and the
+// time it was received. It is called from the goroutine reading the
+// websocket, so it must not block.
+type FrameRecorder interface {
+	RecordFrame(monitorID int, received time.Time, message []byte)
+}
+
+// WithFrameRecorder sets a FrameRecorder for the realtime feed. Clients
+// returned by ForMonitor inherit it.
+func WithFrameRecorder(recorder FrameRecorder) Option {
+	return func(c *Client) {
+		c.recorder = recorder
+	}
+}
+
+// WithMessageHandlers sets the handlers for messages other than realtime
+// updates. Clients returned by ForMonitor inherit them.
+func WithMessageHandlers(handlers MessageHandlers) Option {
+	return func(c *Client) {
+		c.handlers = handlers
+	}
+}
+
+// SetMessageHandlers replaces the handlers for messages other than realtime
+// updates.
+func (c *Client) SetMessageHandlers(handlers MessageHandlers) {
+	c.mu.Lock()
+	c.handlers = handlers
+	c.mu.Unlock()
+}
+
+// handleMessage decodes msg and passes it to the matching handler.
+func (c *Client) handleMessage(msg *Message) error {
+	c.mu.Lock()
+	handlers := c.handlers
+	c.mu.Unlock()
+
+	switch msg.Type {
+	case MessageHello:
+		return dispatch(msg, handlers.Hello)
+	case MessageMonitorInfo:
+		return dispatch(msg, handlers.MonitorInfo)
+	case MessageDeviceStates:
+		return dispatch(msg, handlers.DeviceStates)
+	case MessageDataChange:
+		// A new device checksum means the device list has changed.
+		payload := &DataChangePayload{}
+		if err := json.Unmarshal(msg.Payload, payload); err != nil {
+			return err
+		}
+		if payload.DeviceDataChecksum != "" {
+			c.reloadDevicesIfChanged(payload.DeviceDataChecksum)
+		}
+		return dispatch(msg, handlers.DataChange)
+	case MessageNewTimelineEvent:
+		return dispatch(msg, handlers.NewTimelineEvent)
+	}
+	if handlers.Other != nil {
+		handlers.Other(msg)
+	}
+	return nil
+}
+
+func dispatch[T any](msg *Message, handler func(*T)) error {
+	if handler == nil {
+		return nil
+	}
+	payload := new(T)
+	if err := json.Unmarshal(msg.Payload, payload); err != nil {
+		return err
+	}
+	handler(payload)
+	return nil
+}
@@ -0,0 +1,91 @@
+package sense_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+func TestMessageHandlers(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+
+	got := make(chan string, 10)
+	client := sense.NewClient(append(server.ClientOptions(), sense.WithMessageHandlers(sense.MessageHandlers{
+		Hello: func(p *sense.HelloPayload) {
+			if p.Online {
+				got <- sense.MessageHello
+			}
+		},
+		MonitorInfo: func(p *sense.MonitorInfoPayload) {
+			got <- sense.MessageMonitorInfo + ":" + p.Features
+		},
+		DeviceStates: func(p *sense.DeviceStatesPayload) {
+			if len(p.States) == 1 {
+				got <- sense.MessageDeviceStates + ":" + p.States[0].DeviceID + "=" + p.States[0].State
+			}
+		},
+		DataChange: func(p *sense.DataChangePayload) {
+			got <- sense.MessageDataChange + ":" + p.DeviceDataChecksum
+		},
+		NewTimelineEvent: func(p *sense.NewTimelineEventPayload) {
+			if len(p.ItemsAdded) == 1 {
+				got <- sense.MessageNewTimelineEvent + ":" + p.ItemsAdded[0].DeviceID
+			}
+		},
+		Other: func(m *sense.Message) {
+			got <- "other:" + m.Type
+		},
+	}))...)
+	if err := client.Login(sensetest.DefaultEmail, sensetest.DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	connected := server.Connected()
+	_, sub := runStream(t, client)
+	waitConnected(t, connected)
+	// The server sends the hello itself on connecting.
+	for _, msg := range []map[string]any{
+		{"type": "monitor_info", "payload": map[string]any{"features": "always_on"}},
+		{"type": "device_states", "payload": map[string]any{
+			"states": []map[string]any{{"device_id": "d1a2b3c4", "state": "on"}},
+		}},
+		{"type": "data_change", "payload": map[string]any{"device_data_checksum": "checksum-1"}},
+		{"type": "new_timeline_event", "payload": map[string]any{
+			"items_added": []map[string]any{{"device_id": "e5f6a7b8"}},
+		}},
+		{"type": "recent_history", "payload": map[string]any{}},
+	} {
+		if err := server.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Messages are handled in order, so once the update arrives every
+	// handler has run.
+	send(t, server, sub.Updates(), 1)
+
+	for _, want := range []string{
+		"hello",
+		"monitor_info:always_on",
+		"device_states:d1a2b3c4=on",
+		"data_change:checksum-1",
+		"new_timeline_event:e5f6a7b8",
+		"other:recent_history",
+	} {
+		select {
+		case msg := <-got:
+			if msg != want {
+				t.Errorf("got %q, want %q", msg, want)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	// The checksum was unchanged, so the device list wasn't reloaded.
+	if n := server.RequestCount("/apiservice/api/v1/app/monitors/1/devices/overview"); n != 1 {
+		t.Errorf("got %d device list requests, want 1", n)
+	}
+}
@@ -0,0 +1,165 @@
+package sense
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// session holds the login state shared by a Client and every Client derived
+// from it with ForMonitor. The AuthResponse is never modified in place;
+// Login and Refresh replace it, so readers may use the pointer they get from
+// auth without holding the lock.
+type session struct {
+	mu           sync.Mutex
+	refreshMu    sync.Mutex
+	authResponse *AuthResponse
+	username     string
+}
+
+func (s *session) setAuth(authResponse *AuthResponse) {
+	s.mu.Lock()
+	s.authResponse = authResponse
+	s.mu.Unlock()
+}
+
+// auth returns the current AuthResponse, or ErrNotAuthenticated if there is no
+// valid login.
+func (c *Client) auth() (*AuthResponse, error) {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+	if c.session.authResponse == nil || !c.session.authResponse.Authorized {
+		return nil, ErrNotAuthenticated
+	}
+	return c.session.authResponse, nil
+}
+
+// WithMonitor selects the monitor a Client talks to by ID or serial number.
+// Without it, a Client uses the first monitor on the account.
+func WithMonitor(idOrSerial string) Option {
+	return func(c *Client) {
+		c.mu.Lock()
+		c.monitor = idOrSerial
+		c.mu.Unlock()
+	}
+}
+
+// Monitors returns every monitor on the logged-in account.
+func (c *Client) Monitors() ([]MonitorInfo, error) {
+	auth, err := c.auth()
+	if err != nil {
+		return nil, err
+	}
+	return auth.Monitors, nil
+}
+
+// Monitor returns the monitor this Client talks to.
+func (c *Client) Monitor() (*MonitorInfo, error) {
+	auth, err := c.auth()
+	if err != nil {
+		return nil, err
+	}
+	return c.monitorInfo(auth)
+}
+
+// SelectMonitor switches this Client to the monitor with the given ID or
+// serial number, closing any open realtime feed and reloading the device
+// list.
+func (c *Client) SelectMonitor(idOrSerial string) error {
+	return c.SelectMonitorContext(context.Background(), idOrSerial)
+}
+
+// SelectMonitorContext is like SelectMonitor, but the request it makes is
+// bound to ctx.
+func (c *Client) SelectMonitorContext(ctx context.Context, idOrSerial string) error {
+	auth, err := c.auth()
+	if err != nil {
+		return err
+	}
+	if _, err := findMonitor(auth.Monitors, idOrSerial); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.monitor = idOrSerial
+	c.mu.Unlock()
+	c.Close()
+	c.registry.reset()
+	return c.loadDevices(ctx)
+}
+
+// ForMonitor returns a new Client for the monitor with the given ID or serial
+// number. The new Client shares this Client's login, so a Refresh on either
+// is seen by both, but it has its own device list and realtime feed; any
+// number of them may stream concurrently.
+func (c *Client) ForMonitor(idOrSerial string) (*Client, error) {
+	return c.ForMonitorContext(context.Background(), idOrSerial)
+}
+
+// ForMonitorContext is like ForMonitor, but the request it makes is bound to
+// ctx.
+func (c *Client) ForMonitorContext(ctx context.Context, idOrSerial string) (*Client, error) {
+	auth, err := c.auth()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := findMonitor(auth.Monitors, idOrSerial); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	handlers := c.handlers
+	deviceEvents := c.deviceEvents
+	c.mu.Unlock()
+	m := &Client{
+		client:       c.client,
+		dialer:       c.dialer,
+		apiURL:       c.apiURL,
+		websocketURL: c.websocketURL,
+		clientId:     generateRandomClientID(128),
+		session:      c.session,
+		monitor:      idOrSerial,
+		totp:         c.totp,
+		tokens:       c.tokens,
+		handlers:     handlers,
+		recorder:     c.recorder,
+		registry:     newRegistry(),
+		deviceEvents: deviceEvents,
+	}
+	if err := m.loadDevices(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// monitorInfo returns the monitor selected for this Client from those in
+// auth. It must not be called with c.mu held.
+func (c *Client) monitorInfo(auth *AuthResponse) (*MonitorInfo, error) {
+	c.mu.Lock()
+	idOrSerial := c.monitor
+	c.mu.Unlock()
+	return selectedMonitor(auth.Monitors, idOrSerial)
+}
+
+// selectedMonitor returns the monitor with the given ID or serial number, or
+// the first monitor if idOrSerial is empty.
+func selectedMonitor(monitors []MonitorInfo, idOrSerial string) (*MonitorInfo, error) {
+	if idOrSerial == "" {
+		if len(monitors) == 0 {
+			return nil, ErrNoMonitors
+		}
+		return &monitors[0], nil
+	}
+	return findMonitor(monitors, idOrSerial)
+}
+
+func findMonitor(monitors []MonitorInfo, idOrSerial string) (*MonitorInfo, error) {
+	if len(monitors) == 0 {
+		return nil, ErrNoMonitors
+	}
+	id, err := strconv.Atoi(idOrSerial)
+	for i := range monitors {
+		if monitors[i].SerialNumber == idOrSerial || (err == nil && monitors[i].ID == id) {
+			return &monitors[i], nil
+		}
+	}
+	return nil, ErrMonitorNotFound
+}
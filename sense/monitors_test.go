@@ -0,0 +1,127 @@
+package sense_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+// twoMonitors returns a server with two monitors, the second of which has
+// only a heat pump.
+func twoMonitors(t *testing.T) *sensetest.Server {
+	t.Helper()
+	server := sensetest.NewServer()
+	t.Cleanup(server.Close)
+	monitors := sensetest.DefaultMonitors()
+	second := monitors[0]
+	second.ID = 2
+	second.SerialNumber = "N000000002"
+	second.Attributes.ID = 2
+	second.Attributes.Name = "Cabin"
+	server.SetMonitors(append(monitors, second))
+	server.SetDevices(2, &sense.Devices{
+		Devices:            []sense.Device{{ID: "f9e8d7c6", Name: "Heat Pump"}},
+		DeviceDataChecksum: "checksum-2",
+	})
+	return server
+}
+
+func TestMultipleMonitors(t *testing.T) {
+	server := twoMonitors(t)
+	client := login(t, server)
+
+	monitors, err := client.Monitors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(monitors) != 2 {
+		t.Fatalf("got %d monitors, want 2", len(monitors))
+	}
+	cabin, err := client.ForMonitor("N000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cabin.Close() })
+	if monitor, err := cabin.Monitor(); err != nil || monitor.ID != 2 {
+		t.Fatalf("got monitor %v (%v) by serial number, want 2", monitor, err)
+	}
+	if _, err := cabin.GetDeviceByID("f9e8d7c6"); err != nil {
+		t.Errorf("got error %v looking up the second monitor's device", err)
+	}
+	if _, err := client.GetDeviceByID("f9e8d7c6"); !errors.Is(err, sense.ErrDeviceNotFound) {
+		t.Errorf("got error %v looking up another monitor's device, want %v", err, sense.ErrDeviceNotFound)
+	}
+	if _, err := client.ForMonitor("3"); !errors.Is(err, sense.ErrMonitorNotFound) {
+		t.Errorf("got error %v for an unknown monitor, want %v", err, sense.ErrMonitorNotFound)
+	}
+
+	// Both monitors stream at once, and each sees only its own frames.
+	_, homeSub := runStream(t, client)
+	_, cabinSub := runStream(t, cabin)
+	deadline := time.Now().Add(timeout)
+	for server.Connections() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for both realtime feeds to connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := server.SendToMonitor(2, sensetest.RealtimeUpdate(time.Now(), 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SendToMonitor(1, sensetest.RealtimeUpdate(time.Now(), 10)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		sub   *sense.Subscription
+		frame int
+	}{{homeSub, 10}, {cabinSub, 20}} {
+		select {
+		case update := <-want.sub.Updates():
+			if update.Payload.FrameNumber != want.frame {
+				t.Errorf("got frame %d, want %d", update.Payload.FrameNumber, want.frame)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("timed out waiting for frame %d", want.frame)
+		}
+	}
+}
+
+func TestSelectMonitor(t *testing.T) {
+	server := twoMonitors(t)
+	client := login(t, server)
+
+	connected := server.Connected()
+	_, sub := runStream(t, client)
+	waitConnected(t, connected)
+
+	// Switching monitors closes the feed; the stream reconnects to the new
+	// one.
+	connected = server.Connected()
+	if err := client.SelectMonitor("2"); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(t, connected)
+	if _, err := client.GetDeviceByID("f9e8d7c6"); err != nil {
+		t.Errorf("got error %v looking up the selected monitor's device", err)
+	}
+	if err := server.SendToMonitor(2, sensetest.RealtimeUpdate(time.Now(), 1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case update := <-sub.Updates():
+		if update.Payload.FrameNumber != 1 {
+			t.Errorf("got frame %d, want 1", update.Payload.FrameNumber)
+		}
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for a frame from the selected monitor")
+	}
+	if n := server.RequestCount("/monitors/2/realtimefeed"); n != 1 {
+		t.Errorf("got %d connections to the selected monitor, want 1", n)
+	}
+	if err := client.SelectMonitor("3"); !errors.Is(err, sense.ErrMonitorNotFound) {
+		t.Errorf("got error %v selecting an unknown monitor, want %v", err, sense.ErrMonitorNotFound)
+	}
+}
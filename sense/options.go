@@ -0,0 +1,42 @@
+package sense
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Option configures a Client created by NewClient.
+type Option func(*Client)
+
+// WithApiURL sets the base URL (scheme and host, with an optional port) used
+// for all REST calls, e.g. "http://127.0.0.1:8080". Defaults to DefaultApiURL.
+func WithApiURL(url string) Option {
+	return func(c *Client) {
+		c.apiURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithWebsocketURL sets the base URL (scheme and host, with an optional port)
+// used for the realtime feed, e.g. "ws://127.0.0.1:8080". Defaults to
+// DefaultWebsocketURL.
+func WithWebsocketURL(url string) Option {
+	return func(c *Client) {
+		c.websocketURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for all REST calls.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// WithDialer sets the dialer used to open the realtime websocket.
+func WithDialer(dialer *websocket.Dialer) Option {
+	return func(c *Client) {
+		c.dialer = dialer
+	}
+}
@@ -0,0 +1,255 @@
+package sense
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DeviceEventType is what happened to a device when the device list was
+// reloaded.
+type DeviceEventType string
+
+const (
+	DeviceAdded   DeviceEventType = "added"
+	DeviceRemoved DeviceEventType = "removed"
+	DeviceRenamed DeviceEventType = "renamed"
+)
+
+// DeviceEvent is a change to the device list. Merging devices shows up as
+// the merged devices being removed and the new one added.
+type DeviceEvent struct {
+	Type    DeviceEventType
+	Device  Device
+	OldName string // for DeviceRenamed
+}
+
+// DeviceEventHandler is called with every change found when the device list
+// is reloaded, and the list as it now stands. It is called from whichever
+// goroutine reloaded the list, usually one the Client starts in the
+// background, so it should not block for long.
+type DeviceEventHandler func(events []DeviceEvent, devices *Devices)
+
+// WithDeviceEventHandler sets the handler for changes to the device list.
+// Clients returned by ForMonitor inherit it.
+func WithDeviceEventHandler(handler DeviceEventHandler) Option {
+	return func(c *Client) {
+		c.deviceEvents = handler
+	}
+}
+
+// SetDeviceEventHandler replaces the handler for changes to the device list.
+func (c *Client) SetDeviceEventHandler(handler DeviceEventHandler) {
+	c.mu.Lock()
+	c.deviceEvents = handler
+	c.mu.Unlock()
+}
+
+// minReloadInterval limits how often an unknown device in the realtime feed
+// reloads the device list, since a device the overview doesn't list yet
+// would otherwise reload it with every update.
+const minReloadInterval = time.Minute
+
+// registry is a Client's device list. It holds the latest realtime readings
+// for every device alongside the details from the overview, and may be used
+// from any goroutine.
+type registry struct {
+	mu         sync.RWMutex
+	generation uint64 // counts resets, so that stale reloads can be dropped
+	loaded     bool
+	devices    []Device
+	index      map[string]int
+	checksum   string
+	reloading  bool
+	pending    bool // another reload is wanted once this one finishes
+	lastReload time.Time
+}
+
+func newRegistry() *registry {
+	return &registry{index: map[string]int{}}
+}
+
+// reset forgets the device list, so that the next one loaded doesn't produce
+// events, and any reload already under way is dropped when it finishes.
+func (r *registry) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.generation++
+	r.loaded = false
+	r.devices = nil
+	r.index = map[string]int{}
+	r.checksum = ""
+}
+
+// currentGeneration returns the generation to pass to replace with the list
+// about to be loaded.
+func (r *registry) currentGeneration() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.generation
+}
+
+// snapshot returns a copy of the device list, or nil if none is loaded.
+func (r *registry) snapshot() *Devices {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !r.loaded {
+		return nil
+	}
+	return &Devices{Devices: slices.Clone(r.devices), DeviceDataChecksum: r.checksum}
+}
+
+// device returns a copy of the device with the given ID.
+func (r *registry) device(id string) (*Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i, ok := r.index[id]
+	if !ok {
+		return nil, false
+	}
+	device := r.devices[i]
+	return &device, true
+}
+
+// replace swaps in a freshly loaded device list, keeping the realtime
+// readings of the devices that are still there, and returns how it differs
+// from the old one. There are no events for the first list loaded. If the
+// registry has been reset since generation, the list is for the wrong
+// monitor; it is dropped, and replace reports false.
+func (r *registry) replace(devices *Devices, generation uint64) ([]DeviceEvent, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if generation != r.generation {
+		return nil, false
+	}
+	var events []DeviceEvent
+	index := make(map[string]int, len(devices.Devices))
+	list := slices.Clone(devices.Devices)
+	for i := range list {
+		device := &list[i]
+		index[device.ID] = i
+		j, ok := r.index[device.ID]
+		if !ok {
+			if r.loaded {
+				events = append(events, DeviceEvent{Type: DeviceAdded, Device: *device})
+			}
+			continue
+		}
+		old := &r.devices[j]
+		copyRealtime(device, old)
+		if old.Name != device.Name {
+			events = append(events, DeviceEvent{Type: DeviceRenamed, Device: *device, OldName: old.Name})
+		}
+	}
+	for _, old := range r.devices {
+		if _, ok := index[old.ID]; !ok {
+			events = append(events, DeviceEvent{Type: DeviceRemoved, Device: old})
+		}
+	}
+	r.loaded = true
+	r.devices = list
+	r.index = index
+	r.checksum = devices.DeviceDataChecksum
+	return events, true
+}
+
+// merge records the readings in a realtime update, which lists only the
+// devices that are on, and fills in the rest of their details. It reports
+// whether the update named a device the registry doesn't know about.
+func (r *registry) merge(update *RealtimeUpdate) (unknown bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.loaded {
+		return false
+	}
+	on := make(map[string]bool, len(update.Payload.Devices))
+	for i := range update.Payload.Devices {
+		reading := &update.Payload.Devices[i]
+		if reading.ID == "" {
+			continue
+		}
+		j, ok := r.index[reading.ID]
+		if !ok {
+			unknown = true
+			continue
+		}
+		on[reading.ID] = true
+		device := &r.devices[j]
+		copyRealtime(device, reading)
+		*reading = *device
+	}
+	// Devices missing from the update are off.
+	for i := range r.devices {
+		if !on[r.devices[i].ID] {
+			copyRealtime(&r.devices[i], &Device{})
+		}
+	}
+	return unknown
+}
+
+// copyRealtime copies the fields that realtime updates carry from src to
+// dst.
+func copyRealtime(dst, src *Device) {
+	dst.Attrs = src.Attrs
+	dst.Watts = src.Watts
+	dst.Cirumference = src.Cirumference
+	dst.StatusDetails = src.StatusDetails
+	dst.AlwaysOnState = src.AlwaysOnState
+	dst.AlwaysOnWatts = src.AlwaysOnWatts
+}
+
+// needsReload reports whether a reload should start now, because the device
+// list's checksum differs from checksum (or, if checksum is empty, because
+// a device turned up that isn't on the list and there hasn't been a reload
+// lately), and if so marks one as started. If a reload is already running,
+// the list it loads may be too old, so another is queued to follow it.
+func (r *registry) needsReload(checksum string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.loaded {
+		return false
+	}
+	if checksum != "" && checksum == r.checksum {
+		return false
+	}
+	if checksum == "" && time.Since(r.lastReload) < minReloadInterval {
+		return false
+	}
+	r.lastReload = time.Now()
+	if r.reloading {
+		r.pending = true
+		return false
+	}
+	r.reloading = true
+	return true
+}
+
+// reloaded marks a reload as finished, and reports whether another should
+// start straight away, in which case it is marked as started.
+func (r *registry) reloaded() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reloading = r.pending
+	r.pending = false
+	return r.reloading
+}
+
+// reloadDevicesIfChanged reloads the device list in the background if
+// checksum says it has changed, or, if checksum is empty, if it may have.
+// Changes are passed to the device event handler.
+func (c *Client) reloadDevicesIfChanged(checksum string) {
+	if !c.registry.needsReload(checksum) {
+		return
+	}
+	go func() {
+		for reload := true; reload; reload = c.registry.reloaded() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := c.loadDevices(ctx); err != nil {
+				log.Printf("Failed to reload devices: %v\n", err)
+			}
+			cancel()
+		}
+	}()
+}
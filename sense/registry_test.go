@@ -0,0 +1,146 @@
+package sense
+
+import (
+	"testing"
+)
+
+func strptr(s string) *string {
+	return &s
+}
+
+func eventList(events []DeviceEvent) []string {
+	var list []string
+	for _, event := range events {
+		s := string(event.Type) + " " + event.Device.ID
+		if event.Type == DeviceRenamed {
+			s += " " + event.OldName + "->" + event.Device.Name
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+func TestRegistryReplace(t *testing.T) {
+	r := newRegistry()
+	watts := 120.0
+	events, ok := r.replace(&Devices{Devices: []Device{
+		{ID: "fridge", Name: "Fridge"},
+		{ID: "washer", Name: "Washer"},
+		{ID: "dryer", Name: "Dryer"},
+		{ID: "kettle", Name: "Kettle"},
+	}, DeviceDataChecksum: "1"}, 0)
+	if !ok || len(events) != 0 {
+		t.Fatalf("got %v, %v for the first list, want no events", eventList(events), ok)
+	}
+	r.merge(&RealtimeUpdate{Payload: RealtimeUpdatePayload{Devices: []Device{{ID: "fridge", Watts: &watts}}}})
+
+	// The fridge is renamed, the washer and dryer merged, the kettle
+	// removed and a heat pump added.
+	events, ok = r.replace(&Devices{Devices: []Device{
+		{ID: "fridge", Name: "Kitchen Fridge"},
+		{ID: "laundry", Name: "Laundry", Tags: DeviceTags{MergedDevices: strptr("washer,dryer")}},
+		{ID: "heatpump", Name: "Heat Pump"},
+	}, DeviceDataChecksum: "2"}, 0)
+	if !ok {
+		t.Fatal("replace dropped the list")
+	}
+	want := []string{
+		"renamed fridge Fridge->Kitchen Fridge",
+		"added laundry",
+		"added heatpump",
+		"removed washer",
+		"removed dryer",
+		"removed kettle",
+	}
+	got := eventList(events)
+	if len(got) != len(want) {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got event %q, want %q", got[i], want[i])
+		}
+	}
+
+	// The fridge keeps its readings through the reload.
+	fridge, ok := r.device("fridge")
+	if !ok || fridge.Name != "Kitchen Fridge" || fridge.Watts == nil || *fridge.Watts != watts {
+		t.Errorf("got fridge %+v, want it renamed with its readings kept", fridge)
+	}
+	if snapshot := r.snapshot(); len(snapshot.Devices) != 3 || snapshot.DeviceDataChecksum != "2" {
+		t.Errorf("got %d devices with checksum %q, want 3 with checksum 2", len(snapshot.Devices), snapshot.DeviceDataChecksum)
+	}
+}
+
+func TestRegistryMerge(t *testing.T) {
+	r := newRegistry()
+	update := &RealtimeUpdate{Payload: RealtimeUpdatePayload{Devices: []Device{{ID: "fridge"}}}}
+	if r.merge(update) {
+		t.Error("got an unknown device before any list was loaded")
+	}
+	r.replace(&Devices{Devices: []Device{{ID: "fridge", Name: "Fridge"}, {ID: "dryer", Name: "Dryer"}}}, 0)
+
+	watts := 300.0
+	update = &RealtimeUpdate{Payload: RealtimeUpdatePayload{Devices: []Device{{ID: "dryer", Watts: &watts}, {ID: "new"}}}}
+	if !r.merge(update) {
+		t.Error("got no unknown device for one that isn't listed")
+	}
+	if update.Payload.Devices[0].Name != "Dryer" {
+		t.Errorf("got %q, want the update's device filled in from the list", update.Payload.Devices[0].Name)
+	}
+	if dryer, _ := r.device("dryer"); dryer.Watts == nil || *dryer.Watts != watts {
+		t.Errorf("got dryer %+v, want its reading recorded", dryer)
+	}
+
+	// A device missing from the next update is off.
+	r.merge(&RealtimeUpdate{})
+	if dryer, _ := r.device("dryer"); dryer.Watts != nil {
+		t.Errorf("got dryer drawing %v after it turned off, want nothing", *dryer.Watts)
+	}
+}
+
+func TestRegistryDropsStaleReload(t *testing.T) {
+	r := newRegistry()
+	r.replace(&Devices{Devices: []Device{{ID: "fridge", Name: "Fridge"}}}, 0)
+
+	// A reload starts, and then the monitor is switched.
+	generation := r.currentGeneration()
+	r.reset()
+	if _, ok := r.replace(&Devices{Devices: []Device{{ID: "heatpump"}}}, r.currentGeneration()); !ok {
+		t.Fatal("replace dropped the new monitor's list")
+	}
+	if events, ok := r.replace(&Devices{Devices: []Device{{ID: "fridge"}}}, generation); ok || events != nil {
+		t.Errorf("got %v, %v for the old monitor's list, want it dropped", eventList(events), ok)
+	}
+	if _, ok := r.device("heatpump"); !ok {
+		t.Error("lost the new monitor's list to a stale reload")
+	}
+}
+
+func TestRegistryNeedsReload(t *testing.T) {
+	r := newRegistry()
+	if r.needsReload("2") {
+		t.Error("got a reload before any list was loaded")
+	}
+	r.replace(&Devices{DeviceDataChecksum: "1"}, 0)
+	if r.needsReload("1") {
+		t.Error("got a reload for an unchanged checksum")
+	}
+	if !r.needsReload("2") {
+		t.Fatal("got no reload for a new checksum")
+	}
+	// A change while a reload is running queues another to follow it.
+	if r.needsReload("3") {
+		t.Error("got a second reload started while one was running")
+	}
+	if !r.reloaded() {
+		t.Error("got no reload to follow the first")
+	}
+	if r.reloaded() {
+		t.Error("got a third reload")
+	}
+	// Unknown devices reload the list at most once a minute.
+	if r.needsReload("") {
+		t.Error("got a reload for an unknown device straight after one for a new checksum")
+	}
+}
@@ -0,0 +1,291 @@
+package sense
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinBackoff    = time.Second
+	defaultMaxBackoff    = 2 * time.Minute
+	defaultRefreshMargin = 5 * time.Minute
+	defaultMinRefresh    = time.Minute
+)
+
+// StreamState is the connection state of a Stream.
+type StreamState int
+
+const (
+	StreamConnecting StreamState = iota
+	StreamConnected
+	StreamRefreshing
+	StreamWaiting // waiting out the backoff delay before reconnecting
+	StreamStopped
+)
+
+func (s StreamState) String() string {
+	switch s {
+	case StreamConnecting:
+		return "connecting"
+	case StreamConnected:
+		return "connected"
+	case StreamRefreshing:
+		return "refreshing"
+	case StreamWaiting:
+		return "waiting"
+	case StreamStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+type StreamConfig struct {
+	// MinBackoff and MaxBackoff bound the delay before reconnecting after a
+	// failure. The delay doubles with each consecutive failure, and is
+	// jittered so that several clients don't reconnect in lockstep. They
+	// default to 1 second and 2 minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// RefreshMargin is how long before TokenExpiry the access token is
+	// refreshed and the websocket reopened with the new one. It defaults to
+	// 5 minutes.
+	RefreshMargin time.Duration
+	// MinRefreshInterval is the shortest time between proactive refreshes, so
+	// that a token issued with less than RefreshMargin to live isn't
+	// refreshed in a loop. It defaults to 1 minute.
+	MinRefreshInterval time.Duration
+	// Login is called to log in again if the refresh token is rejected. If it
+	// is nil, Run gives up and returns the error instead.
+	Login func(ctx context.Context) error
+	// OnStateChange, if set, is called from Run on every state transition,
+	// along with the error that caused it, if any.
+	OnStateChange func(state StreamState, err error)
+}
+
+// Stream is a realtime feed that survives network outages and token expiry:
+// it reconnects with jittered exponential backoff after transport errors,
+// refreshes (or, failing that, repeats) the login after authentication
+// errors, and refreshes the access token before it expires.
+type Stream struct {
+	client      *Client
+	config      StreamConfig
+	subscribers subscribers
+
+	mu      sync.Mutex
+	state   StreamState
+	lastErr error
+}
+
+// NewStream returns a Stream for this Client's monitor. Nothing happens until
+// Run is called.
+func (c *Client) NewStream(config StreamConfig) *Stream {
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = max(defaultMaxBackoff, config.MinBackoff)
+	}
+	if config.RefreshMargin <= 0 {
+		config.RefreshMargin = defaultRefreshMargin
+	}
+	if config.MinRefreshInterval <= 0 {
+		config.MinRefreshInterval = defaultMinRefresh
+	}
+	return &Stream{
+		client: c,
+		config: config,
+		state:  StreamStopped,
+	}
+}
+
+// Subscribe returns a Subscription that receives every realtime update from
+// now until it is closed or Run returns. Any number of subscribers may be
+// active at once; a slow one only holds up the others if its overflow
+// policy is Block.
+func (s *Stream) Subscribe(options SubscribeOptions) *Subscription {
+	return s.subscribers.add(options)
+}
+
+// State returns the current state of the stream, and the error that caused
+// the most recent transition, if any.
+func (s *Stream) State() (StreamState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.lastErr
+}
+
+// Run connects and keeps the stream connected until ctx is done, returning
+// ctx.Err(), or until it hits an error that retrying can't fix (such as a
+// rejected password), returning that error. Run may only be called once.
+func (s *Stream) Run(ctx context.Context) error {
+	defer s.subscribers.close()
+	defer s.client.Close()
+
+	failures := 0
+	for {
+		received, err := s.stream(ctx)
+		if ctx.Err() != nil {
+			s.setState(StreamStopped, nil)
+			return ctx.Err()
+		}
+		if received {
+			failures = 0
+		}
+		if isFatalError(err) {
+			s.setState(StreamStopped, err)
+			return err
+		}
+		if isAuthError(err) {
+			s.setState(StreamRefreshing, err)
+			if authErr := s.reauthenticate(ctx); authErr != nil {
+				if ctx.Err() != nil {
+					s.setState(StreamStopped, nil)
+					return ctx.Err()
+				}
+				if isFatalError(authErr) || errors.Is(authErr, ErrAuthenticationFailed) {
+					s.setState(StreamStopped, authErr)
+					return authErr
+				}
+				err = authErr
+			}
+		}
+
+		failures++
+		s.setState(StreamWaiting, err)
+		timer := time.NewTimer(backoffDelay(s.config.MinBackoff, s.config.MaxBackoff, failures))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			s.setState(StreamStopped, nil)
+			return ctx.Err()
+		}
+	}
+}
+
+// stream connects and delivers updates until the connection fails, reporting
+// whether any updates were received.
+func (s *Stream) stream(ctx context.Context) (received bool, err error) {
+	defer s.client.Close()
+	s.setState(StreamConnecting, nil)
+	if err := s.client.refreshIfExpiring(ctx, s.config.RefreshMargin); err != nil {
+		return false, err
+	}
+	updates, err := s.client.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+	s.setState(StreamConnected, nil)
+
+	refreshAt := s.nextRefresh()
+	for {
+		refresh := time.NewTimer(time.Until(refreshAt))
+		select {
+		case update, ok := <-updates:
+			refresh.Stop()
+			if !ok {
+				return received, io.EOF
+			}
+			received = true
+			s.client.mergeDevices(update)
+			s.subscribers.publish(ctx, update)
+		case <-refresh.C:
+			// Reopen the websocket with a fresh token before the old one
+			// expires.
+			s.setState(StreamRefreshing, nil)
+			s.client.Close()
+			if err := s.client.refreshIfExpiring(ctx, s.config.RefreshMargin); err != nil {
+				return received, err
+			}
+			if updates, err = s.client.connect(ctx); err != nil {
+				return received, err
+			}
+			refreshAt = s.nextRefresh()
+			s.setState(StreamConnected, nil)
+		case <-ctx.Done():
+			refresh.Stop()
+			return received, ctx.Err()
+		}
+	}
+}
+
+// nextRefresh returns when to proactively refresh the access token:
+// RefreshMargin before it expires, but no sooner than MinRefreshInterval from
+// now.
+func (s *Stream) nextRefresh() time.Time {
+	at := s.client.TokenExpiry().Add(-s.config.RefreshMargin)
+	if earliest := time.Now().Add(s.config.MinRefreshInterval); at.Before(earliest) {
+		return earliest
+	}
+	return at
+}
+
+// reauthenticate refreshes the access token, falling back to a full login if
+// the refresh token is rejected.
+func (s *Stream) reauthenticate(ctx context.Context) error {
+	_, err := s.client.RefreshContext(ctx)
+	if errors.Is(err, ErrAuthenticationFailed) || errors.Is(err, ErrNotAuthenticated) {
+		if s.config.Login == nil {
+			return err
+		}
+		return s.config.Login(ctx)
+	}
+	return err
+}
+
+func (s *Stream) setState(state StreamState, err error) {
+	s.mu.Lock()
+	changed := s.state != state || err != nil
+	s.state = state
+	s.lastErr = err
+	s.mu.Unlock()
+	if changed && s.config.OnStateChange != nil {
+		s.config.OnStateChange(state, err)
+	}
+}
+
+// refreshIfExpiring refreshes the access token if it expires within margin.
+// Clients sharing a session only refresh once between them.
+func (c *Client) refreshIfExpiring(ctx context.Context, margin time.Duration) error {
+	c.session.refreshMu.Lock()
+	defer c.session.refreshMu.Unlock()
+	auth, err := c.auth()
+	if err != nil {
+		return err
+	}
+	if time.Until(auth.Expires) >= margin {
+		return nil
+	}
+	_, err = c.refresh(ctx)
+	return err
+}
+
+func isAuthError(err error) bool {
+	return errors.Is(err, ErrTokenRejected) ||
+		errors.Is(err, ErrNotAuthenticated) ||
+		errors.Is(err, ErrAuthenticationFailed)
+}
+
+// isFatalError reports whether err can't be fixed by reconnecting or logging
+// in again.
+func isFatalError(err error) bool {
+	return errors.Is(err, ErrNoMonitors) ||
+		errors.Is(err, ErrMonitorNotFound) ||
+		errors.Is(err, ErrMFARequired)
+}
+
+// backoffDelay returns the delay before the given consecutive retry: half of
+// it doubles from minDelay up to maxDelay, and the other half is random.
+func backoffDelay(minDelay, maxDelay time.Duration, failures int) time.Duration {
+	delay := maxDelay
+	if failures < 32 {
+		if d := minDelay << (failures - 1); d > 0 && d < maxDelay {
+			delay = d
+		}
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,184 @@
+package sense
+
+import (
+	"context"
+	"iter"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultSubscriptionBuffer = 1024
+
+// OverflowPolicy decides what happens to an update when a subscriber's buffer
+// is full.
+type OverflowPolicy int
+
+const (
+	// Block waits for the subscriber to make room, holding up every other
+	// subscriber in the meantime.
+	Block OverflowPolicy = iota
+	// DropOldest discards the oldest buffered update to make room.
+	DropOldest
+	// DropNewest discards the new update.
+	DropNewest
+)
+
+type SubscribeOptions struct {
+	// Buffer is the number of updates buffered for the subscriber. It
+	// defaults to 1024.
+	Buffer int
+	// Overflow is what to do when the buffer is full. It defaults to Block.
+	Overflow OverflowPolicy
+}
+
+// Subscription receives every realtime update delivered by a Stream. The
+// updates are shared between subscribers and must not be modified.
+type Subscription struct {
+	updates  chan *RealtimeUpdate
+	overflow OverflowPolicy
+	dropped  atomic.Uint64
+	owner    *subscribers
+
+	mu        sync.Mutex // held while sending to or closing updates
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Updates returns the channel updates are delivered on. It is closed when the
+// Subscription is closed or the Stream stops.
+func (s *Subscription) Updates() <-chan *RealtimeUpdate {
+	return s.updates
+}
+
+// All returns an iterator over the updates, which ends when the Subscription
+// is closed or the Stream stops. Breaking out of the loop closes the
+// Subscription.
+func (s *Subscription) All() iter.Seq[*RealtimeUpdate] {
+	return func(yield func(*RealtimeUpdate) bool) {
+		for update := range s.updates {
+			if !yield(update) {
+				s.Close()
+				return
+			}
+		}
+	}
+}
+
+// Dropped returns the number of updates discarded because the subscriber's
+// buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops delivery to the subscriber and closes its channel.
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		// Closing done first releases a Block send in progress, so that the
+		// lock below can be taken.
+		close(s.done)
+		s.mu.Lock()
+		s.closed = true
+		close(s.updates)
+		s.mu.Unlock()
+		if s.owner != nil {
+			s.owner.remove(s)
+		}
+	})
+}
+
+func (s *Subscription) deliver(ctx context.Context, update *RealtimeUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	switch s.overflow {
+	case DropNewest:
+		select {
+		case s.updates <- update:
+		default:
+			s.dropped.Add(1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.updates <- update:
+				return
+			default:
+			}
+			select {
+			case <-s.updates:
+				s.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.updates <- update:
+		case <-s.done:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// subscribers fans updates out to a set of Subscriptions.
+type subscribers struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func (s *subscribers) add(options SubscribeOptions) *Subscription {
+	if options.Buffer <= 0 {
+		options.Buffer = defaultSubscriptionBuffer
+	}
+	sub := &Subscription{
+		updates:  make(chan *RealtimeUpdate, options.Buffer),
+		overflow: options.Overflow,
+		done:     make(chan struct{}),
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		sub.Close()
+		return sub
+	}
+	if s.subs == nil {
+		s.subs = make(map[*Subscription]struct{})
+	}
+	s.subs[sub] = struct{}{}
+	sub.owner = s
+	s.mu.Unlock()
+	return sub
+}
+
+func (s *subscribers) remove(sub *Subscription) {
+	s.mu.Lock()
+	delete(s.subs, sub)
+	s.mu.Unlock()
+}
+
+func (s *subscribers) publish(ctx context.Context, update *RealtimeUpdate) {
+	s.mu.Lock()
+	subs := make([]*Subscription, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.mu.Unlock()
+	for _, sub := range subs {
+		sub.deliver(ctx, update)
+	}
+}
+
+// close closes every Subscription, and any added later.
+func (s *subscribers) close() {
+	s.mu.Lock()
+	s.closed = true
+	subs := s.subs
+	s.subs = nil
+	s.mu.Unlock()
+	for sub := range subs {
+		sub.Close()
+	}
+}
@@ -0,0 +1,107 @@
+package sense_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+// frames drains the updates buffered on sub and returns their frame numbers.
+func frames(sub *sense.Subscription) []int {
+	var got []int
+	for {
+		select {
+		case update := <-sub.Updates():
+			got = append(got, update.Payload.FrameNumber)
+		default:
+			return got
+		}
+	}
+}
+
+func TestSlowSubscribers(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	connected := server.Connected()
+	stream, fast := runStream(t, client)
+	dropNewest := stream.Subscribe(sense.SubscribeOptions{Buffer: 2, Overflow: sense.DropNewest})
+	dropOldest := stream.Subscribe(sense.SubscribeOptions{Buffer: 2, Overflow: sense.DropOldest})
+	// A closed Block subscriber that never reads doesn't hold up the others.
+	closed := stream.Subscribe(sense.SubscribeOptions{Buffer: 1})
+	closed.Close()
+	waitConnected(t, connected)
+
+	for frame := 1; frame <= 5; frame++ {
+		send(t, server, fast.Updates(), frame)
+	}
+	deadline := time.Now().Add(timeout)
+	for dropNewest.Dropped() < 3 || dropOldest.Dropped() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d and %d dropped updates, want 3 each", dropNewest.Dropped(), dropOldest.Dropped())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, test := range []struct {
+		name string
+		sub  *sense.Subscription
+		want []int
+	}{
+		{"DropNewest", dropNewest, []int{1, 2}},
+		{"DropOldest", dropOldest, []int{4, 5}},
+	} {
+		got := frames(test.sub)
+		if len(got) != len(test.want) || got[0] != test.want[0] || got[1] != test.want[1] {
+			t.Errorf("%s: got frames %v, want %v", test.name, got, test.want)
+		}
+		if n := test.sub.Dropped(); n != 3 {
+			t.Errorf("%s: got %d dropped updates, want 3", test.name, n)
+		}
+	}
+	if n := fast.Dropped(); n != 0 {
+		t.Errorf("got %d updates dropped for a Block subscriber, want 0", n)
+	}
+	if _, ok := <-closed.Updates(); ok {
+		t.Error("got an update on a closed subscription")
+	}
+}
+
+func TestSubscriptionAll(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	client := login(t, server)
+
+	connected := server.Connected()
+	stream, _ := runStream(t, client)
+	sub := stream.Subscribe(sense.SubscribeOptions{})
+	waitConnected(t, connected)
+	for frame := 1; frame <= 3; frame++ {
+		if err := server.Send(sensetest.RealtimeUpdate(time.Now(), frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Breaking out of the loop closes the subscription.
+	want := 1
+	for update := range sub.All() {
+		if update.Payload.FrameNumber != want {
+			t.Fatalf("got frame %d, want %d", update.Payload.FrameNumber, want)
+		}
+		if want == 2 {
+			break
+		}
+		want++
+	}
+	select {
+	case _, ok := <-sub.Updates():
+		for ok {
+			_, ok = <-sub.Updates()
+		}
+	case <-time.After(timeout):
+		t.Fatal("subscription not closed after breaking out of All")
+	}
+}
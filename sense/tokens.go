@@ -0,0 +1,151 @@
+package sense
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/adamroach/sense-logger/internal/atomicfile"
+)
+
+// tokenRefreshMargin is how close to expiry a stored access token may be
+// before it is refreshed rather than used as-is.
+const tokenRefreshMargin = 5 * time.Minute
+
+var errNoStoredToken = errors.New("no stored token")
+
+// TokenStore persists the login state (access and refresh tokens, along with
+// the account's monitors) so that a Client can resume a session without
+// sending the password again.
+type TokenStore interface {
+	// LoadToken returns the stored login for username, or nil if there is
+	// none.
+	LoadToken(username string) (*AuthResponse, error)
+	// SaveToken stores the login for username, replacing any previous one.
+	SaveToken(username string, auth *AuthResponse) error
+}
+
+// WithTokenStore makes the Client save its tokens to store after every Login
+// and Refresh, and makes Login try the stored tokens before the password.
+func WithTokenStore(store TokenStore) Option {
+	return func(c *Client) {
+		c.tokens = store
+	}
+}
+
+// FileTokenStore is a TokenStore that keeps logins for any number of users in
+// a single JSON file, readable only by its owner.
+type FileTokenStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileTokenStore returns a FileTokenStore backed by the file at path. The
+// file and its directory are created on the first save.
+func NewFileTokenStore(path string) *FileTokenStore {
+	return &FileTokenStore{path: path}
+}
+
+func (s *FileTokenStore) LoadToken(username string) (*AuthResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return tokens[username], nil
+}
+
+func (s *FileTokenStore) SaveToken(username string, auth *AuthResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens, err := s.read()
+	if err != nil {
+		return err
+	}
+	tokens[username] = auth
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("error creating token directory: %w", err)
+	}
+	// Replace the file atomically, so that a crash can't leave a truncated
+	// token file behind.
+	return atomicfile.WriteJSON(s.path, 0600, tokens)
+}
+
+func (s *FileTokenStore) read() (map[string]*AuthResponse, error) {
+	tokens := make(map[string]*AuthResponse)
+	file, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tokens, nil
+		}
+		return nil, fmt.Errorf("error opening token file: %w", err)
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("error decoding token file %v: %w", s.path, err)
+	}
+	return tokens, nil
+}
+
+func (s *session) setUsername(username string) {
+	s.mu.Lock()
+	s.username = username
+	s.mu.Unlock()
+}
+
+// resume restores the stored login for username, refreshing it if the access
+// token has expired or is rejected. It returns ErrAuthenticationFailed if the
+// refresh token is rejected, ErrTokenRejected if even a refreshed access token
+// is rejected, or errNoStoredToken if there is nothing stored.
+func (c *Client) resume(ctx context.Context, username string) error {
+	auth, err := c.tokens.LoadToken(username)
+	if err != nil {
+		log.Printf("Failed to load stored token: %v\n", err)
+		return errNoStoredToken
+	}
+	if auth == nil || !auth.Authorized {
+		return errNoStoredToken
+	}
+	c.session.setUsername(username)
+	c.session.setAuth(auth)
+
+	if time.Until(auth.Expires) < tokenRefreshMargin {
+		if _, err := c.RefreshContext(ctx); err != nil {
+			return err
+		}
+	}
+	err = c.loadDevices(ctx)
+	if errors.Is(err, ErrTokenRejected) {
+		if _, err := c.RefreshContext(ctx); err != nil {
+			return err
+		}
+		err = c.loadDevices(ctx)
+	}
+	return err
+}
+
+// saveToken stores auth for the logged-in user, if the Client has a
+// TokenStore. Failures are logged rather than returned, since the login
+// itself succeeded.
+func (c *Client) saveToken(auth *AuthResponse) {
+	if c.tokens == nil {
+		return
+	}
+	c.session.mu.Lock()
+	username := c.session.username
+	c.session.mu.Unlock()
+	if username == "" {
+		return
+	}
+	if err := c.tokens.SaveToken(username, auth); err != nil {
+		log.Printf("Failed to save token: %v\n", err)
+	}
+}
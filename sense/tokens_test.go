@@ -0,0 +1,133 @@
+package sense_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+func TestFileTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "tokens.json")
+	store := sense.NewFileTokenStore(path)
+
+	if auth, err := store.LoadToken("a@example.com"); err != nil || auth != nil {
+		t.Fatalf("got %v (%v) before saving, want nothing", auth, err)
+	}
+	for _, user := range []string{"a@example.com", "b@example.com"} {
+		if err := store.SaveToken(user, &sense.AuthResponse{Authorized: true, AccessToken: "token-" + user}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("got token file permissions %v, want %v", perm, os.FileMode(0600))
+	}
+
+	// A new store reads what the first one saved.
+	store = sense.NewFileTokenStore(path)
+	for _, user := range []string{"a@example.com", "b@example.com"} {
+		auth, err := store.LoadToken(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth == nil || auth.AccessToken != "token-"+user {
+			t.Errorf("got %v for %s, want its saved token", auth, user)
+		}
+	}
+	if auth, err := store.LoadToken("c@example.com"); err != nil || auth != nil {
+		t.Errorf("got %v (%v) for an unknown user, want nothing", auth, err)
+	}
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 0 {
+		t.Errorf("got temporary files %v left behind", matches)
+	}
+}
+
+// loginWithStore logs in with the given password and a FileTokenStore at
+// path.
+func loginWithStore(t *testing.T, options []sense.Option, path, password string) error {
+	t.Helper()
+	client := sense.NewClient(append(options, sense.WithTokenStore(sense.NewFileTokenStore(path)))...)
+	t.Cleanup(func() { client.Close() })
+	return client.Login(sensetest.DefaultEmail, password)
+}
+
+func TestLoginResumesStoredToken(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	if err := loginWithStore(t, server.ClientOptions(), path, sensetest.DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	// The stored token is used instead of the (now wrong) password.
+	if err := loginWithStore(t, server.ClientOptions(), path, "wrong"); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.RequestCount(sense.AuthPath); n != 1 {
+		t.Errorf("got %d password logins, want 1", n)
+	}
+
+	// An expired access token is refreshed.
+	server.ExpireAccessToken()
+	if err := loginWithStore(t, server.ClientOptions(), path, "wrong"); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.RequestCount(sense.RefreshPath); n != 1 {
+		t.Errorf("got %d refreshes, want 1", n)
+	}
+
+	// A rejected refresh token falls back to the password.
+	server.ExpireAccessToken()
+	server.RejectRefresh(true)
+	if err := loginWithStore(t, server.ClientOptions(), path, sensetest.DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.RequestCount(sense.AuthPath); n != 2 {
+		t.Errorf("got %d password logins, want 2", n)
+	}
+}
+
+func TestLoginFallsBackWhenRefreshedTokenRejected(t *testing.T) {
+	server := sensetest.New()
+	// The renew endpoint hands out an access token the API doesn't accept.
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == sense.RefreshPath {
+			json.NewEncoder(w).Encode(map[string]any{
+				"authorized":   true,
+				"access_token": "bogus",
+				"expires":      time.Now().Add(time.Hour),
+			})
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	defer httpServer.Close()
+	options := []sense.Option{
+		sense.WithApiURL(httpServer.URL),
+		sense.WithWebsocketURL(strings.Replace(httpServer.URL, "http", "ws", 1)),
+	}
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	if err := loginWithStore(t, options, path, sensetest.DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	server.ExpireAccessToken()
+	if err := loginWithStore(t, options, path, sensetest.DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.RequestCount(sense.AuthPath); n != 2 {
+		t.Errorf("got %d password logins, want 2", n)
+	}
+}
@@ -0,0 +1,75 @@
+package sense_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sensetest"
+)
+
+// rfc6238Secret is the SHA-1 key from RFC 6238 appendix B, "12345678901234567890",
+// in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC lists eight digit codes; authenticator apps use the last six.
+	for _, test := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		got, err := sense.TOTPCode(rfc6238Secret, time.Unix(test.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("got code %s at %d, want %s", got, test.unix, test.want)
+		}
+	}
+	// Secrets are often shown lowercase, in groups, or padded.
+	got, err := sense.TOTPCode("gezd gnbv gy3t qojq gezd gnbv gy3t qojq====", time.Unix(59, 0))
+	if err != nil || got != "287082" {
+		t.Errorf("got code %s (%v) for a formatted secret, want 287082", got, err)
+	}
+	if _, err := sense.TOTPCode("not base32!", time.Now()); err == nil {
+		t.Error("got no error for an invalid secret")
+	}
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	server := sensetest.NewServer()
+	defer server.Close()
+	server.RequireTOTP(rfc6238Secret)
+
+	client := sense.NewClient(append(server.ClientOptions(), sense.WithTOTPSecret(rfc6238Secret))...)
+	defer client.Close()
+	if err := client.Login(sensetest.DefaultEmail, sensetest.DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.RequestCount(sense.MfaPath); n != 1 {
+		t.Errorf("got %d MFA requests, want 1", n)
+	}
+	if _, err := client.GetDeviceByID("d1a2b3c4"); err != nil {
+		t.Error(err)
+	}
+
+	client = sense.NewClient(server.ClientOptions()...)
+	if err := client.Login(sensetest.DefaultEmail, sensetest.DefaultPassword); !errors.Is(err, sense.ErrMFARequired) {
+		t.Errorf("got error %v without a TOTP source, want %v", err, sense.ErrMFARequired)
+	}
+
+	wrongCode := sense.WithTOTP(func(ctx context.Context) (string, error) { return "000000", nil })
+	client = sense.NewClient(append(server.ClientOptions(), wrongCode)...)
+	if err := client.Login(sensetest.DefaultEmail, sensetest.DefaultPassword); !errors.Is(err, sense.ErrAuthenticationFailed) {
+		t.Errorf("got error %v with the wrong code, want %v", err, sense.ErrAuthenticationFailed)
+	}
+}
@@ -0,0 +1,81 @@
+package sensetest
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+// DefaultMonitors returns the monitors a new Server reports on login.
+func DefaultMonitors() []sense.MonitorInfo {
+	return []sense.MonitorInfo{
+		{
+			ID:           1,
+			SerialNumber: "N000000001",
+			TimeZone:     "America/Chicago",
+			Online:       true,
+			Attributes: sense.MonitorAttributes{
+				ID:           1,
+				Name:         "Home",
+				Cost:         13,
+				SellBackRate: 5,
+			},
+		},
+	}
+}
+
+// DefaultDevices returns the device overview a new Server reports for each
+// monitor.
+func DefaultDevices() *sense.Devices {
+	return &sense.Devices{
+		Devices: []sense.Device{
+			{ID: "always_on", Name: "Always On", Icon: ptr("alwayson")},
+			{ID: "unknown", Name: "Other", Icon: ptr("home")},
+			{
+				ID:   "d1a2b3c4",
+				Name: "Fridge",
+				Icon: ptr("fridge"),
+				Tags: sense.DeviceTags{UserDeviceType: ptr("Fridge")},
+			},
+			{
+				ID:   "e5f6a7b8",
+				Name: "Dryer",
+				Icon: ptr("dryer"),
+				Tags: sense.DeviceTags{UserDeviceType: ptr("Dryer")},
+			},
+		},
+		DeviceDataChecksum: "checksum-1",
+	}
+}
+
+// RealtimeUpdate returns a plausible realtime_update message for the given
+// time, reporting the given devices as active. Devices without a Watts value
+// are given a random one.
+func RealtimeUpdate(at time.Time, frame int, devices ...sense.Device) *sense.RealtimeUpdate {
+	total := 0.0
+	for i := range devices {
+		if devices[i].Watts == nil {
+			devices[i].Watts = ptr(50 + rand.Float64()*1000)
+		}
+		total += *devices[i].Watts
+	}
+	return &sense.RealtimeUpdate{
+		Type: "realtime_update",
+		Payload: sense.RealtimeUpdatePayload{
+			Voltage:        []float64{120 + rand.Float64(), 120 + rand.Float64()},
+			FrameNumber:    frame,
+			Devices:        devices,
+			Channels:       []float64{total / 2, total / 2},
+			FrequencyHz:    59.95 + rand.Float64()/10,
+			TotalWatts:     total,
+			GridWatts:      int(total),
+			DeviceWatts:    int(total),
+			EpochTimestamp: at.Unix(),
+		},
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
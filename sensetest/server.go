@@ -0,0 +1,540 @@
+// Package sensetest provides a fake Sense cloud for exercising sense.Client
+// and the code built on top of it without talking to the real service.
+package sensetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DefaultEmail    = "user@example.com"
+	DefaultPassword = "password"
+	DefaultUserID   = 1000
+	accountID       = 2000
+)
+
+// Server is a fake Sense cloud implementing the authenticate, renew,
+// devices/overview, device detail, labs_content and realtimefeed endpoints.
+// It is safe for concurrent use; the scripting methods below change its
+// behavior while it is running.
+type Server struct {
+	httpServer *httptest.Server
+	mux        *http.ServeMux
+	upgrader   websocket.Upgrader
+
+	mu            sync.Mutex
+	email         string
+	password      string
+	failAuth      bool
+	rejectRefresh bool
+	totpSecret    string
+	mfaToken      string
+	accessToken   string
+	refreshToken  string
+	tokenCounter  int
+	monitors      []sense.MonitorInfo
+	devices       map[int]*sense.Devices
+	deviceDetails map[string]*sense.DeviceDetails
+	labsReport    *sense.LabsReport
+	conns         map[*websocket.Conn]*connection
+	connected     chan struct{}
+	requests      map[string]int
+}
+
+type connection struct {
+	mu        sync.Mutex
+	conn      *websocket.Conn
+	monitorID int
+}
+
+// New returns a Server that is not listening on any address. It implements
+// http.Handler, so it can be mounted on any listener.
+func New() *Server {
+	s := &Server{
+		mux:           http.NewServeMux(),
+		email:         DefaultEmail,
+		password:      DefaultPassword,
+		monitors:      DefaultMonitors(),
+		devices:       map[int]*sense.Devices{},
+		deviceDetails: map[string]*sense.DeviceDetails{},
+		labsReport:    &sense.LabsReport{},
+		conns:         map[*websocket.Conn]*connection{},
+		connected:     make(chan struct{}),
+		requests:      map[string]int{},
+	}
+	for _, monitor := range s.monitors {
+		s.devices[monitor.ID] = DefaultDevices()
+	}
+	s.issueTokens()
+
+	s.mux.HandleFunc("POST /apiservice/api/v1/authenticate", s.handleAuthenticate)
+	s.mux.HandleFunc("POST /apiservice/api/v1/authenticate/mfa", s.handleMFA)
+	s.mux.HandleFunc("POST /apiservice/api/v1/renew", s.handleRenew)
+	s.mux.HandleFunc("GET /apiservice/api/v1/app/monitors/{monitor}/devices/overview", s.handleDeviceOverview)
+	s.mux.HandleFunc("GET /apiservice/api/v1/app/monitors/{monitor}/devices/{device}", s.handleDeviceDetail)
+	s.mux.HandleFunc("GET /apiservice/api/v1/app/monitors/{monitor}/labs_content", s.handleLabsContent)
+	s.mux.HandleFunc("GET /monitors/{monitor}/realtimefeed", s.handleRealtimeFeed)
+	return s
+}
+
+// NewServer returns a Server listening on a loopback address. Callers should
+// call Close when finished.
+func NewServer() *Server {
+	s := New()
+	s.httpServer = httptest.NewServer(s)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	s.mu.Unlock()
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close drops all websocket connections and, if the Server was created with
+// NewServer, shuts down the listener.
+func (s *Server) Close() {
+	s.DropConnections()
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// URL returns the base URL of the REST API, suitable for sense.WithApiURL.
+func (s *Server) URL() string {
+	if s.httpServer == nil {
+		return ""
+	}
+	return s.httpServer.URL
+}
+
+// WebsocketURL returns the base URL of the realtime feed, suitable for
+// sense.WithWebsocketURL.
+func (s *Server) WebsocketURL() string {
+	return strings.Replace(s.URL(), "http", "ws", 1)
+}
+
+// ClientOptions returns the options needed to point a sense.Client at this
+// Server.
+func (s *Server) ClientOptions() []sense.Option {
+	if s.httpServer == nil {
+		return nil
+	}
+	return []sense.Option{
+		sense.WithApiURL(s.URL()),
+		sense.WithWebsocketURL(s.WebsocketURL()),
+		sense.WithHTTPClient(s.httpServer.Client()),
+	}
+}
+
+// SetCredentials changes the email and password accepted by the authenticate
+// endpoint.
+func (s *Server) SetCredentials(email, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.email = email
+	s.password = password
+}
+
+// FailAuth makes the authenticate endpoint reject every login when fail is
+// true.
+func (s *Server) FailAuth(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failAuth = fail
+}
+
+// RequireTOTP enables two-factor authentication: logins are challenged for a
+// code generated from the given base32 secret. An empty secret disables it.
+func (s *Server) RequireTOTP(secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totpSecret = secret
+}
+
+// RejectRefresh makes the renew endpoint reject every refresh token when
+// reject is true.
+func (s *Server) RejectRefresh(reject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejectRefresh = reject
+}
+
+// ExpireAccessToken invalidates the current access token, as if it had
+// expired. The refresh token remains valid.
+func (s *Server) ExpireAccessToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenCounter++
+	s.accessToken = fmt.Sprintf("access-%d", s.tokenCounter)
+}
+
+// AccessToken returns the currently valid access token.
+func (s *Server) AccessToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accessToken
+}
+
+// SetMonitors replaces the monitors returned on login. Monitors without a
+// device list get a copy of DefaultDevices.
+func (s *Server) SetMonitors(monitors []sense.MonitorInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.monitors = monitors
+	for _, monitor := range monitors {
+		if _, ok := s.devices[monitor.ID]; !ok {
+			s.devices[monitor.ID] = DefaultDevices()
+		}
+	}
+}
+
+// SetDevices replaces the device overview returned for a monitor.
+func (s *Server) SetDevices(monitorID int, devices *sense.Devices) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[monitorID] = devices
+}
+
+// SetDeviceDetails sets the response for the device detail endpoint.
+func (s *Server) SetDeviceDetails(deviceID string, details *sense.DeviceDetails) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deviceDetails[deviceID] = details
+}
+
+// SetLabsReport sets the response for the labs_content endpoint.
+func (s *Server) SetLabsReport(report *sense.LabsReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labsReport = report
+}
+
+// RequestCount returns the number of requests received for the given path.
+func (s *Server) RequestCount(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// Connections returns the number of open realtime websocket connections.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Connected returns a channel that is closed the next time a realtime
+// websocket connection is established.
+func (s *Server) Connected() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+// Send marshals msg as JSON and sends it to every realtime connection.
+func (s *Server) Send(msg any) error {
+	message, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.SendRaw(message)
+}
+
+// SendRaw sends message verbatim to every realtime connection; use it to
+// script malformed frames.
+func (s *Server) SendRaw(message []byte) error {
+	return s.sendRaw(0, message)
+}
+
+// SendToMonitor marshals msg as JSON and sends it to the realtime connections
+// for a single monitor.
+func (s *Server) SendToMonitor(monitorID int, msg any) error {
+	message, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.sendRaw(monitorID, message)
+}
+
+// sendRaw sends message to the connections for monitorID, or to all
+// connections if monitorID is zero.
+func (s *Server) sendRaw(monitorID int, message []byte) error {
+	for _, c := range s.connections() {
+		if monitorID != 0 && c.monitorID != monitorID {
+			continue
+		}
+		c.mu.Lock()
+		err := c.conn.WriteMessage(websocket.TextMessage, message)
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CloseConnections closes every realtime connection with a normal close
+// frame.
+func (s *Server) CloseConnections() {
+	for _, c := range s.connections() {
+		c.mu.Lock()
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		c.mu.Unlock()
+		c.conn.Close()
+	}
+}
+
+// DropConnections abruptly closes every realtime connection without a close
+// frame, as a network outage would.
+func (s *Server) DropConnections() {
+	for _, c := range s.connections() {
+		c.conn.NetConn().Close()
+	}
+}
+
+func (s *Server) connections() []*connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]*connection, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// issueTokens must be called with s.mu held.
+func (s *Server) issueTokens() {
+	s.tokenCounter++
+	s.accessToken = fmt.Sprintf("access-%d", s.tokenCounter)
+	s.refreshToken = fmt.Sprintf("refresh-%d", s.tokenCounter)
+}
+
+// authorized must be called with s.mu held.
+func (s *Server) authorized(r *http.Request) bool {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	} else {
+		token = strings.TrimPrefix(token, "bearer ")
+	}
+	return token == s.accessToken
+}
+
+// monitor must be called with s.mu held.
+func (s *Server) monitor(r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("monitor"))
+	if err != nil {
+		return 0, false
+	}
+	for _, monitor := range s.monitors {
+		if monitor.ID == id {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) handleAuthenticate(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failAuth || r.FormValue("email") != s.email || r.FormValue("password") != s.password {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{
+			"status":       "error",
+			"error_reason": "Unexpected username or password",
+		})
+		return
+	}
+	if s.totpSecret != "" {
+		s.tokenCounter++
+		s.mfaToken = fmt.Sprintf("mfa-%d", s.tokenCounter)
+		writeJSON(w, http.StatusUnauthorized, map[string]any{
+			"status":       "error",
+			"error_reason": "Multi-factor authentication required",
+			"mfa_token":    s.mfaToken,
+			"mfa_type":     "totp",
+		})
+		return
+	}
+	s.writeLogin(w)
+}
+
+func (s *Server) handleMFA(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	valid := false
+	// Accept the previous period's code too, as the real service allows for
+	// some clock skew.
+	for _, t := range []time.Time{now, now.Add(-30 * time.Second)} {
+		code, err := sense.TOTPCode(s.totpSecret, t)
+		if err == nil && r.FormValue("totp") == code {
+			valid = true
+		}
+	}
+	if s.mfaToken == "" || r.FormValue("mfa_token") != s.mfaToken || !valid {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{
+			"status":       "error",
+			"error_reason": "Invalid code",
+		})
+		return
+	}
+	s.mfaToken = ""
+	s.writeLogin(w)
+}
+
+// writeLogin issues new tokens and writes a successful login response. It
+// must be called with s.mu held.
+func (s *Server) writeLogin(w http.ResponseWriter) {
+	s.issueTokens()
+	writeJSON(w, http.StatusOK, sense.AuthResponse{
+		Authorized:   true,
+		AccountID:    accountID,
+		UserID:       DefaultUserID,
+		AccessToken:  s.accessToken,
+		RefreshToken: s.refreshToken,
+		TotpEnabled:  s.totpSecret != "",
+		Monitors:     s.monitors,
+		Expires:      time.Now().Add(24 * time.Hour),
+	})
+}
+
+func (s *Server) handleRenew(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rejectRefresh || r.FormValue("refresh_token") != s.refreshToken {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{
+			"status":       "error",
+			"error_reason": "Invalid refresh token",
+		})
+		return
+	}
+	s.issueTokens()
+	// The renew response only carries the token fields, so it is written as a
+	// map rather than a sense.AuthResponse.
+	writeJSON(w, http.StatusOK, map[string]any{
+		"authorized":    true,
+		"account_id":    accountID,
+		"user_id":       DefaultUserID,
+		"access_token":  s.accessToken,
+		"refresh_token": s.refreshToken,
+		"roles":         "USER",
+		"expires":       time.Now().Add(24 * time.Hour),
+	})
+}
+
+func (s *Server) handleDeviceOverview(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	monitorID, ok := s.monitor(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.devices[monitorID])
+}
+
+func (s *Server) handleDeviceDetail(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	monitorID, ok := s.monitor(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	deviceID := r.PathValue("device")
+	if details, ok := s.deviceDetails[deviceID]; ok {
+		writeJSON(w, http.StatusOK, details)
+		return
+	}
+	device := s.devices[monitorID].GetDeviceByID(deviceID)
+	if device == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, sense.DeviceDetails{Device: *device})
+}
+
+func (s *Server) handleLabsContent(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if _, ok := s.monitor(r); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.labsReport)
+}
+
+func (s *Server) handleRealtimeFeed(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	if !s.authorized(r) {
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	monitorID, ok := s.monitor(r)
+	s.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &connection{conn: conn, monitorID: monitorID}
+	// The real feed always starts with a hello message.
+	conn.WriteJSON(map[string]any{
+		"type":    sense.MessageHello,
+		"payload": sense.HelloPayload{Online: true},
+	})
+	s.mu.Lock()
+	s.conns[conn] = c
+	close(s.connected)
+	s.connected = make(chan struct{})
+	s.mu.Unlock()
+
+	// Drain (and discard) anything the client sends until the connection goes
+	// away, so that close frames are processed.
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
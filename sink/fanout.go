@@ -0,0 +1,282 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+const defaultQueueSize = 1024
+
+var (
+	ErrQueueFull = fmt.Errorf("sink queue full; update dropped")
+	ErrClosed    = fmt.Errorf("fanout closed")
+)
+
+type FanoutOptions struct {
+	// QueueSize is the number of operations buffered for each sink. Updates
+	// that arrive while a sink's queue is full are dropped for that sink
+	// alone. It defaults to 1024.
+	QueueSize int
+	// Block makes Write wait for room in every queue instead of dropping
+	// updates, for when completeness matters more than keeping up (as when
+	// replaying an archive).
+	Block bool
+	// OnError, if set, is called with the name of the sink and the error
+	// whenever a sink fails or misses an update. It must not block.
+	OnError func(name string, err error)
+}
+
+// Stats counts what has happened to the updates given to one sink.
+type Stats struct {
+	Name    string
+	Written uint64
+	Errors  uint64
+	Dropped uint64
+}
+
+// Fanout is a Sink that writes to any number of other sinks. Each sink runs
+// in its own goroutine with its own queue, so one that is slow or failing
+// doesn't hold up, or stop, the others. Errors from the sinks are reported to
+// OnError rather than returned from Write.
+type Fanout struct {
+	options FanoutOptions
+
+	mu      sync.RWMutex // held for writing only to add sinks or close
+	workers []*worker
+	closed  bool
+}
+
+func NewFanout(options FanoutOptions) *Fanout {
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultQueueSize
+	}
+	return &Fanout{options: options}
+}
+
+// Add starts writing to sink. The name identifies it in errors and Stats.
+func (f *Fanout) Add(name string, sink Sink) {
+	w := &worker{
+		name:    name,
+		sink:    sink,
+		queue:   make(chan operation, f.options.QueueSize),
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		onError: f.options.OnError,
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.workers = append(f.workers, w)
+	go w.run()
+}
+
+// Write queues update for every sink. Unless the Block option is set, it
+// never blocks; a sink whose queue is full misses the update, ErrQueueFull is
+// reported for it, and Write returns ErrQueueFull once the other sinks have
+// been given the update.
+func (f *Fanout) Write(update *sense.RealtimeUpdate) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return ErrClosed
+	}
+	var err error
+	for _, w := range f.workers {
+		if f.options.Block {
+			w.queue <- operation{update: update}
+			continue
+		}
+		select {
+		case w.queue <- operation{update: update}:
+		default:
+			w.dropped.Add(1)
+			if w.onError != nil {
+				w.onError(w.name, ErrQueueFull)
+			}
+			err = ErrQueueFull
+		}
+	}
+	return err
+}
+
+// UpdateDevices passes the device list to every sink. It never blocks; a sink
+// that is still busy gets only the latest list once it is ready for it.
+func (f *Fanout) UpdateDevices(devices []sense.Device) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return ErrClosed
+	}
+	for _, w := range f.workers {
+		w.setDevices(devices)
+	}
+	return nil
+}
+
+// Flush waits for every sink to work through its queue and flush, and
+// returns their errors joined together.
+func (f *Fanout) Flush() error {
+	f.mu.RLock()
+	if f.closed {
+		f.mu.RUnlock()
+		return ErrClosed
+	}
+	results := make([]chan error, len(f.workers))
+	for i, w := range f.workers {
+		results[i] = make(chan error, 1)
+		w.queue <- operation{flushed: results[i]}
+	}
+	f.mu.RUnlock()
+
+	var errs []error
+	for _, result := range results {
+		errs = append(errs, <-result)
+	}
+	return errors.Join(errs...)
+}
+
+// Close works through every queue, then closes every sink, and returns their
+// errors joined together.
+func (f *Fanout) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	workers := f.workers
+	for _, w := range workers {
+		close(w.queue)
+	}
+	f.mu.Unlock()
+
+	var errs []error
+	for _, w := range workers {
+		<-w.done
+		if err := w.call(w.sink.Close); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", w.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns the counts for every sink, in the order they were added.
+func (f *Fanout) Stats() []Stats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	stats := make([]Stats, len(f.workers))
+	for i, w := range f.workers {
+		stats[i] = Stats{
+			Name:    w.name,
+			Written: w.written.Load(),
+			Errors:  w.errors.Load(),
+			Dropped: w.dropped.Load(),
+		}
+	}
+	return stats
+}
+
+// operation is either an update to write or a request to flush.
+type operation struct {
+	update  *sense.RealtimeUpdate
+	flushed chan error
+}
+
+type worker struct {
+	name    string
+	sink    Sink
+	queue   chan operation
+	changed chan struct{} // signalled when devices is set
+	done    chan struct{}
+	onError func(name string, err error)
+
+	mu      sync.Mutex
+	devices []sense.Device
+
+	written atomic.Uint64
+	errors  atomic.Uint64
+	dropped atomic.Uint64
+}
+
+func (w *worker) run() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.changed:
+			w.updateDevices()
+		case op, ok := <-w.queue:
+			if !ok {
+				w.updateDevices()
+				return
+			}
+			// Device names should be in place before the updates that
+			// follow them.
+			select {
+			case <-w.changed:
+				w.updateDevices()
+			default:
+			}
+			if op.flushed != nil {
+				err := w.call(w.sink.Flush)
+				if err != nil {
+					w.report(err)
+					err = fmt.Errorf("%s: %w", w.name, err)
+				}
+				op.flushed <- err
+				continue
+			}
+			if err := w.call(func() error { return w.sink.Write(op.update) }); err != nil {
+				w.report(err)
+			} else {
+				w.written.Add(1)
+			}
+		}
+	}
+}
+
+func (w *worker) setDevices(devices []sense.Device) {
+	w.mu.Lock()
+	w.devices = devices
+	w.mu.Unlock()
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (w *worker) updateDevices() {
+	w.mu.Lock()
+	devices := w.devices
+	w.devices = nil
+	w.mu.Unlock()
+	if devices == nil {
+		return
+	}
+	if err := w.call(func() error { return w.sink.UpdateDevices(devices) }); err != nil {
+		w.report(err)
+	}
+}
+
+// call runs fn, turning a panic into an error so that a broken sink can't
+// take the others down with it.
+func (w *worker) call(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn()
+}
+
+func (w *worker) report(err error) {
+	w.errors.Add(1)
+	if w.onError != nil {
+		w.onError(w.name, err)
+	}
+}
@@ -0,0 +1,238 @@
+package sink_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sink"
+)
+
+const timeout = 5 * time.Second
+
+// events is a log of the calls made to every testSink, in order.
+type events struct {
+	mu  sync.Mutex
+	log []string
+}
+
+func (e *events) add(format string, args ...any) {
+	e.mu.Lock()
+	e.log = append(e.log, fmt.Sprintf(format, args...))
+	e.mu.Unlock()
+}
+
+func (e *events) String() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return strings.Join(e.log, " ")
+}
+
+// testSink logs its calls to events. If gate is set, each Write waits for
+// it to be closed, after signalling started (which must be buffered); if
+// panics is set, Write panics.
+type testSink struct {
+	name    string
+	events  *events
+	gate    chan struct{}
+	started chan struct{}
+	panics  bool
+}
+
+func (s *testSink) Write(update *sense.RealtimeUpdate) error {
+	if s.gate != nil {
+		s.started <- struct{}{}
+		<-s.gate
+	}
+	if s.panics {
+		panic("broken sink")
+	}
+	s.events.add("%s:write%d", s.name, update.Payload.FrameNumber)
+	return nil
+}
+
+func (s *testSink) UpdateDevices(devices []sense.Device) error {
+	s.events.add("%s:devices%d", s.name, len(devices))
+	return nil
+}
+
+func (s *testSink) Flush() error {
+	s.events.add("%s:flush", s.name)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.events.add("%s:close", s.name)
+	return nil
+}
+
+func update(frame int) *sense.RealtimeUpdate {
+	return &sense.RealtimeUpdate{Payload: sense.RealtimeUpdatePayload{FrameNumber: frame}}
+}
+
+// waitWritten waits for the ith sink added to f to have written n updates.
+func waitWritten(t *testing.T, f *sink.Fanout, i int, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for f.Stats()[i].Written < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d updates to be written", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFanoutDropsForSlowSink(t *testing.T) {
+	var log events
+	var errs []string
+	f := sink.NewFanout(sink.FanoutOptions{
+		QueueSize: 1,
+		OnError:   func(name string, err error) { errs = append(errs, name+": "+err.Error()) },
+	})
+	slow := &testSink{name: "slow", events: &log, gate: make(chan struct{}), started: make(chan struct{}, 3)}
+	f.Add("slow", slow)
+	f.Add("fast", &testSink{name: "fast", events: &log})
+
+	if err := f.Write(update(1)); err != nil {
+		t.Fatal(err)
+	}
+	<-slow.started
+	waitWritten(t, f, 1, 1)
+	// The slow sink is busy with the first update, and has room for one more.
+	if err := f.Write(update(2)); err != nil {
+		t.Fatal(err)
+	}
+	waitWritten(t, f, 1, 2)
+	if err := f.Write(update(3)); !errors.Is(err, sink.ErrQueueFull) {
+		t.Errorf("got error %v for a full queue, want %v", err, sink.ErrQueueFull)
+	}
+	close(slow.gate)
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sink.Stats{{Name: "slow", Written: 2, Dropped: 1}, {Name: "fast", Written: 3}}
+	if got := f.Stats(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got stats %v, want %v", got, want)
+	}
+	if len(errs) != 1 || errs[0] != "slow: "+sink.ErrQueueFull.Error() {
+		t.Errorf("got errors %q, want one queue full error for the slow sink", errs)
+	}
+	f.Close()
+}
+
+func TestFanoutBlock(t *testing.T) {
+	var log events
+	f := sink.NewFanout(sink.FanoutOptions{QueueSize: 1, Block: true})
+	slow := &testSink{name: "slow", events: &log, gate: make(chan struct{}), started: make(chan struct{}, 3)}
+	f.Add("slow", slow)
+
+	written := make(chan error)
+	go func() {
+		for frame := 1; frame <= 3; frame++ {
+			if err := f.Write(update(frame)); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	<-slow.started
+	select {
+	case <-written:
+		t.Fatal("Write returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(slow.gate)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := log.String(), "slow:write1 slow:write2 slow:write3 slow:close"; got != want {
+		t.Errorf("got calls %q, want %q", got, want)
+	}
+	if stats := f.Stats(); stats[0].Dropped != 0 || stats[0].Written != 3 {
+		t.Errorf("got stats %v, want 3 written and none dropped", stats[0])
+	}
+}
+
+func TestFanoutRecoversPanics(t *testing.T) {
+	var log events
+	var errs []error
+	var mu sync.Mutex
+	f := sink.NewFanout(sink.FanoutOptions{OnError: func(name string, err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}})
+	f.Add("broken", &testSink{name: "broken", events: &log, panics: true})
+	f.Add("good", &testSink{name: "good", events: &log})
+
+	if err := f.Write(update(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stats := f.Stats()
+	if stats[0].Errors != 1 || stats[0].Written != 0 || stats[1].Written != 1 {
+		t.Errorf("got stats %v, want the broken sink's write to fail and the other's to succeed", stats)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "panic: broken sink") {
+		t.Errorf("got errors %v, want the panic", errs)
+	}
+}
+
+func TestFanoutFlushAndClose(t *testing.T) {
+	var log events
+	f := sink.NewFanout(sink.FanoutOptions{})
+	f.Add("a", &testSink{name: "a", events: &log})
+
+	f.UpdateDevices(make([]sense.Device, 2))
+	f.Write(update(1))
+	f.Write(update(2))
+	// Flush waits for the queue to drain, and devices come before the
+	// updates that follow them.
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := log.String(), "a:devices2 a:write1 a:write2 a:flush"; got != want {
+		t.Errorf("got calls %q after Flush, want %q", got, want)
+	}
+
+	f.Write(update(3))
+	f.UpdateDevices(make([]sense.Device, 3))
+	done := make(chan error)
+	go func() { done <- f.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for Close")
+	}
+	// Close works through the queue before closing the sink.
+	got := log.String()
+	if !strings.HasSuffix(got, "a:close") || !strings.Contains(got, "a:write3") || !strings.Contains(got, "a:devices3") {
+		t.Errorf("got calls %q after Close, want the third update and devices before the close", got)
+	}
+
+	if err := f.Write(update(4)); !errors.Is(err, sink.ErrClosed) {
+		t.Errorf("got error %v writing after Close, want %v", err, sink.ErrClosed)
+	}
+	if err := f.Flush(); !errors.Is(err, sink.ErrClosed) {
+		t.Errorf("got error %v flushing after Close, want %v", err, sink.ErrClosed)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("got error %v closing twice", err)
+	}
+}
@@ -0,0 +1,21 @@
+// Package sink defines the interface the logger writes realtime updates
+// through, and a Fanout that writes to several sinks at once.
+package sink
+
+import (
+	"github.com/adamroach/sense-logger/sense"
+)
+
+// Sink is a destination for realtime updates, such as a set of RRD files or a
+// time series database.
+type Sink interface {
+	// Write records a realtime update.
+	Write(update *sense.RealtimeUpdate) error
+	// UpdateDevices is called with the monitor's full device list when the
+	// logger starts, and again whenever it changes.
+	UpdateDevices(devices []sense.Device) error
+	// Flush writes out anything the sink has buffered.
+	Flush() error
+	// Close flushes the sink and releases its resources.
+	Close() error
+}
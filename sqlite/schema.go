@@ -0,0 +1,61 @@
+package sqlite
+
+// schema creates the tables, if they don't already exist. Times are Unix
+// seconds. Every table carries the monitor ID, so that several monitors can
+// share a database.
+const schema = `
+PRAGMA journal_mode = WAL;
+
+CREATE TABLE IF NOT EXISTS devices (
+	monitor_id INTEGER NOT NULL,
+	device_id  TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	type       TEXT,
+	make       TEXT,
+	model      TEXT,
+	location   TEXT,
+	icon       TEXT,
+	updated    INTEGER NOT NULL,
+	PRIMARY KEY (monitor_id, device_id)
+);
+
+CREATE TABLE IF NOT EXISTS mains_samples (
+	monitor_id      INTEGER NOT NULL,
+	time            INTEGER NOT NULL,
+	voltage_1       REAL,
+	voltage_2       REAL,
+	channel_1_watts REAL,
+	channel_2_watts REAL,
+	total_watts     REAL,
+	device_watts    REAL,
+	grid_watts      REAL,
+	frequency_hz    REAL,
+	PRIMARY KEY (monitor_id, time)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS device_samples (
+	monitor_id      INTEGER NOT NULL,
+	device_id       TEXT NOT NULL,
+	time            INTEGER NOT NULL,
+	watts           REAL,
+	current         REAL,
+	voltage         REAL,
+	energy_used     REAL,
+	always_on_watts REAL,
+	PRIMARY KEY (monitor_id, device_id, time)
+) WITHOUT ROWID;
+
+CREATE INDEX IF NOT EXISTS device_samples_time
+	ON device_samples (monitor_id, time);
+
+CREATE TABLE IF NOT EXISTS device_transitions (
+	monitor_id INTEGER NOT NULL,
+	device_id  TEXT NOT NULL,
+	time       INTEGER NOT NULL,
+	state      TEXT NOT NULL CHECK (state IN ('on', 'off')),
+	PRIMARY KEY (monitor_id, device_id, time)
+) WITHOUT ROWID;
+
+CREATE INDEX IF NOT EXISTS device_transitions_time
+	ON device_transitions (monitor_id, time);
+`
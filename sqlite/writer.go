@@ -0,0 +1,220 @@
+// Package sqlite stores realtime updates in a SQLite database: mains and
+// device samples, the device list, and the times devices turn on and off, in
+// tables that can be queried together. See schema.go for the tables.
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/adamroach/sense-logger/internal/sqlitedsn"
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sink"
+	"github.com/adamroach/sense-logger/timeline"
+)
+
+var _ sink.Sink = (*Writer)(nil)
+
+// Writer stores the updates from one monitor. Several Writers, for different
+// monitors, may share a database file.
+type Writer struct {
+	db         *sql.DB
+	monitorID  int
+	lastSample int64
+	tracker    *timeline.Tracker
+}
+
+// New opens (creating, if necessary) the database at path and returns a
+// Writer for monitor.
+func New(path string, monitor sense.MonitorInfo) (*Writer, error) {
+	db, err := sql.Open("sqlite3", sqlitedsn.File(path))
+	if err != nil {
+		return nil, fmt.Errorf("error opening database %v: %w", path, err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables in %v: %w", path, err)
+	}
+	w := &Writer{
+		db:        db,
+		monitorID: monitor.ID,
+		tracker:   timeline.NewTracker(),
+	}
+	if err := w.loadStates(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// loadStates picks up the devices an earlier run left on, so that a device
+// that is still on isn't recorded as turning on again.
+func (w *Writer) loadStates() error {
+	rows, err := w.db.Query(`
+		SELECT device_id, time FROM device_transitions AS t
+		WHERE monitor_id = ? AND state = 'on' AND time = (
+			SELECT MAX(time) FROM device_transitions
+			WHERE monitor_id = t.monitor_id AND device_id = t.device_id
+		)`, w.monitorID)
+	if err != nil {
+		return fmt.Errorf("error loading device states: %w", err)
+	}
+	defer rows.Close()
+	var runs []timeline.Run
+	for rows.Next() {
+		var id string
+		var start int64
+		if err := rows.Scan(&id, &start); err != nil {
+			return fmt.Errorf("error loading device states: %w", err)
+		}
+		runs = append(runs, timeline.Run{DeviceID: id, Start: time.Unix(start, 0)})
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error loading device states: %w", err)
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	var last sql.NullInt64
+	err = w.db.QueryRow(`SELECT MAX(time) FROM mains_samples WHERE monitor_id = ?`, w.monitorID).Scan(&last)
+	if err != nil {
+		return fmt.Errorf("error loading device states: %w", err)
+	}
+	w.tracker.Resume(runs, time.Unix(last.Int64, 0))
+	return nil
+}
+
+// Write stores the mains and device samples in update, at most one per
+// second, and a transition for every device that has turned on or off, as
+// the timeline package judges it, since the last update.
+func (w *Writer) Write(update *sense.RealtimeUpdate) error {
+	payload := &update.Payload
+	t := payload.EpochTimestamp
+	if t <= w.lastSample {
+		return nil
+	}
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO mains_samples
+		(monitor_id, time, voltage_1, voltage_2, channel_1_watts, channel_2_watts,
+		 total_watts, device_watts, grid_watts, frequency_hz)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		w.monitorID, t,
+		index(payload.Voltage, 0), index(payload.Voltage, 1),
+		index(payload.Channels, 0), index(payload.Channels, 1),
+		payload.TotalWatts, payload.DeviceWatts, payload.GridWatts, payload.FrequencyHz)
+	if err != nil {
+		return fmt.Errorf("error storing mains sample: %w", err)
+	}
+
+	sample, err := tx.Prepare(`
+		INSERT OR REPLACE INTO device_samples
+		(monitor_id, device_id, time, watts, current, voltage, energy_used, always_on_watts)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer sample.Close()
+	for _, device := range payload.Devices {
+		var current, voltage, energy *float64
+		if sd := device.StatusDetails; sd != nil {
+			current, voltage, energy = &sd.Current, &sd.Voltage, &sd.EnergyUsed
+		}
+		_, err := sample.Exec(w.monitorID, device.ID, t, device.Watts, current, voltage, energy, device.AlwaysOnWatts)
+		if err != nil {
+			return fmt.Errorf("error storing device sample: %w", err)
+		}
+	}
+
+	// The tracker only moves on once the transitions are committed, so that
+	// a failed write doesn't lose them.
+	tracker := w.tracker.Clone()
+	if err := w.storeTransitions(tx, tracker.Observe(update)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	w.tracker = tracker
+	w.lastSample = t
+	return nil
+}
+
+// UpdateDevices stores the device list.
+func (w *Writer) UpdateDevices(devices []sense.Device) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`
+		INSERT INTO devices (monitor_id, device_id, name, type, make, model, location, icon, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (monitor_id, device_id) DO UPDATE SET
+			name = excluded.name, type = excluded.type, make = excluded.make,
+			model = excluded.model, location = excluded.location, icon = excluded.icon,
+			updated = excluded.updated`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	now := time.Now().Unix()
+	for _, device := range devices {
+		typ := device.Tags.UserDeviceType
+		if typ == nil {
+			typ = device.Tags.Type
+		}
+		_, err := stmt.Exec(w.monitorID, device.ID, device.Name, typ, device.Make, device.Model, device.Location, device.Icon, now)
+		if err != nil {
+			return fmt.Errorf("error storing device %v: %w", device.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Flush does nothing, since every update is committed as it arrives.
+func (w *Writer) Flush() error {
+	return nil
+}
+
+// storeTransitions stores a transition for each of events.
+func (w *Writer) storeTransitions(tx *sql.Tx, events []timeline.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	transition, err := tx.Prepare(`
+		INSERT OR REPLACE INTO device_transitions (monitor_id, device_id, time, state)
+		VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer transition.Close()
+	for _, event := range events {
+		if _, err := transition.Exec(w.monitorID, event.Run.DeviceID, event.Time.Unix(), string(event.Type)); err != nil {
+			return fmt.Errorf("error storing device transition: %w", err)
+		}
+	}
+	return nil
+}
+
+func (w *Writer) Close() error {
+	return w.db.Close()
+}
+
+// index returns values[i], or nil if there is no such element.
+func index(values []float64, i int) any {
+	if i < len(values) {
+		return values[i]
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+func update(epoch int64, watts float64) *sense.RealtimeUpdate {
+	update := &sense.RealtimeUpdate{Payload: sense.RealtimeUpdatePayload{EpochTimestamp: epoch, TotalWatts: watts}}
+	if watts > 0 {
+		update.Payload.Devices = []sense.Device{{ID: "kettle", Name: "Kettle", Watts: &watts}}
+	}
+	return update
+}
+
+// transitions returns the kettle's transitions, as "state@epoch".
+func transitions(t *testing.T, w *Writer) []string {
+	t.Helper()
+	rows, err := w.db.Query(`SELECT state, time FROM device_transitions WHERE device_id = 'kettle' ORDER BY time`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var list []string
+	for rows.Next() {
+		var state string
+		var epoch int64
+		if err := rows.Scan(&state, &epoch); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, state+"@"+time.Unix(epoch, 0).UTC().Format("05"))
+	}
+	return list
+}
+
+func TestWriteKeepsTransitionsOfFailedWrites(t *testing.T) {
+	w, err := New(filepath.Join(t.TempDir(), "sense.db"), sense.MonitorInfo{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Write(update(1700000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The kettle turns on in a write that fails.
+	if _, err := w.db.Exec(`DROP TABLE device_transitions`); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(update(1700000001, 1800)); err == nil {
+		t.Fatal("got no error writing without a transitions table")
+	}
+	if _, err := w.db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next write records it turning on, rather than taking it to be
+	// on already.
+	if err := w.Write(update(1700000002, 1800)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(update(1700000003, 0)); err != nil {
+		t.Fatal(err)
+	}
+	got := transitions(t, w)
+	if len(got) != 2 || got[0] != "on@22" || got[1] != "off@23" {
+		t.Errorf("got transitions %q, want [on@22 off@23]", got)
+	}
+}
+
+func TestResumeDeviceStates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sense.db")
+	w, err := New(path, sense.MonitorInfo{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(update(1700000000, 1800))
+	w.Close()
+
+	// A device left on isn't recorded turning on again.
+	w, err = New(path, sense.MonitorInfo{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Write(update(1700000001, 1800))
+	w.Write(update(1700000002, 0))
+	got := transitions(t, w)
+	if len(got) != 2 || got[0] != "on@20" || got[1] != "off@22" {
+		t.Errorf("got transitions %q, want [on@20 off@22]", got)
+	}
+}
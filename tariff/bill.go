@@ -0,0 +1,157 @@
+package tariff
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/adamroach/sense-logger/energy"
+)
+
+// Grouping is how Bills divides a range of time.
+type Grouping string
+
+const (
+	ByDay   Grouping = "day"
+	ByMonth Grouping = "month"
+	ByCycle Grouping = "cycle" // billing cycles
+	ByRange Grouping = "range" // the whole range at once
+)
+
+// Bill is the cost of the energy recorded from Start until End.
+type Bill struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	ImportKWh float64   `json:"import_kwh"`
+	ExportKWh float64   `json:"export_kwh"`
+	// ImportCost is the cost of the energy drawn from the grid, and
+	// ExportCredit the credit for the energy sent to it.
+	ImportCost   float64 `json:"import_cost"`
+	ExportCredit float64 `json:"export_credit"`
+	// DailyCharges are the tariff's daily charges, for the part of each
+	// calendar day in the bill.
+	DailyCharges float64 `json:"daily_charges"`
+	// Total is what the bill comes to: ImportCost - ExportCredit +
+	// DailyCharges.
+	Total float64 `json:"total"`
+	// DeviceKWh and DeviceCost are the energy each device used, by ID, and
+	// what it cost at the rate for the energy drawn from the grid when it was
+	// used. Energy the house makes itself isn't accounted for, so a house
+	// with solar panels pays less than its devices cost.
+	DeviceKWh  map[string]float64 `json:"device_kwh"`
+	DeviceCost map[string]float64 `json:"device_cost"`
+}
+
+// Bills prices the energy recorded from start until end in hours, hourly
+// energy totals in the order energy.Store.Hours returns them, divided up as
+// by says in loc. Tiered rates depend on the energy drawn since the start of
+// the billing cycle, so hours should start from CycleStart(start, loc);
+// those before start are counted towards the tiers but not billed.
+//
+// There is a bill for every day, month or billing cycle from start until end,
+// whether or not any energy was recorded in it, so that its daily charges
+// are counted however the range is divided up.
+func (t *Tariff) Bills(hours []energy.Bucket, start, end time.Time, by Grouping, loc *time.Location) ([]Bill, error) {
+	s, err := t.compile()
+	if err != nil {
+		return nil, err
+	}
+	switch by {
+	case ByDay, ByMonth, ByCycle, ByRange:
+	default:
+		return nil, fmt.Errorf("can't group bills by %q", by)
+	}
+
+	var bills []Bill
+	for from := start; from.Before(end); from = bills[len(bills)-1].End {
+		bills = append(bills, t.newBill(from.In(loc), start, end, by, loc))
+	}
+	n := 0 // the bill the current hour falls in
+	var cycleEnd time.Time
+	var cycle float64 // kWh drawn from the grid so far this billing cycle
+	for _, hour := range hours {
+		at := hour.Start.In(loc)
+		if !at.Before(cycleEnd) {
+			cycleEnd = t.nextCycle(t.CycleStart(at, loc), loc)
+			cycle = 0
+		}
+		imported := hour.Energy[energy.GridImport]
+		cost, rate := s.importCost(at, cycle, imported)
+		cycle += imported
+		if at.Before(start) || !at.Before(end) {
+			continue
+		}
+
+		for !at.Before(bills[n].End) {
+			n++
+		}
+		bill := &bills[n]
+		exported := hour.Energy[energy.GridExport]
+		bill.ImportKWh += imported
+		bill.ExportKWh += exported
+		bill.ImportCost += cost
+		bill.ExportCredit += exported * s.exportRate(at)
+		for meter, kWh := range hour.Energy {
+			if id, ok := meter.Device(); ok {
+				bill.DeviceKWh[id] += kWh
+				bill.DeviceCost[id] += kWh * rate
+			}
+		}
+	}
+	for i := range bills {
+		bill := &bills[i]
+		bill.DailyCharges = t.DailyCharge * days(bill.Start, bill.End, loc)
+		bill.Total = bill.ImportCost - bill.ExportCredit + bill.DailyCharges
+	}
+	return bills, nil
+}
+
+// newBill returns an empty bill for the day, month or billing cycle that at
+// falls in, or for the whole range, cut to fit between start and end.
+func (t *Tariff) newBill(at, start, end time.Time, by Grouping, loc *time.Location) Bill {
+	from, to := start, end
+	switch by {
+	case ByDay:
+		from = time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, loc)
+		to = from.AddDate(0, 0, 1)
+	case ByMonth:
+		from = time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, loc)
+		to = from.AddDate(0, 1, 0)
+	case ByCycle:
+		from = t.CycleStart(at, loc)
+		to = t.nextCycle(from, loc)
+	}
+	if from.Before(start) {
+		from = start
+	}
+	if to.After(end) {
+		to = end
+	}
+	return Bill{
+		Start:      from,
+		End:        to,
+		DeviceKWh:  map[string]float64{},
+		DeviceCost: map[string]float64{},
+	}
+}
+
+// days returns how many calendar days in loc there are from start until end,
+// counting the part of a day by its share of that day's length, so that a
+// day with a daylight saving change is still one day.
+func days(start, end time.Time, loc *time.Location) float64 {
+	var total float64
+	start = start.In(loc)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	for day.Before(end) {
+		next := day.AddDate(0, 0, 1)
+		from, to := day, next
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		total += float64(to.Sub(from)) / float64(next.Sub(day))
+		day = next
+	}
+	return total
+}
@@ -0,0 +1,76 @@
+package tariff_test
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // for America/New_York wherever the tests run
+
+	"github.com/adamroach/sense-logger/energy"
+	"github.com/adamroach/sense-logger/tariff"
+)
+
+func TestBillsWithoutEnergy(t *testing.T) {
+	tf := &tariff.Tariff{Rate: 0.2, DailyCharge: 0.5}
+	// Three and a half days, with energy recorded on only one.
+	start, end := date(2024, 3, 1, 12), date(2024, 3, 5, 0)
+	hours := []energy.Bucket{hour(date(2024, 3, 2, 10), 2)}
+
+	days := bills(t, tf, hours, start, end, tariff.ByDay)
+	if len(days) != 4 {
+		t.Fatalf("got %d daily bills, want 4", len(days))
+	}
+	checkAmount(t, "charges for half a day", days[0].DailyCharges, 0.25)
+	checkAmount(t, "for a day without energy", days[2].Total, 0.5)
+	checkAmount(t, "for the day with energy", days[1].Total, 0.5+2*0.2)
+
+	var total float64
+	for _, bill := range days {
+		total += bill.Total
+	}
+	whole := bills(t, tf, hours, start, end, tariff.ByRange)
+	if len(whole) != 1 {
+		t.Fatalf("got %d bills for the range, want 1", len(whole))
+	}
+	checkAmount(t, "for the range", whole[0].Total, total)
+	checkAmount(t, "for the month", bills(t, tf, hours, start, end, tariff.ByMonth)[0].Total, total)
+
+	if got := bills(t, tf, nil, end, end, tariff.ByDay); len(got) != 0 {
+		t.Errorf("got bills %+v for an empty range, want none", got)
+	}
+	if _, err := tf.Bills(hours, start, end, "week", time.UTC); err == nil {
+		t.Error("got no error grouping bills by week")
+	}
+}
+
+func TestDailyChargesAcrossDaylightSaving(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf := &tariff.Tariff{DailyCharge: 0.5}
+	// Clocks go forward on March 10th, 2024, and that day has 23 hours.
+	start := time.Date(2024, 3, 9, 0, 0, 0, 0, newYork)
+	end := time.Date(2024, 3, 12, 0, 0, 0, 0, newYork)
+	days, err := tf.Bills(nil, start, end, tariff.ByDay, newYork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 3 {
+		t.Fatalf("got %d daily bills, want 3", len(days))
+	}
+	for _, bill := range days {
+		checkAmount(t, "charges for "+bill.Start.Format("Jan 2"), bill.DailyCharges, 0.5)
+	}
+	whole, err := tf.Bills(nil, start, end, tariff.ByRange, newYork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAmount(t, "charges for the range", whole[0].DailyCharges, 1.5)
+
+	// Half of the short day is 11.5 hours.
+	half, err := tf.Bills(nil, time.Date(2024, 3, 10, 12, 30, 0, 0, newYork), end, tariff.ByRange, newYork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAmount(t, "charges from halfway through the short day", half[0].DailyCharges, 0.5*1.5)
+}
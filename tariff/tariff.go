@@ -0,0 +1,271 @@
+// Package tariff prices the energy the logger records: flat, tiered and
+// time-of-use rates, credits for energy sent back to the grid, and daily
+// charges, over any range of time or by billing cycle.
+package tariff
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+// Tariff is how electricity is priced. Rates are in currency units per kWh.
+//
+// The rate for an hour is that of the first time-of-use period the hour falls
+// in. Outside them it comes from the tiers, by the energy drawn from the grid
+// so far in the billing cycle, or, if there are no tiers, it is Rate.
+type Tariff struct {
+	// Currency is shown before costs, such as "$".
+	Currency    string   `yaml:"currency" toml:"currency" json:"currency,omitempty"`
+	Rate        float64  `yaml:"rate" toml:"rate" json:"rate"`
+	Tiers       []Tier   `yaml:"tiers" toml:"tiers" json:"tiers,omitempty"`
+	Periods     []Period `yaml:"periods" toml:"periods" json:"periods,omitempty"`
+	ExportRate  float64  `yaml:"export_rate" toml:"export_rate" json:"export_rate"`
+	DailyCharge float64  `yaml:"daily_charge" toml:"daily_charge" json:"daily_charge,omitempty"`
+	// CycleDay is the day of the month billing cycles start on; in shorter
+	// months, cycles start on the last day. It defaults to 1.
+	CycleDay int `yaml:"cycle_start" toml:"cycle_start" json:"cycle_start,omitempty"`
+}
+
+// Tier is the rate for the energy drawn from the grid in a billing cycle up
+// to UpTo kWh, after that of the tiers before it. The last tier has no UpTo.
+type Tier struct {
+	UpTo float64 `yaml:"up_to" toml:"up_to" json:"up_to,omitempty"`
+	Rate float64 `yaml:"rate" toml:"rate" json:"rate"`
+}
+
+// Period is a time-of-use period. It applies in the hours from Start until
+// End ("16:00" until "21:00", say, or "22:00" until "06:00" overnight) on the
+// given days of the week ("mon" to "sun", "weekdays" or "weekends") in the
+// given months (1 to 12). Without days or months it applies every day or all
+// year, and without Start and End, all day.
+type Period struct {
+	Name   string   `yaml:"name" toml:"name" json:"name"`
+	Months []int    `yaml:"months" toml:"months" json:"months,omitempty"`
+	Days   []string `yaml:"days" toml:"days" json:"days,omitempty"`
+	Start  string   `yaml:"start" toml:"start" json:"start,omitempty"`
+	End    string   `yaml:"end" toml:"end" json:"end,omitempty"`
+	Rate   float64  `yaml:"rate" toml:"rate" json:"rate"`
+	// ExportRate, if set, replaces the tariff's export rate during the
+	// period.
+	ExportRate *float64 `yaml:"export_rate" toml:"export_rate" json:"export_rate,omitempty"`
+}
+
+// FromMonitor returns the flat tariff Sense has for a monitor: its cost and
+// sell-back rate, which Sense keeps in cents per kWh, and its billing cycle.
+// defaultCost, the cost in the monitor's realtime updates, is used if no cost
+// is set; it may be 0 if it isn't known. Sense doesn't share its time-of-use
+// rates, so a monitor that has them (attributes.TOUEnabled) gets only its
+// flat rate.
+func FromMonitor(attributes sense.MonitorAttributes, defaultCost int) *Tariff {
+	cost := attributes.Cost
+	if cost == 0 {
+		cost = float64(defaultCost)
+	}
+	return &Tariff{
+		Currency:   "$",
+		Rate:       cost / 100,
+		ExportRate: attributes.SellBackRate / 100,
+		CycleDay:   attributes.CycleStart,
+	}
+}
+
+var dayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+// schedule is a Tariff's periods, parsed.
+type schedule struct {
+	tariff  *Tariff
+	periods []period
+}
+
+type period struct {
+	*Period
+	months     [13]bool
+	days       [7]bool
+	start, end int // hours of the day; end is 24 for midnight
+}
+
+// Validate checks that the tariff makes sense, returning every problem found
+// at once.
+func (t *Tariff) Validate() error {
+	_, err := t.compile()
+	return err
+}
+
+func (t *Tariff) compile() (*schedule, error) {
+	var problems []string
+	if t.CycleDay < 0 || t.CycleDay > 31 {
+		problems = append(problems, fmt.Sprintf("cycle_start must be a day of the month, not %d", t.CycleDay))
+	}
+	for i, tier := range t.Tiers {
+		last := i == len(t.Tiers)-1
+		switch {
+		case last && tier.UpTo != 0:
+			problems = append(problems, "the last tier must not have up_to")
+		case !last && tier.UpTo <= 0:
+			problems = append(problems, fmt.Sprintf("tier %d needs a positive up_to", i+1))
+		case !last && i > 0 && tier.UpTo <= t.Tiers[i-1].UpTo:
+			problems = append(problems, fmt.Sprintf("tier %d must go up to more than tier %d", i+1, i))
+		}
+	}
+	s := &schedule{tariff: t}
+	for i := range t.Periods {
+		p := period{Period: &t.Periods[i], end: 24}
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("period %d", i+1)
+		}
+		if len(p.Months) == 0 {
+			for m := range p.months {
+				p.months[m] = true
+			}
+		}
+		for _, m := range p.Months {
+			if m < 1 || m > 12 {
+				problems = append(problems, fmt.Sprintf("%s: months must be 1 to 12, not %d", name, m))
+				continue
+			}
+			p.months[m] = true
+		}
+		if len(p.Days) == 0 {
+			p.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		for _, day := range p.Days {
+			days, ok := dayNames[strings.ToLower(day)]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: days must be mon to sun, weekdays or weekends, not %q", name, day))
+			}
+			for _, d := range days {
+				p.days[d] = true
+			}
+		}
+		var err error
+		if p.Start != "" {
+			if p.start, err = parseHour(p.Start); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: start: %v", name, err))
+			}
+		}
+		if p.End != "" {
+			if p.end, err = parseHour(p.End); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: end: %v", name, err))
+			}
+			if p.end == 0 {
+				p.end = 24
+			}
+		}
+		s.periods = append(s.periods, p)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return s, nil
+}
+
+// parseHour parses a time of day on the hour, since energy is recorded by
+// the hour.
+func parseHour(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse time of day %q", s)
+	}
+	if t.Minute() != 0 {
+		return 0, fmt.Errorf("%q is not on the hour", s)
+	}
+	return t.Hour(), nil
+}
+
+// period returns the time-of-use period the hour starting at t falls in, or
+// nil.
+func (s *schedule) period(t time.Time) *period {
+	for i := range s.periods {
+		p := &s.periods[i]
+		if !p.months[t.Month()] || !p.days[t.Weekday()] {
+			continue
+		}
+		hour := t.Hour()
+		if p.start < p.end && hour >= p.start && hour < p.end ||
+			p.start >= p.end && (hour >= p.start || hour < p.end) {
+			return p
+		}
+	}
+	return nil
+}
+
+// importCost returns the cost of drawing kWh from the grid in the hour
+// starting at t, when cycle kWh have already been drawn in the billing
+// cycle, and the rate for the next kWh drawn.
+func (s *schedule) importCost(t time.Time, cycle, kWh float64) (cost, rate float64) {
+	if p := s.period(t); p != nil {
+		return kWh * p.Rate, p.Rate
+	}
+	tiers := s.tariff.Tiers
+	if len(tiers) == 0 {
+		return kWh * s.tariff.Rate, s.tariff.Rate
+	}
+	// Charge each tier's share of the energy at its rate.
+	used, end := cycle, cycle+kWh
+	for i, tier := range tiers {
+		if i < len(tiers)-1 && used >= tier.UpTo {
+			continue
+		}
+		upTo := end
+		if i < len(tiers)-1 {
+			upTo = min(end, tier.UpTo)
+		}
+		cost += (upTo - used) * tier.Rate
+		used = upTo
+		if used >= end {
+			return cost, tier.Rate
+		}
+	}
+	return cost, tiers[len(tiers)-1].Rate
+}
+
+// exportRate returns the credit for each kWh sent to the grid in the hour
+// starting at t.
+func (s *schedule) exportRate(t time.Time) float64 {
+	if p := s.period(t); p != nil && p.ExportRate != nil {
+		return *p.ExportRate
+	}
+	return s.tariff.ExportRate
+}
+
+// CycleStart returns when the billing cycle that t falls in started, in loc.
+func (t *Tariff) CycleStart(at time.Time, loc *time.Location) time.Time {
+	at = at.In(loc)
+	start := cycleStart(at.Year(), at.Month(), t.CycleDay, loc)
+	if at.Before(start) {
+		start = cycleStart(at.Year(), at.Month()-1, t.CycleDay, loc)
+	}
+	return start
+}
+
+// cycleStart returns the start of the billing cycle that starts on day in
+// the given month, or on its last day if it is shorter.
+func cycleStart(year int, month time.Month, day int, loc *time.Location) time.Time {
+	day = max(day, 1)
+	// The zeroth day of the next month is the last day of this one.
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+	return time.Date(year, month, min(day, last), 0, 0, 0, 0, loc)
+}
+
+// nextCycle returns the start of the billing cycle after the one starting at
+// start.
+func (t *Tariff) nextCycle(start time.Time, loc *time.Location) time.Time {
+	// Every cycle starts between the 1st and 31st of its month, so the
+	// cycle after start's starts in the month after start's.
+	next := time.Date(start.Year(), start.Month()+1, 1, 0, 0, 0, 0, loc)
+	return cycleStart(next.Year(), next.Month(), t.CycleDay, loc)
+}
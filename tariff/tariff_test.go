@@ -0,0 +1,137 @@
+package tariff_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/energy"
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/tariff"
+)
+
+func date(year int, month time.Month, day, hour int) time.Time {
+	return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+}
+
+// hour returns the energy drawn from the grid in the hour starting at t, and
+// used by the kettle.
+func hour(t time.Time, kWh float64) energy.Bucket {
+	return energy.Bucket{Start: t, End: t.Add(time.Hour), Energy: map[energy.Meter]float64{
+		energy.GridImport:            kWh,
+		energy.DeviceMeter("kettle"): kWh,
+	}}
+}
+
+func bills(t *testing.T, tf *tariff.Tariff, hours []energy.Bucket, start, end time.Time, by tariff.Grouping) []tariff.Bill {
+	t.Helper()
+	bills, err := tf.Bills(hours, start, end, by, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bills
+}
+
+func checkAmount(t *testing.T, what string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("got %v %s, want %v", got, what, want)
+	}
+}
+
+func TestTiers(t *testing.T) {
+	tf := &tariff.Tariff{Tiers: []tariff.Tier{{UpTo: 10, Rate: 0.1}, {UpTo: 20, Rate: 0.2}, {Rate: 0.3}}}
+	start := date(2024, 3, 1, 0)
+	hours := []energy.Bucket{
+		// Before the range, but in the same billing cycle, so it counts
+		// towards the tiers.
+		hour(start, 8),
+		// 2 kWh in the first tier and 3 in the second.
+		hour(start.Add(time.Hour), 5),
+		// 7 kWh in the second tier and 3 in the last.
+		hour(start.Add(2*time.Hour), 10),
+		// A new billing cycle starts back in the first tier.
+		hour(date(2024, 4, 1, 0), 5),
+	}
+	got := bills(t, tf, hours, start.Add(time.Hour), date(2024, 4, 2, 0), tariff.ByCycle)
+	if len(got) != 2 {
+		t.Fatalf("got %d bills, want one for each billing cycle", len(got))
+	}
+	checkAmount(t, "kWh in March", got[0].ImportKWh, 15)
+	checkAmount(t, "for March", got[0].ImportCost, 2*0.1+3*0.2+7*0.2+3*0.3)
+	checkAmount(t, "for April", got[1].ImportCost, 5*0.1)
+	// Each hour's device energy is charged at the rate for the next kWh
+	// drawn.
+	checkAmount(t, "for the kettle in March", got[0].DeviceCost["kettle"], 5*0.2+10*0.3)
+}
+
+func TestOvernightPeriod(t *testing.T) {
+	cheap := 0.01
+	tf := &tariff.Tariff{
+		Rate:       0.2,
+		ExportRate: 0.04,
+		Periods: []tariff.Period{
+			{Name: "weekend", Days: []string{"weekends"}, Start: "12:00", End: "13:00", Rate: 0.5},
+			{Name: "overnight", Start: "23:00", End: "07:00", Rate: 0.05, ExportRate: &cheap},
+		},
+	}
+	if err := tf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Friday evening to Saturday afternoon, 1 kWh an hour.
+	start := date(2024, 3, 1, 22)
+	var hours []energy.Bucket
+	for h := 0; h < 16; h++ {
+		bucket := hour(start.Add(time.Duration(h)*time.Hour), 1)
+		bucket.Energy[energy.GridExport] = 1
+		hours = append(hours, bucket)
+	}
+	got := bills(t, tf, hours, start, start.Add(16*time.Hour), tariff.ByRange)
+	if len(got) != 1 {
+		t.Fatalf("got %d bills, want 1", len(got))
+	}
+	// 22:00 and 07:00 to 12:00 at the flat rate, 23:00 to 07:00 overnight,
+	// and 12:00 to 13:00 on Saturday at the weekend rate.
+	checkAmount(t, "for the energy", got[0].ImportCost, 6*0.2+8*0.05+0.5+0.2)
+	checkAmount(t, "credit", got[0].ExportCredit, 8*0.04+8*cheap)
+}
+
+func TestCycleStart(t *testing.T) {
+	tf := &tariff.Tariff{CycleDay: 31}
+	for _, test := range []struct {
+		at, want time.Time
+	}{
+		{date(2024, 3, 15, 12), date(2024, 2, 29, 0)},
+		{date(2024, 2, 29, 0), date(2024, 2, 29, 0)},
+		{date(2024, 2, 28, 23), date(2024, 1, 31, 0)},
+		{date(2024, 3, 31, 1), date(2024, 3, 31, 0)},
+		{date(2024, 5, 1, 0), date(2024, 4, 30, 0)},
+	} {
+		if got := tf.CycleStart(test.at, time.UTC); !got.Equal(test.want) {
+			t.Errorf("got cycle start %v for %v, want %v", got, test.at, test.want)
+		}
+	}
+
+	got := bills(t, tf, nil, date(2024, 2, 1, 0), date(2024, 4, 1, 0), tariff.ByCycle)
+	want := []time.Time{date(2024, 2, 1, 0), date(2024, 2, 29, 0), date(2024, 3, 31, 0), date(2024, 4, 1, 0)}
+	if len(got) != len(want)-1 {
+		t.Fatalf("got %d bills, want %d", len(got), len(want)-1)
+	}
+	for i, bill := range got {
+		if !bill.Start.Equal(want[i]) || !bill.End.Equal(want[i+1]) {
+			t.Errorf("got bill from %v to %v, want %v to %v", bill.Start, bill.End, want[i], want[i+1])
+		}
+	}
+}
+
+func TestFromMonitor(t *testing.T) {
+	tf := tariff.FromMonitor(sense.MonitorAttributes{Cost: 14.5, SellBackRate: 5, CycleStart: 15}, 12)
+	checkAmount(t, "rate", tf.Rate, 0.145)
+	checkAmount(t, "export rate", tf.ExportRate, 0.05)
+	if tf.CycleDay != 15 {
+		t.Errorf("got cycle day %d, want 15", tf.CycleDay)
+	}
+	// Without a cost set, the default is used.
+	tf = tariff.FromMonitor(sense.MonitorAttributes{}, 12)
+	checkAmount(t, "default rate", tf.Rate, 0.12)
+}
@@ -0,0 +1,96 @@
+package timeline
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/adamroach/sense-logger/internal/sqlitedsn"
+)
+
+// File is the name of the run history database in a monitor's directory.
+const File = "timeline.db"
+
+// schema creates the runs table, if it doesn't already exist. Times are Unix
+// seconds.
+const schema = `
+PRAGMA journal_mode = WAL;
+
+CREATE TABLE IF NOT EXISTS runs (
+	device_id   TEXT NOT NULL,
+	device_name TEXT NOT NULL,
+	start       INTEGER NOT NULL,
+	end         INTEGER NOT NULL,
+	energy_wh   REAL NOT NULL,
+	peak_watts  REAL NOT NULL,
+	interrupted INTEGER NOT NULL,
+	PRIMARY KEY (device_id, start)
+) WITHOUT ROWID;
+
+CREATE INDEX IF NOT EXISTS runs_start ON runs (start);
+`
+
+// Store is the run history of one monitor's devices.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens (creating, if necessary) the run history in directory.
+func Open(directory string) (*Store, error) {
+	path := filepath.Join(directory, File)
+	db, err := sql.Open("sqlite3", sqlitedsn.File(path))
+	if err != nil {
+		return nil, fmt.Errorf("error opening database %v: %w", path, err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables in %v: %w", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Add records a completed run.
+func (s *Store) Add(run Run) error {
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO runs
+		(device_id, device_name, start, end, energy_wh, peak_watts, interrupted)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		run.DeviceID, run.DeviceName, run.Start.Unix(), run.End.Unix(), run.EnergyWh, run.PeakWatts, run.Interrupted)
+	if err != nil {
+		return fmt.Errorf("error storing run of %v: %w", run.DeviceID, err)
+	}
+	return nil
+}
+
+// Runs returns the runs that overlap the time between start and end, oldest
+// first, for the device with the given ID, or for every device if id is
+// empty.
+func (s *Store) Runs(id string, start, end time.Time) ([]Run, error) {
+	rows, err := s.db.Query(`
+		SELECT device_id, device_name, start, end, energy_wh, peak_watts, interrupted FROM runs
+		WHERE end >= ? AND start < ? AND (? = '' OR device_id = ?)
+		ORDER BY start, device_id`, start.Unix(), end.Unix(), id, id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading runs: %w", err)
+	}
+	defer rows.Close()
+	var runs []Run
+	for rows.Next() {
+		var run Run
+		var start, end int64
+		err := rows.Scan(&run.DeviceID, &run.DeviceName, &start, &end, &run.EnergyWh, &run.PeakWatts, &run.Interrupted)
+		if err != nil {
+			return nil, fmt.Errorf("error reading runs: %w", err)
+		}
+		run.Start, run.End = time.Unix(start, 0), time.Unix(end, 0)
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,230 @@
+// Package timeline works out when devices turn on and off from the realtime
+// feed, and keeps a history of their runs: when each started and ended, and
+// the energy it used.
+package timeline
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+)
+
+// EventType is whether a device turned on or off.
+type EventType string
+
+const (
+	On  EventType = "on"
+	Off EventType = "off"
+)
+
+// Run is one stretch of a device being on.
+type Run struct {
+	DeviceID   string    `json:"device_id"`
+	DeviceName string    `json:"device_name"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	EnergyWh   float64   `json:"energy_wh"`
+	PeakWatts  float64   `json:"peak_watts"`
+	// Interrupted is set if the run was cut short by the readings stopping,
+	// rather than ended by the device turning off.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// Duration returns the length of the run.
+func (r Run) Duration() time.Duration {
+	return r.End.Sub(r.Start)
+}
+
+// Event is a device turning on or off. For On, the Run has only started;
+// for Off, it is complete.
+type Event struct {
+	Type EventType
+	Time time.Time
+	Run  Run
+}
+
+// untracked are the pseudo-devices that are always in the feed, and so
+// never turn on or off.
+var untracked = []string{"always_on", "unknown", "solar"}
+
+// MaxInterval is the longest time between two updates that a run continues
+// across. Longer, and the runs in progress are ended, interrupted, at the
+// last update before the gap.
+const MaxInterval = 2 * time.Minute
+
+// Tracker follows the state of every device in one monitor's realtime
+// updates. A device is on while it is in an update, drawing more than its
+// standby threshold, and not marked idle. It turns off once it has been
+// below its threshold (or idle, or missing) for its standby hysteresis.
+type Tracker struct {
+	devices map[string]*deviceState
+	last    time.Time
+}
+
+type deviceState struct {
+	on         bool
+	run        Run
+	watts      float64   // the latest reading
+	below      time.Time // when the device last went from on to below its threshold
+	energy     float64   // the run's energy at that time
+	hysteresis time.Duration
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{devices: map[string]*deviceState{}}
+}
+
+// Observe takes the next realtime update and returns the events it causes,
+// in no particular order.
+func (t *Tracker) Observe(update *sense.RealtimeUpdate) []Event {
+	now := time.Unix(update.Payload.EpochTimestamp, 0)
+	if !now.After(t.last) {
+		return nil
+	}
+	var events []Event
+	if !t.last.IsZero() && now.Sub(t.last) > MaxInterval {
+		events = t.Stop()
+	}
+	elapsed := now.Sub(t.last).Hours()
+	if t.last.IsZero() {
+		elapsed = 0
+	}
+
+	present := make(map[string]*sense.Device, len(update.Payload.Devices))
+	for i := range update.Payload.Devices {
+		device := &update.Payload.Devices[i]
+		if device.ID == "" || slices.Contains(untracked, device.ID) {
+			continue
+		}
+		present[device.ID] = device
+		if t.devices[device.ID] == nil {
+			t.devices[device.ID] = &deviceState{}
+		}
+	}
+
+	for id, state := range t.devices {
+		if state.on {
+			// The energy used since the last update, at the power it was
+			// drawing then.
+			state.run.EnergyWh += state.watts * elapsed
+		}
+		device := present[id]
+		watts, active := 0.0, false
+		if device != nil {
+			if device.Watts != nil {
+				watts = *device.Watts
+			}
+			threshold, hysteresis := standby(device)
+			active = watts > threshold && !slices.Contains(device.Attrs, sense.AttrIdle)
+			state.hysteresis = hysteresis
+			state.run.DeviceName = device.Name
+		}
+		state.watts = watts
+
+		switch {
+		case active && !state.on:
+			state.on = true
+			state.below = time.Time{}
+			state.run = Run{DeviceID: id, DeviceName: state.run.DeviceName, Start: now, PeakWatts: watts}
+			events = append(events, Event{Type: On, Time: now, Run: state.run})
+		case active:
+			state.below = time.Time{}
+			state.run.PeakWatts = max(state.run.PeakWatts, watts)
+		case state.on:
+			if state.below.IsZero() {
+				state.below = now
+				state.energy = state.run.EnergyWh
+			}
+			if now.Sub(state.below) >= state.hysteresis {
+				// The run ended when the device went below its threshold.
+				state.on = false
+				state.run.End = state.below
+				state.run.EnergyWh = state.energy
+				events = append(events, Event{Type: Off, Time: state.below, Run: state.run})
+			}
+		}
+		if !state.on && device == nil {
+			delete(t.devices, id)
+		}
+	}
+	t.last = now
+	return events
+}
+
+// Resume picks up runs left in progress by an earlier Tracker, as returned
+// by its Open, or as recorded before its process crashed: the device of each run is
+// taken to have been on since the run's Start, as of last, the time of the
+// last update it saw. If the next update comes more than MaxInterval after
+// last, the runs end there, interrupted; otherwise they carry on, and a
+// device that is still on isn't reported as turning on again.
+func (t *Tracker) Resume(runs []Run, last time.Time) {
+	for _, run := range runs {
+		if slices.Contains(untracked, run.DeviceID) {
+			continue
+		}
+		t.devices[run.DeviceID] = &deviceState{on: true, run: run}
+		if run.Start.After(last) {
+			last = run.Start
+		}
+	}
+	if last.After(t.last) {
+		t.last = last
+	}
+}
+
+// Open returns the runs in progress, with the energy they have used so far,
+// and the time of the last update, to pass to Resume in a later Tracker.
+func (t *Tracker) Open() (runs []Run, last time.Time) {
+	for _, state := range t.devices {
+		if state.on {
+			runs = append(runs, state.run)
+		}
+	}
+	slices.SortFunc(runs, func(a, b Run) int { return strings.Compare(a.DeviceID, b.DeviceID) })
+	return runs, t.last
+}
+
+// Clone returns a copy of the Tracker that can be advanced without changing
+// this one.
+func (t *Tracker) Clone() *Tracker {
+	clone := &Tracker{devices: make(map[string]*deviceState, len(t.devices)), last: t.last}
+	for id, state := range t.devices {
+		copied := *state
+		clone.devices[id] = &copied
+	}
+	return clone
+}
+
+// Stop ends every run in progress, interrupted, at the time of the last
+// update, and returns the Off events.
+func (t *Tracker) Stop() []Event {
+	var events []Event
+	for id, state := range t.devices {
+		if state.on {
+			state.run.End = t.last
+			state.run.Interrupted = true
+			events = append(events, Event{Type: Off, Time: t.last, Run: state.run})
+		}
+		delete(t.devices, id)
+	}
+	return events
+}
+
+// standby returns the power a device must draw to count as on, and how long
+// it must stay below that to count as off, from its standby configuration.
+func standby(device *sense.Device) (threshold float64, hysteresis time.Duration) {
+	config := device.StandbyConfig
+	if config == nil {
+		return 0, 0
+	}
+	watts, seconds := config.StandbyThresholdWatt, config.StandbyHysteresisSec
+	if watts == 0 {
+		watts = config.DefaultStandbyThresholdWatt
+	}
+	if seconds == 0 {
+		seconds = config.DefaultStandbyHysteresisSec
+	}
+	return float64(watts), time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,155 @@
+package timeline_test
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/timeline"
+)
+
+var start = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func at(seconds int) time.Time {
+	return start.Add(time.Duration(seconds) * time.Second)
+}
+
+// kettle is on above 100 W, and off after 10 seconds below that.
+func kettle(watts float64, attrs ...sense.Attr) sense.Device {
+	return sense.Device{ID: "kettle", Name: "Kettle", Watts: &watts, Attrs: attrs,
+		StandbyConfig: &sense.StandbyConfig{DefaultStandbyThresholdWatt: 50, StandbyThresholdWatt: 100, DefaultStandbyHysteresisSec: 10}}
+}
+
+func update(seconds int, devices ...sense.Device) *sense.RealtimeUpdate {
+	return &sense.RealtimeUpdate{Payload: sense.RealtimeUpdatePayload{EpochTimestamp: at(seconds).Unix(), Devices: devices}}
+}
+
+// describe returns events as "type device@seconds", sorted, with the energy
+// and peak of each Off.
+func describe(events []timeline.Event) []string {
+	var list []string
+	for _, event := range events {
+		s := fmt.Sprintf("%s %s@%d", event.Type, event.Run.DeviceID, int(event.Time.Sub(start).Seconds()))
+		if event.Type == timeline.Off {
+			s += fmt.Sprintf(" from %d, %.2f Wh, peak %.0f W", int(event.Run.Start.Sub(start).Seconds()), event.Run.EnergyWh, event.Run.PeakWatts)
+			if event.Run.Interrupted {
+				s += ", interrupted"
+			}
+		}
+		list = append(list, s)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func checkEvents(t *testing.T, got []timeline.Event, want ...string) {
+	t.Helper()
+	list := describe(got)
+	if len(list) != len(want) {
+		t.Fatalf("got events %q, want %q", list, want)
+	}
+	for i := range want {
+		if list[i] != want[i] {
+			t.Errorf("got event %q, want %q", list[i], want[i])
+		}
+	}
+}
+
+func TestTrackerThresholdAndHysteresis(t *testing.T) {
+	tracker := timeline.NewTracker()
+	// Below the device's own threshold, though above the default, it isn't
+	// on.
+	checkEvents(t, tracker.Observe(update(0, kettle(80))))
+	checkEvents(t, tracker.Observe(update(1, kettle(1800))), "on kettle@1")
+	checkEvents(t, tracker.Observe(update(2, kettle(2000))))
+	// A dip shorter than the hysteresis doesn't end the run.
+	checkEvents(t, tracker.Observe(update(3, kettle(10))))
+	checkEvents(t, tracker.Observe(update(5, kettle(1800))))
+	// It ends when the kettle went below its threshold, with the energy
+	// used until then: 1800 W for 1 s, 2000 W for 1 s, 10 W for 2 s and
+	// 1800 W for 1 s.
+	checkEvents(t, tracker.Observe(update(6)))
+	want := (1800 + 2000 + 2*10 + 1800) / 3600.0
+	events := tracker.Observe(update(16))
+	if len(events) != 1 || math.Abs(events[0].Run.EnergyWh-want) > 1e-9 {
+		t.Fatalf("got %q, want the run to end with %.4f Wh", describe(events), want)
+	}
+	checkEvents(t, events, fmt.Sprintf("off kettle@6 from 1, %.2f Wh, peak 2000 W", want))
+	if events[0].Run.DeviceName != "Kettle" || events[0].Run.Duration() != 5*time.Second {
+		t.Errorf("got run %+v, want the kettle's, 5s long", events[0].Run)
+	}
+
+	// Updates that don't move time forward are ignored.
+	checkEvents(t, tracker.Observe(update(10, kettle(1800))))
+}
+
+func TestTrackerIdle(t *testing.T) {
+	tracker := timeline.NewTracker()
+	checkEvents(t, tracker.Observe(update(0, kettle(1800))), "on kettle@0")
+	// Sense marking the device idle counts as below the threshold.
+	checkEvents(t, tracker.Observe(update(1, kettle(1800, sense.AttrIdle))))
+	checkEvents(t, tracker.Observe(update(11, kettle(1800, sense.AttrIdle))), "off kettle@1 from 0, 0.50 Wh, peak 1800 W")
+
+	// Untracked pseudo-devices never turn on.
+	watts := 500.0
+	checkEvents(t, tracker.Observe(update(12, sense.Device{ID: "always_on", Watts: &watts}, sense.Device{ID: "unknown", Watts: &watts})))
+}
+
+func TestTrackerGap(t *testing.T) {
+	tracker := timeline.NewTracker()
+	checkEvents(t, tracker.Observe(update(0, kettle(1800))), "on kettle@0")
+	checkEvents(t, tracker.Observe(update(60, kettle(1800))))
+	// After more than MaxInterval without updates, the run ends,
+	// interrupted, at the last update, and a new one starts.
+	later := 60 + int(timeline.MaxInterval.Seconds()) + 1
+	checkEvents(t, tracker.Observe(update(later, kettle(1800))),
+		"off kettle@60 from 0, 30.00 Wh, peak 1800 W, interrupted",
+		fmt.Sprintf("on kettle@%d", later))
+
+	events := tracker.Stop()
+	checkEvents(t, events, fmt.Sprintf("off kettle@%d from %d, 0.00 Wh, peak 1800 W, interrupted", later, later))
+}
+
+func TestTrackerResume(t *testing.T) {
+	tracker := timeline.NewTracker()
+	tracker.Observe(update(0, kettle(1800)))
+	tracker.Observe(update(10, kettle(1800)))
+	runs, last := tracker.Open()
+	if len(runs) != 1 || runs[0].DeviceID != "kettle" || !last.Equal(at(10)) {
+		t.Fatalf("got open runs %+v as of %v, want the kettle's as of %v", runs, last, at(10))
+	}
+
+	// A resumed run carries on, without turning on again, and keeps the
+	// energy it had used; the time between the two Trackers' updates has no
+	// reading to count.
+	resumed := timeline.NewTracker()
+	resumed.Resume(runs, last)
+	checkEvents(t, resumed.Observe(update(11, kettle(1800))))
+	checkEvents(t, resumed.Observe(update(12)))
+	checkEvents(t, resumed.Observe(update(22)), "off kettle@12 from 0, 5.50 Wh, peak 1800 W")
+
+	// One resumed after too long ends, interrupted, when the readings
+	// stopped.
+	resumed = timeline.NewTracker()
+	resumed.Resume(runs, last)
+	checkEvents(t, resumed.Observe(update(600, kettle(1800))),
+		"off kettle@10 from 0, 5.00 Wh, peak 1800 W, interrupted",
+		"on kettle@600")
+}
+
+func TestTrackerClone(t *testing.T) {
+	tracker := timeline.NewTracker()
+	tracker.Observe(update(0, kettle(1800)))
+	clone := tracker.Clone()
+	clone.Observe(update(1))
+	clone.Observe(update(20))
+	if runs, _ := clone.Open(); len(runs) != 0 {
+		t.Errorf("got %d runs open in the clone, want 0", len(runs))
+	}
+	if runs, last := tracker.Open(); len(runs) != 1 || !last.Equal(at(0)) {
+		t.Errorf("got %d runs open as of %v in the original, want it unchanged", len(runs), last)
+	}
+}
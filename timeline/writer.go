@@ -0,0 +1,128 @@
+package timeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/adamroach/sense-logger/internal/atomicfile"
+	"github.com/adamroach/sense-logger/sense"
+	"github.com/adamroach/sense-logger/sink"
+)
+
+// StateFile is the name of the file, beside the run history, that holds the
+// runs in progress.
+const StateFile = "timeline-state.json"
+
+var _ sink.Sink = (*Writer)(nil)
+
+// Writer is a sink that tracks one monitor's devices turning on and off, and
+// adds each run to the run history as it ends. The runs in progress, and the
+// time of the last update, are saved when the Writer is closed, whenever a
+// device turns on or off, and at least once a minute, so that the next
+// Writer carries them on; after a crash, a run that has gone on since may
+// end up to a minute early.
+type Writer struct {
+	directory string
+	tracker   *Tracker
+	store     *Store
+	onEvent   func(Event)
+	saved     time.Time
+}
+
+type state struct {
+	Runs []Run     `json:"runs"`
+	Last time.Time `json:"last"`
+}
+
+// NewWriter returns a Writer that keeps the run history in directory, which
+// is created if it does not already exist, and resumes the runs an earlier
+// Writer left in progress there. onEvent, if not nil, is called with every
+// device turning on or off.
+func NewWriter(directory string, onEvent func(Event)) (*Writer, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory %v: %w", directory, err)
+	}
+	store, err := Open(directory)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{directory: directory, tracker: NewTracker(), store: store, onEvent: onEvent}
+	data, err := os.ReadFile(filepath.Join(directory, StateFile))
+	if err == nil {
+		var s state
+		if err := json.Unmarshal(data, &s); err != nil {
+			log.Printf("Ignoring runs in progress: error decoding JSON file %v: %v\n", StateFile, err)
+		} else {
+			w.tracker.Resume(s.Runs, s.Last)
+		}
+	} else if !os.IsNotExist(err) {
+		store.Close()
+		return nil, fmt.Errorf("error reading %v: %w", StateFile, err)
+	}
+	return w, nil
+}
+
+func (w *Writer) Write(update *sense.RealtimeUpdate) error {
+	events := w.tracker.Observe(update)
+	err := w.record(events)
+	if len(events) > 0 || time.Since(w.saved) >= time.Minute {
+		if saveErr := w.save(); err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// record stores the runs that events end, and passes the events on.
+func (w *Writer) record(events []Event) error {
+	var firstErr error
+	for _, event := range events {
+		if event.Type == Off {
+			if err := w.store.Add(event.Run); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if w.onEvent != nil {
+			w.onEvent(event)
+		}
+	}
+	return firstErr
+}
+
+// UpdateDevices does nothing; the names recorded are the ones in the
+// realtime updates.
+func (w *Writer) UpdateDevices(devices []sense.Device) error {
+	return nil
+}
+
+// Flush does nothing, since every run is stored as it ends.
+func (w *Writer) Flush() error {
+	return nil
+}
+
+// Close saves the runs still in progress, for the next Writer to carry on,
+// and closes the run history.
+func (w *Writer) Close() error {
+	err := w.save()
+	if closeErr := w.store.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// save writes the runs in progress to the state file.
+func (w *Writer) save() error {
+	w.saved = time.Now()
+	runs, last := w.tracker.Open()
+	if last.IsZero() {
+		return nil
+	}
+	if runs == nil {
+		runs = []Run{}
+	}
+	return atomicfile.WriteJSON(filepath.Join(w.directory, StateFile), 0644, state{Runs: runs, Last: last})
+}
@@ -0,0 +1,93 @@
+package timeline_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adamroach/sense-logger/timeline"
+)
+
+func newWriter(t *testing.T, directory string) *timeline.Writer {
+	t.Helper()
+	w, err := timeline.NewWriter(directory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func runs(t *testing.T, directory string) []timeline.Run {
+	t.Helper()
+	store, err := timeline.Open(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	runs, err := store.Runs("", at(0), at(3600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runs
+}
+
+func TestWriterResumesAfterRestart(t *testing.T) {
+	directory := t.TempDir()
+	w := newWriter(t, directory)
+	w.Write(update(0, kettle(1800)))
+	w.Write(update(10, kettle(1800)))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing doesn't end the run.
+	if got := runs(t, directory); len(got) != 0 {
+		t.Fatalf("got runs %+v after closing, want none", got)
+	}
+
+	// The next Writer carries it on, so it is stored once, whole.
+	w = newWriter(t, directory)
+	w.Write(update(11, kettle(1800)))
+	w.Write(update(12))
+	w.Write(update(22))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := runs(t, directory)
+	if len(got) != 1 || !got[0].Start.Equal(at(0)) || !got[0].End.Equal(at(12)) || got[0].Interrupted {
+		t.Errorf("got runs %+v, want one from 0s to 12s", got)
+	}
+}
+
+func TestWriterAfterCrash(t *testing.T) {
+	directory := t.TempDir()
+	// The process dies without closing the Writer; the run was saved when
+	// it started.
+	w := newWriter(t, directory)
+	w.Write(update(0, kettle(1800)))
+	w.Write(update(10, kettle(1800)))
+
+	// Restarted long after, the run ends, interrupted, where it was last
+	// saved.
+	w = newWriter(t, directory)
+	w.Write(update(600))
+	w.Close()
+	got := runs(t, directory)
+	if len(got) != 1 || !got[0].Start.Equal(at(0)) || !got[0].End.Equal(at(0)) || !got[0].Interrupted {
+		t.Errorf("got runs %+v, want one interrupted at 0s", got)
+	}
+}
+
+func TestWriterIgnoresCorruptState(t *testing.T) {
+	directory := t.TempDir()
+	if err := os.WriteFile(filepath.Join(directory, timeline.StateFile), []byte(`{"runs": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := newWriter(t, directory)
+	w.Write(update(0, kettle(1800)))
+	w.Write(update(1))
+	w.Write(update(11))
+	w.Close()
+	if got := runs(t, directory); len(got) != 1 {
+		t.Errorf("got runs %+v, want the run recorded without the state file", got)
+	}
+}